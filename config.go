@@ -1,6 +1,10 @@
 package gateway
 
 import (
+	"time"
+
+	"github.com/zeromicro/go-zero/core/discov"
+	"github.com/zeromicro/go-zero/core/stores/redis"
 	"github.com/zeromicro/go-zero/rest"
 	"github.com/zeromicro/go-zero/zrpc"
 )
@@ -10,7 +14,7 @@ type (
 	GatewayConf struct {
 		rest.RestConf
 		Upstreams []Upstream
-		//管理后台相关权限rpc服务
+		//管理后台相关权限rpc服务，jzAuth 创建时连接，修改需要重启
 		AccessControlRpc zrpc.RpcClientConf
 		//是否校验强制登录map
 		AuthCheckMapping map[string]map[string]bool `json:",optional"`
@@ -22,6 +26,122 @@ type (
 		Safe Safe
 		//php内部调用sign
 		SignKey string
+		// Sign 内部调用的签名版本和每个调用方的密钥，未配置时只支持 SignKey 的 md5 签名
+		Sign SignConf `json:",optional"`
+		// AuthKey 管理后台 jwt 的密钥，等同于 Jwt.Keys 中一个没有 kid 的密钥，修改需要重启
+		AuthKey string `json:",optional"`
+		// Jwt jzAuth 在本地校验管理后台的 jwt，无法在本地校验时调用 accessControl 的 ParseAuthToken
+		Jwt JwtConf `json:",optional"`
+		// Revocation jzAuth 吊销的用户 ID 和 security_key 指纹，未配置时不检查，在 jzAuth 初始化时读取，修改需要重启
+		Revocation RevocationConf `json:",optional"`
+		// AuthCache jzAuth 缓存 ParseAuthToken 和 VerifyFuncControl 的结果，未配置时不缓存，在 jzAuth 初始化时读取，修改需要重启
+		AuthCache *AuthCacheConf `json:",optional"`
+		// SignReplay php 内部调用 sign 的防重放，未配置时不检查 timestamp 和 nonce，在 jzAuth 初始化时读取，修改需要重启
+		SignReplay *SignReplayConf `json:",optional"`
+		// Reload 配置热更新，未配置则不监听
+		Reload ReloadConf `json:",optional"`
+		// DescriptorRefresh 定期重新获取上游的反射描述，变化后重建路由，默认为 0，只在调用返回 Unimplemented 后刷新
+		DescriptorRefresh time.Duration `json:",optional"`
+		// Errors gRPC 错误的输出方式
+		Errors ErrorConf `json:",optional"`
+		// Formatter 非流式方法的响应格式，raw、jz-envelope、problem+json 或通过 RegisterFormatter 注册的名称
+		// 为空时成功的响应由插件输出，失败时输出 {code,msg,data}
+		Formatter string `json:",optional"`
+		// ReadyPath 就绪检查的路径，如 /readyz，所有插件的 HealthCheck 通过时返回 200，否则返回 503，为空不注册
+		ReadyPath string `json:",optional"`
+		// WebSocketOrigins WebSocket 路由允许的 Origin，如 https://app.example.com、https://*.example.com，
+		// 为空时允许所有 Origin；没有 Origin 头的服务端调用方总是允许
+		WebSocketOrigins []string `json:",optional"`
+		// TrustedProxies 受信任的代理网段，如 10.0.0.0/8，请求来自这些地址时才按 X-Forwarded-For 确定客户端 IP，
+		// 为空时客户端 IP 为连接的对端地址，用于插件的 When.CIDRs
+		TrustedProxies []string `json:",optional"`
+		// DescriptorCache 反射描述的缓存目录，反射成功后保存，启动时反射不可用则使用缓存，为空不缓存
+		DescriptorCache string `json:",optional"`
+		// Redis 插件共用的 redis，如 rateLimit 的集群限流，未配置时插件只能使用内存，在插件初始化时连接，修改需要重启
+		Redis redis.RedisConf `json:",optional"`
+	}
+
+	// AuthCacheConf jzAuth 调用 accessControl 结果的缓存
+	AuthCacheConf struct {
+		// TokenTTL ParseAuthToken 成功结果的缓存时间，不超过 token 的 expire_time
+		TokenTTL time.Duration `json:",default=5m"`
+		// FuncTTL VerifyFuncControl 通过的缓存时间
+		FuncTTL time.Duration `json:",default=1m"`
+		// NegativeTTL token 无效、没有权限等失败结果的缓存时间，为 0 时不缓存；accessControl 不可用的错误不缓存
+		NegativeTTL time.Duration `json:",default=5s"`
+		// StaleTTL 成功的结果过期后继续保留的时间，accessControl 不可用时使用，不超过 token 的 expire_time，为 0 时不保留
+		StaleTTL time.Duration `json:",default=10m"`
+		// Timeout 调用 accessControl 的超时时间，同一个 key 的请求共用一次调用，不受发起调用的请求取消的影响
+		Timeout time.Duration `json:",default=3s"`
+		// Limit 最多缓存的条数
+		Limit int `json:",default=100000"`
+	}
+
+	// SignConf 内部调用的签名，按请求头 X-Sign-Version 选择版本，为空时为 md5
+	SignConf struct {
+		// Keys 每个调用方的 hmac-sha256 密钥，按请求头 X-Sign-Key-Id 选择
+		Keys []SignKeyConf `json:",optional"`
+		// DisableMd5 不再接受 SignKey 的 md5 签名，所有调用方迁移后开启
+		DisableMd5 bool `json:",optional"`
+	}
+
+	// SignKeyConf 一个调用方的签名密钥
+	SignKeyConf struct {
+		// Kid 调用方的密钥 ID，如服务名
+		Kid    string
+		Secret string
+	}
+
+	// SignReplayConf sign 请求的防重放，timestamp 必须在 Window 内，带 nonce 的请求在 2 倍 Window 内不能重复
+	SignReplayConf struct {
+		// Window timestamp 与网关时间允许的最大偏差
+		Window time.Duration `json:",default=5m"`
+		// RequireNonce 是否必须携带 nonce
+		RequireNonce bool `json:",optional"`
+		// Store 已使用的 nonce 保存在 memory 本机内存或 redis 集群共享，redis 不可用时退化为本机内存
+		Store string `json:",default=memory,options=memory|redis"`
+		// Code 过期和重放请求返回的业务码
+		Code uint32 `json:",default=1005"`
+	}
+
+	// JwtConf 管理后台 jwt 的本地校验，未配置密钥时不在本地校验；在 jzAuth 初始化时读取，修改后需要重启
+	JwtConf struct {
+		// Keys 校验签名的密钥，token 头部有 kid 时按 kid 选择，否则依次尝试；轮换时同时配置新旧密钥
+		Keys []JwtKey `json:",optional"`
+		// Issuer 不为空时校验 iss，如 jzkj
+		Issuer string `json:",optional"`
+		// Leeway 校验 exp、nbf 时允许的时钟偏差
+		Leeway time.Duration `json:",optional"`
+	}
+
+	// JwtKey jwt 的密钥，Secret 和 PublicKey 配置其中一个
+	JwtKey struct {
+		// Kid 密钥 ID，对应 token 头部的 kid
+		Kid string `json:",optional"`
+		// Secret HS256、HS384、HS512 的密钥
+		Secret string `json:",optional"`
+		// PublicKey PEM 格式的 RSA、ECDSA 或 Ed25519 公钥
+		PublicKey string `json:",optional"`
+	}
+
+	// RevocationConf 吊销列表，成员为用户 ID 或 security_key 的指纹，File 和 RedisKey 可以同时配置
+	RevocationConf struct {
+		// File 本地文件，每行一个成员，# 开头的行为注释
+		File string `json:",optional"`
+		// RedisKey 使用网关 Redis 中的 set
+		RedisKey string `json:",optional"`
+		// Interval 重新加载文件和 set 的间隔
+		Interval time.Duration `json:",default=10s"`
+	}
+
+	// ReloadConf 配置热更新，监听配置文件或 etcd，变化后重建 Upstreams 和 Mappings 对应的路由
+	ReloadConf struct {
+		// File 监听的配置文件，一般为启动时加载的配置文件
+		File string `json:",optional"`
+		// Interval 检查配置文件的间隔
+		Interval time.Duration `json:",default=10s"`
+		// Etcd 监听 etcd 中的配置，配置以 yaml 格式写入 Key/ 下的唯一一个 key，如 gateway/config/0
+		Etcd discov.EtcdConf `json:",optional"`
 	}
 
 	// RouteMapping is a mapping between a gateway route and an upstream rpc method.
@@ -36,11 +156,69 @@ type (
 		AuthCheck bool `json:",optional,default=true"`
 		// Plugins 单一路由的插件，将完全覆盖全局插件
 		Plugins []string `json:",optional"`
+		// PluginConfs 带参数的单一路由插件，如 - name: rateLimit, args: {qps: 50}，不能与 Plugins 同时配置
+		PluginConfs []PluginConf `json:",optional"`
 		// OrigName 单一路由控制 是否启用OriginName  未配置则使用 Upstream.OrigName
 		OrigName *bool `json:",optional"`
 		// VerifyFuncControl 功能权限检查，默认为不检查
 		VerifyFuncControl bool        `json:",optional,default=false"`
 		UriDispatch       UriDispatch `json:",optional"`
+		// Stream 服务端流式方法的输出方式，sse 或 ndjson，未配置则按 Accept 头选择，默认 sse
+		Stream string `json:",optional,options=sse|ndjson"`
+		// WebSocket 升级为 WebSocket 路由，用于客户端流式和双向流式方法，Method 必须为 get
+		WebSocket bool `json:",optional"`
+		// Errors 覆盖网关的 gRPC 错误输出方式，配置了的 HttpStatus 和 Details 以路由为准，Codes 与网关的合并
+		Errors *ErrorConf `json:",optional"`
+		// Formatter 覆盖网关的响应格式
+		Formatter string `json:",optional"`
+	}
+
+	// PluginConf 插件及其在路由上的参数
+	PluginConf struct {
+		Name string
+		// Args 插件参数，插件通过 RoutePlugin 在构造路由时读取
+		Args PluginArgs `json:",optional"`
+		// When 插件生效的条件，不满足时本次请求跳过这个插件，未配置时总是生效
+		When *PluginWhen `json:",optional"`
+	}
+
+	// PluginWhen 插件生效的条件，配置的条件都满足时生效
+	PluginWhen struct {
+		// Headers 请求头都存在
+		Headers []string `json:",optional"`
+		// Query query 参数等于给定的值，值为 * 时只要求存在
+		Query map[string]string `json:",optional"`
+		// CIDRs 客户端 IP 在任一网段内，如 10.0.0.0/8，客户端 IP 按 TrustedProxies 确定
+		CIDRs []string `json:",optional"`
+		// UserAgent User-Agent 匹配的正则
+		UserAgent string `json:",optional"`
+		// AppTypes 公共参数 app_type 为其中之一
+		AppTypes []string `json:",optional"`
+		// AppVersion 公共参数 appversion 满足的版本约束，如 >=3.2.0,<4
+		AppVersion string `json:",optional"`
+		// Not 条件取反，如 CIDRs 配置内网网段时对外网请求生效
+		Not bool `json:",optional"`
+	}
+
+	// ErrorConf gRPC 错误的输出方式，默认 HTTP 状态码为 200，业务码为 SERVER_COMMON_ERROR
+	ErrorConf struct {
+		// HttpStatus 按 gRPC 状态码返回标准的 HTTP 状态码，如 NotFound 返回 404，Unavailable 返回 503
+		// 路由上未配置时使用网关的配置
+		HttpStatus *bool `json:",optional"`
+		// Details 在 data 中输出 errdetails 的 BadRequest、RetryInfo 和 ErrorInfo，路由上未配置时使用网关的配置
+		Details *bool `json:",optional"`
+		// Codes 指定 gRPC 状态码对应的 HTTP 状态码和业务码
+		Codes []ErrorCode `json:",optional"`
+	}
+
+	// ErrorCode gRPC 状态码对应的 HTTP 状态码和业务码
+	ErrorCode struct {
+		// Code gRPC 状态码，如 NotFound、NOT_FOUND 或 5
+		Code string
+		// HttpStatus HTTP 状态码，未配置则按 ErrorConf.HttpStatus 确定
+		HttpStatus int `json:",optional"`
+		// BizCode 业务码，未配置则为 SERVER_COMMON_ERROR
+		BizCode uint32 `json:",optional"`
 	}
 
 	// Upstream is the configuration for an upstream.
@@ -53,11 +231,18 @@ type (
 		// if your proto file import another proto file, you need to write multi-file slice,
 		// like [hello.pb, common.pb].
 		ProtoSets []string `json:",optional"`
+		// ProtoFiles 直接编译的 .proto 文件，路径相对 ImportPaths，如 [hello/hello.proto]
+		// 被引用的文件也会从 ImportPaths 查找，google/protobuf 和 google/api 下的文件无需提供
+		ProtoFiles []string `json:",optional"`
+		// ImportPaths 编译 ProtoFiles 的查找目录，如服务仓库的 proto 目录
+		ImportPaths []string `json:",optional"`
 		// Mappings is the mapping between gateway routes and Upstream rpc methods.
 		// Keep it blank if annotations are added in rpc methods.
 		Mappings []RouteMapping `json:",optional"`
 		// Plugins 全局插件
 		Plugins []string `json:",optional"`
+		// PluginConfs 带参数的全局插件，不能与 Plugins 同时配置
+		PluginConfs []PluginConf `json:",optional"`
 		// OrigName  是否启用OriginName 默认不开启
 		OrigName bool `json:",optional,default=false"`
 	}
@@ -65,6 +250,8 @@ type (
 	Safe struct {
 		Key string
 		Iv  string
+		// ClockSkew 检查 security_key 的 expire_time 时允许的时钟偏差
+		ClockSkew time.Duration `json:",default=1m"`
 	}
 
 	UriDispatch struct {
@@ -0,0 +1,207 @@
+package gateway
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fullstorydev/grpcurl"
+	"github.com/jhump/protoreflect/grpcreflect"
+	"github.com/punpeo/pun-gateway-lib/internal"
+	"github.com/zeromicro/go-zero/core/logx"
+	"github.com/zeromicro/go-zero/core/metric"
+)
+
+const (
+	// refreshTimeout 一次获取反射描述的超时时间
+	refreshTimeout = 10 * time.Second
+	// minRefreshInterval Unimplemented 触发刷新的最小间隔
+	minRefreshInterval = 10 * time.Second
+	// cacheRetryInterval 关闭定期刷新时，使用描述缓存的上游重试反射的间隔
+	cacheRetryInterval = time.Minute
+)
+
+var (
+	descriptorChanges = metric.NewCounterVec(&metric.CounterVecOpts{
+		Namespace: "gateway",
+		Subsystem: "descriptor",
+		Name:      "changes_total",
+		Help:      "gateway upstream descriptor changes.",
+		Labels:    []string{"upstream"},
+	})
+	descriptorRefreshErrors = metric.NewCounterVec(&metric.CounterVecOpts{
+		Namespace: "gateway",
+		Subsystem: "descriptor",
+		Name:      "refresh_errors_total",
+		Help:      "gateway upstream descriptor refresh errors.",
+		Labels:    []string{"upstream"},
+	})
+)
+
+// requestRefresh 通知刷新反射描述，不阻塞
+func (s *Server) requestRefresh() {
+	select {
+	case s.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// watchDescriptors 定期或在收到通知后刷新反射描述
+// interval 为 0 时只有使用描述缓存的上游定期重试
+func (s *Server) watchDescriptors(interval time.Duration) {
+	onlyCached := interval <= 0
+	if onlyCached {
+		interval = cacheRetryInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var last time.Time
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.refreshDescriptors(onlyCached)
+			continue
+		case <-s.refresh:
+			if time.Since(last) < minRefreshInterval {
+				continue
+			}
+		}
+
+		last = time.Now()
+		s.refreshDescriptors(false)
+	}
+}
+
+// refreshDescriptors 重新获取反射上游的描述，有变化时按当前配置重建路由，新增注解的方法随之生效
+// 获取描述时不持有 reloadLock，避免多个上游的网络调用阻塞热更新
+func (s *Server) refreshDescriptors(onlyCached bool) {
+	s.reloadLock.Lock()
+	cur := s.current
+	s.reloadLock.Unlock()
+	if cur == nil {
+		return
+	}
+
+	var changed bool
+	for name, st := range cur.upstreams {
+		if !st.reflection || (onlyCached && !st.cached) {
+			continue
+		}
+
+		digest, methods, err := resolveDescriptor(st)
+		if err != nil {
+			logx.Errorf("%s: 获取反射描述失败，%v", name, err)
+			descriptorRefreshErrors.Inc(name)
+			continue
+		}
+		if digest == st.digest {
+			continue
+		}
+
+		changed = true
+		descriptorChanges.Inc(name)
+		added, removed := diffStrings(st.methods, methods)
+		logx.Infof("%s: 反射描述已变化，新增方法 %v，移除方法 %v", name, added, removed)
+	}
+
+	if !changed {
+		return
+	}
+
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+	// 获取描述期间已经热更新，新的路由已按最新的描述构造
+	if s.current != cur {
+		return
+	}
+
+	if err := s.reload(cur.conf); err != nil {
+		logx.Errorf("反射描述变化后重建路由失败，继续使用当前路由：%v", err)
+	}
+}
+
+func resolveDescriptor(st *upstreamState) (string, []string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), refreshTimeout)
+	defer cancel()
+
+	client := grpcreflect.NewClientAuto(ctx, st.cli.Conn())
+	defer client.Reset()
+
+	source := grpcurl.DescriptorSourceFromServer(ctx, client)
+	digest, err := internal.DescriptorDigest(source)
+	if err != nil {
+		return "", nil, err
+	}
+
+	methods, err := internal.GetMethods(source)
+	if err != nil {
+		return "", nil, err
+	}
+
+	rpcPaths := make([]string, len(methods))
+	for i, m := range methods {
+		rpcPaths[i] = m.RpcPath
+	}
+
+	return digest, rpcPaths, nil
+}
+
+// descriptorCacheFile 上游描述缓存的文件名，上游名称中的特殊字符替换为 _
+func descriptorCacheFile(dir, name string) string {
+	file := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, name)
+
+	return filepath.Join(dir, file+".pb")
+}
+
+func hasDescriptorCache(dir, name string) bool {
+	if len(dir) == 0 {
+		return false
+	}
+
+	_, err := os.Stat(descriptorCacheFile(dir, name))
+	return err == nil
+}
+
+// saveDescriptorCache 将上游的描述保存为 FileDescriptorSet，先写临时文件再替换，避免读到不完整的缓存
+func saveDescriptorCache(dir, name string, source grpcurl.DescriptorSource) error {
+	if len(dir) == 0 {
+		return nil
+	}
+
+	svcs, err := source.ListServices()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	file := descriptorCacheFile(dir, name)
+	tmp, err := os.CreateTemp(dir, filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := grpcurl.WriteProtoset(tmp, source, svcs...); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), file)
+}
@@ -0,0 +1,122 @@
+package gateway
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/punpeo/pun-gateway-lib/internal"
+	"github.com/punpeo/punpeo-lib/rest/xerr"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Error 插件中止请求的错误，与 rpc 返回的错误一样按 Errors 和 Formatter 配置输出
+type Error struct {
+	// Code gRPC 状态码，按 Errors 配置确定 HTTP 状态码和业务码
+	Code codes.Code
+	Msg  string
+	// BizCode、HttpStatus 不为 0 时替换按配置确定的业务码和 HTTP 状态码
+	BizCode    uint32
+	HttpStatus int
+	// Details 附加的 errdetails，如 errdetails.BadRequest
+	Details []proto.Message
+}
+
+// NewError 创建插件中止请求的错误
+func NewError(code codes.Code, msg string) *Error {
+	return &Error{Code: code, Msg: msg}
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+// GRPCStatus 转为 gRPC 状态，附加的 errdetails 无法转换时忽略
+func (e *Error) GRPCStatus() *status.Status {
+	st := status.New(e.Code, e.Msg)
+	if len(e.Details) == 0 {
+		return st
+	}
+
+	if withDetails, err := st.WithDetails(e.Details...); err == nil {
+		return withDetails
+	}
+
+	return st
+}
+
+// errorWriter 按 ErrorConf 确定 gRPC 错误的输出
+type errorWriter struct {
+	httpStatus bool
+	details    bool
+	codes      map[codes.Code]ErrorCode
+}
+
+// newErrorWriter 合并网关和路由的配置，route 为 nil 时使用网关的配置
+func newErrorWriter(gw ErrorConf, route *ErrorConf) (*errorWriter, error) {
+	ew := &errorWriter{
+		codes: make(map[codes.Code]ErrorCode),
+	}
+
+	confs := []ErrorConf{gw}
+	if route != nil {
+		confs = append(confs, *route)
+	}
+
+	for _, c := range confs {
+		if c.HttpStatus != nil {
+			ew.httpStatus = *c.HttpStatus
+		}
+		if c.Details != nil {
+			ew.details = *c.Details
+		}
+		for _, ec := range c.Codes {
+			code, err := internal.ParseCode(ec.Code)
+			if err != nil {
+				return nil, err
+			}
+
+			ew.codes[code] = ec
+		}
+	}
+
+	return ew, nil
+}
+
+// fill 按配置填充失败响应的 HTTP 状态码、业务码和 errdetails，RetryInfo 同时写入 Retry-After 头
+func (ew *errorWriter) fill(w http.ResponseWriter, resp *Response) {
+	st := resp.Status
+	resp.HttpStatus = http.StatusOK
+	if ew.httpStatus {
+		resp.HttpStatus = internal.HttpStatusFromCode(st.Code())
+	}
+
+	resp.Code = xerr.SERVER_COMMON_ERROR
+	if ec, ok := ew.codes[st.Code()]; ok {
+		if ec.HttpStatus > 0 {
+			resp.HttpStatus = ec.HttpStatus
+		}
+		if ec.BizCode > 0 {
+			resp.Code = ec.BizCode
+		}
+	}
+
+	var ge *Error
+	if errors.As(resp.err, &ge) {
+		if ge.HttpStatus > 0 {
+			resp.HttpStatus = ge.HttpStatus
+		}
+		if ge.BizCode > 0 {
+			resp.Code = ge.BizCode
+		}
+	}
+
+	if ew.details {
+		resp.Details = internal.ErrorDetails(st)
+	}
+	if secs := internal.RetryAfter(st); secs > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(secs))
+	}
+}
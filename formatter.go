@@ -0,0 +1,184 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/punpeo/pun-gateway-lib/internal"
+	"github.com/punpeo/punpeo-lib/rest/result"
+	"github.com/zeromicro/go-zero/core/logx"
+	"github.com/zeromicro/go-zero/rest/httpx"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const (
+	// FormatterRaw 成功时原样输出响应消息，失败时输出 google.rpc.Status
+	FormatterRaw = "raw"
+	// FormatterJzEnvelope 输出简知的 {code,msg,data}
+	FormatterJzEnvelope = "jz-envelope"
+	// FormatterProblem 成功时原样输出响应消息，失败时按 RFC 7807 输出 application/problem+json
+	FormatterProblem = "problem+json"
+
+	problemContentType = "application/problem+json"
+)
+
+// ResponseFormatter 输出非流式方法的响应
+// 配置了 Formatter 的路由先调用插件的 OnReceiveResponse，处理后的响应由 ResponseFormatter 输出
+type ResponseFormatter interface {
+	Format(w http.ResponseWriter, resp *Response) error
+}
+
+// ResponseFormatterFunc 函数形式的 ResponseFormatter
+type ResponseFormatterFunc func(w http.ResponseWriter, resp *Response) error
+
+func (f ResponseFormatterFunc) Format(w http.ResponseWriter, resp *Response) error {
+	return f(w, resp)
+}
+
+// Response rpc 的响应
+type Response struct {
+	Request *http.Request
+	// Message 解码后的响应消息，rpc 失败时为 nil
+	Message proto.Message
+	// Data 响应消息的 JSON，已按 OrigName 和 response_body 处理并经过插件的 OnReceiveResponse，rpc 失败时为 nil
+	Data json.RawMessage
+	// Header、Trailer rpc 的响应头和响应尾
+	Header  metadata.MD
+	Trailer metadata.MD
+	Status  *status.Status
+
+	// HttpStatus、Code、Details rpc 失败时按 Errors 配置得到的 HTTP 状态码、业务码和 errdetails
+	HttpStatus int
+	Code       uint32
+	Details    map[string]any
+
+	// err rpc 调用或插件中止请求的错误
+	err error
+}
+
+// defaultFormatters 内置的 ResponseFormatter
+func defaultFormatters() map[string]ResponseFormatter {
+	return map[string]ResponseFormatter{
+		FormatterRaw:        ResponseFormatterFunc(formatRaw),
+		FormatterJzEnvelope: ResponseFormatterFunc(formatJzEnvelope),
+		FormatterProblem:    ResponseFormatterFunc(formatProblem),
+	}
+}
+
+// legacyFormatter 未配置 Formatter 时的输出，成功的响应已由插件写出，失败时输出 {code,msg,data}
+var legacyFormatter = ResponseFormatterFunc(func(w http.ResponseWriter, resp *Response) error {
+	if resp.Status.Code() == codes.OK {
+		return nil
+	}
+
+	return formatJzEnvelope(w, resp)
+})
+
+// format 输出响应，失败时先按 Errors 配置确定 HTTP 状态码和业务码
+func (t rpcTarget) format(w http.ResponseWriter, resp *Response) {
+	if resp.Status.Code() != codes.OK {
+		t.errors.fill(w, resp)
+	}
+
+	f := t.formatter
+	if f == nil {
+		f = legacyFormatter
+	}
+	if err := f.Format(w, resp); err != nil {
+		logx.Error(err)
+	}
+}
+
+func formatRaw(w http.ResponseWriter, resp *Response) error {
+	if resp.Status.Code() == codes.OK {
+		return writeRawJson(w, http.StatusOK, resp.Data)
+	}
+
+	bs, err := protojson.Marshal(resp.Status.Proto())
+	if err != nil {
+		// details 中有未知类型时只输出 code 和 message
+		bs, err = protojson.Marshal(status.New(resp.Status.Code(), resp.Status.Message()).Proto())
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeRawJson(w, resp.HttpStatus, bs)
+}
+
+func formatJzEnvelope(w http.ResponseWriter, resp *Response) error {
+	if resp.Status.Code() == codes.OK {
+		httpx.WriteJson(w, http.StatusOK, internal.JzEnvelope(string(resp.Data), resp.Header))
+		return nil
+	}
+
+	bean := &result.ResponseSuccessBean{Code: resp.Code, Msg: resp.Status.Message()}
+	if resp.Details != nil {
+		bean.Data = resp.Details
+	}
+	httpx.WriteJson(w, resp.HttpStatus, bean)
+
+	return nil
+}
+
+// problem RFC 7807 的错误响应，code 为业务码，grpc_code 为 gRPC 状态码
+type problem struct {
+	Type     string         `json:"type"`
+	Title    string         `json:"title"`
+	Status   int            `json:"status"`
+	Detail   string         `json:"detail,omitempty"`
+	Instance string         `json:"instance,omitempty"`
+	Code     uint32         `json:"code"`
+	GrpcCode string         `json:"grpc_code"`
+	Details  map[string]any `json:"details,omitempty"`
+}
+
+func formatProblem(w http.ResponseWriter, resp *Response) error {
+	if resp.Status.Code() == codes.OK {
+		return writeRawJson(w, http.StatusOK, resp.Data)
+	}
+
+	// 未开启 Errors.HttpStatus 时也按 gRPC 状态码返回错误的 HTTP 状态码
+	httpStatus := resp.HttpStatus
+	if httpStatus < http.StatusBadRequest {
+		httpStatus = internal.HttpStatusFromCode(resp.Status.Code())
+	}
+
+	p := problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(httpStatus),
+		Status:   httpStatus,
+		Detail:   resp.Status.Message(),
+		Code:     resp.Code,
+		GrpcCode: resp.Status.Code().String(),
+		Details:  resp.Details,
+	}
+	if resp.Request != nil {
+		p.Instance = resp.Request.URL.Path
+	}
+
+	bs, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set(httpx.ContentType, problemContentType)
+	w.WriteHeader(httpStatus)
+	_, err = w.Write(bs)
+	return err
+}
+
+func writeRawJson(w http.ResponseWriter, code int, data []byte) error {
+	if len(data) == 0 {
+		data = []byte("null")
+	}
+
+	w.Header().Set(httpx.ContentType, httpx.JsonContentType)
+	w.WriteHeader(code)
+	_, err := w.Write(data)
+	return err
+}
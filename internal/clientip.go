@@ -0,0 +1,130 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type clientIPKey struct{}
+
+// TrustedProxies 受信任的代理网段，只有请求来自这些地址时才使用 X-Forwarded-For 和 X-Real-Ip
+type TrustedProxies struct {
+	nets []*net.IPNet
+}
+
+// NewTrustedProxies 解析受信任的代理网段，如 10.0.0.0/8、192.168.1.1
+func NewTrustedProxies(cidrs []string) (*TrustedProxies, error) {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TrustedProxies{nets: nets}, nil
+}
+
+// ClientIP 客户端 IP，RemoteAddr 不是受信任的代理时为 RemoteAddr 的 IP，
+// 否则从右向左取 X-Forwarded-For 中第一个不受信任的地址，没有 X-Forwarded-For 时取 X-Real-Ip
+func (tp *TrustedProxies) ClientIP(r *http.Request) string {
+	ip := remoteIP(r)
+	if len(ip) == 0 || !tp.trusted(ip) {
+		return ip
+	}
+
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				// 无法解析时使用最近的受信任代理
+				return ip
+			}
+			ip = hop
+			if !tp.trusted(hop) {
+				return hop
+			}
+		}
+
+		return ip
+	}
+
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-Ip")); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+
+	return ip
+}
+
+func (tp *TrustedProxies) trusted(s string) bool {
+	if tp == nil {
+		return false
+	}
+
+	return containsIP(tp.nets, s)
+}
+
+// WithClientIP 在请求中保存网关确定的客户端 IP
+func WithClientIP(r *http.Request, ip string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip))
+}
+
+// RequestClientIP 网关按受信任的代理确定的客户端 IP，请求不是由网关路由处理时为 RemoteAddr 的 IP
+func RequestClientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+
+	return remoteIP(r)
+}
+
+func remoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(strings.TrimSpace(r.RemoteAddr))
+	if err == nil && net.ParseIP(ip) != nil {
+		return ip
+	}
+
+	return ""
+}
+
+// parseCIDRs 解析网段，单个 IP 按 /32 或 /128 处理
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("错误的 IP：%s", cidr)
+			}
+			if ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, s string) bool {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return false
+	}
+
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrustedProxiesClientIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		proxies []string
+		remote  string
+		xff     []string
+		realIP  string
+		expect  string
+	}{
+		{name: "no proxies", remote: "8.8.8.8:1234", xff: []string{"1.1.1.1"}, expect: "8.8.8.8"},
+		{name: "untrusted remote", proxies: []string{"10.0.0.0/8"}, remote: "8.8.8.8:1234", xff: []string{"1.1.1.1"}, realIP: "2.2.2.2", expect: "8.8.8.8"},
+		{name: "trusted remote", proxies: []string{"10.0.0.0/8"}, remote: "10.0.0.1:1234", xff: []string{"1.1.1.1"}, expect: "1.1.1.1"},
+		{name: "spoofed first hop", proxies: []string{"10.0.0.0/8"}, remote: "10.0.0.1:1234", xff: []string{"9.9.9.9, 1.1.1.1, 10.0.0.2"}, expect: "1.1.1.1"},
+		{name: "multiple headers", proxies: []string{"10.0.0.0/8"}, remote: "10.0.0.1:1234", xff: []string{"9.9.9.9", "1.1.1.1"}, expect: "1.1.1.1"},
+		{name: "all trusted", proxies: []string{"10.0.0.0/8"}, remote: "10.0.0.1:1234", xff: []string{"10.0.0.3, 10.0.0.2"}, expect: "10.0.0.3"},
+		{name: "bad hop", proxies: []string{"10.0.0.0/8"}, remote: "10.0.0.1:1234", xff: []string{"1.1.1.1, unknown, 10.0.0.2"}, expect: "10.0.0.2"},
+		{name: "real ip", proxies: []string{"10.0.0.1"}, remote: "10.0.0.1:1234", realIP: "1.1.1.1", expect: "1.1.1.1"},
+		{name: "no headers", proxies: []string{"10.0.0.1"}, remote: "10.0.0.1:1234", expect: "10.0.0.1"},
+		{name: "ipv6", proxies: []string{"::1"}, remote: "[::1]:1234", xff: []string{"2001:db8::1"}, expect: "2001:db8::1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tp, err := NewTrustedProxies(test.proxies)
+			assert.NoError(t, err)
+
+			r := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
+			r.RemoteAddr = test.remote
+			for _, v := range test.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if len(test.realIP) > 0 {
+				r.Header.Set("X-Real-Ip", test.realIP)
+			}
+			assert.Equal(t, test.expect, tp.ClientIP(r))
+		})
+	}
+}
+
+func TestRequestClientIP(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
+	r.RemoteAddr = "8.8.8.8:1234"
+	r.Header.Set("X-Forwarded-For", "1.1.1.1")
+	assert.Equal(t, "8.8.8.8", RequestClientIP(r))
+
+	var tp *TrustedProxies
+	assert.Equal(t, "8.8.8.8", tp.ClientIP(r))
+	assert.Equal(t, "1.1.1.1", RequestClientIP(WithClientIP(r, "1.1.1.1")))
+
+	_, err := NewTrustedProxies([]string{"proxy"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+type streamDeadlineKey struct{}
+
+// StreamDeadline 流式响应的写超时
+// http.Server 的 WriteTimeout 从读取请求时开始计算，会截断持续时间超过它的流，
+// 所以开始时清除写超时，每次写入前按 timeout 设置、写入后清除，两次写入之间不受限制
+type StreamDeadline struct {
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+// WithStreamDeadline 在请求中保存 StreamDeadline，w 需要是 http.Server 传入的 ResponseWriter，
+// go-zero 的中间件包装后的 ResponseWriter 没有实现 Unwrap，无法设置写超时
+func WithStreamDeadline(w http.ResponseWriter, r *http.Request, timeout time.Duration) *http.Request {
+	d := &StreamDeadline{
+		rc:      http.NewResponseController(w),
+		timeout: timeout,
+	}
+	_ = d.rc.SetWriteDeadline(time.Time{})
+
+	return r.WithContext(context.WithValue(r.Context(), streamDeadlineKey{}, d))
+}
+
+// StreamDeadlineFromRequest 返回请求中的 StreamDeadline，没有时返回 nil
+func StreamDeadlineFromRequest(r *http.Request) *StreamDeadline {
+	d, _ := r.Context().Value(streamDeadlineKey{}).(*StreamDeadline)
+	return d
+}
+
+// Write 在写超时内调用 write，d 为 nil 时直接调用
+func (d *StreamDeadline) Write(write func() error) error {
+	if d == nil {
+		return write()
+	}
+
+	if d.timeout > 0 {
+		_ = d.rc.SetWriteDeadline(time.Now().Add(d.timeout))
+	}
+	err := write()
+	_ = d.rc.SetWriteDeadline(time.Time{})
+
+	return err
+}
@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamDeadline(t *testing.T) {
+	const (
+		writeTimeout = 100 * time.Millisecond
+		lines        = 5
+	)
+
+	tests := []struct {
+		name     string
+		deadline bool
+	}{
+		{name: "stream outlives write timeout", deadline: true},
+		{name: "cut by write timeout", deadline: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if test.deadline {
+					r = WithStreamDeadline(w, r, writeTimeout)
+				}
+				d := StreamDeadlineFromRequest(r)
+				for i := 0; i < lines; i++ {
+					time.Sleep(writeTimeout * 4 / 5)
+					err := d.Write(func() error {
+						if _, err := fmt.Fprintf(w, "%d\n", i); err != nil {
+							return err
+						}
+						w.(http.Flusher).Flush()
+						return nil
+					})
+					if err != nil {
+						return
+					}
+				}
+			}))
+			svr.Config.WriteTimeout = writeTimeout
+			svr.Start()
+			defer svr.Close()
+
+			resp, err := http.Get(svr.URL)
+			if err != nil {
+				assert.False(t, test.deadline)
+				return
+			}
+			defer resp.Body.Close()
+
+			var got int
+			scanner := bufio.NewScanner(resp.Body)
+			for scanner.Scan() {
+				got++
+			}
+			if test.deadline {
+				assert.NoError(t, scanner.Err())
+				assert.Equal(t, lines, got)
+			} else {
+				assert.Less(t, got, lines)
+			}
+		})
+	}
+}
+
+func TestStreamDeadlineNil(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
+	d := StreamDeadlineFromRequest(r)
+	assert.Nil(t, d)
+	assert.Equal(t, io.EOF, d.Write(func() error {
+		return io.EOF
+	}))
+}
@@ -1,23 +1,45 @@
 package internal
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"net/http"
+	"sort"
 	"strings"
 
+	"github.com/bufbuild/protocompile"
 	"github.com/fullstorydev/grpcurl"
 	"github.com/jhump/protoreflect/desc"
+	"github.com/zeromicro/go-zero/core/logx"
 	"google.golang.org/genproto/googleapis/api/annotations"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
 )
 
 type Method struct {
 	HttpMethod string
-	HttpPath   string
-	RpcPath    string
+	// HttpPath 路由路径，由 HttpTemplate 转换而来
+	HttpPath string
+	// HttpTemplate google.api.http 注解中的路径模板
+	HttpTemplate string
+	RpcPath      string
+	// Body 请求体映射的字段，* 表示整个请求消息，为空表示请求体不映射字段
+	Body string
+	// ResponseBody 只返回响应消息中的这个字段，为空表示返回整个响应消息
+	ResponseBody string
+	// ClientStreaming 是否为客户端流式方法，包括双向流
+	ClientStreaming bool
+	// ServerStreaming 是否为服务端流式方法
+	ServerStreaming bool
 }
 
 // GetMethods returns all methods of the given grpcurl.DescriptorSource.
+// 带有 google.api.http 注解的方法，主规则和 additional_bindings 中的每条规则各返回一个 Method
 func GetMethods(source grpcurl.DescriptorSource) ([]Method, error) {
 	svcs, err := source.ListServices()
 	if err != nil {
@@ -35,58 +57,30 @@ func GetMethods(source grpcurl.DescriptorSource) ([]Method, error) {
 		case *desc.ServiceDescriptor:
 			svcMethods := val.GetMethods()
 			for _, method := range svcMethods {
-				rpcPath := fmt.Sprintf("%s/%s", svc, method.GetName())
-				ext := proto.GetExtension(method.GetMethodOptions(), annotations.E_Http)
-				switch rule := ext.(type) {
-				case *annotations.HttpRule:
-					if rule == nil {
-						methods = append(methods, Method{
-							RpcPath: rpcPath,
-						})
-						continue
-					}
-
-					switch httpRule := rule.GetPattern().(type) {
-					case *annotations.HttpRule_Get:
-						methods = append(methods, Method{
-							HttpMethod: http.MethodGet,
-							HttpPath:   adjustHttpPath(httpRule.Get),
-							RpcPath:    rpcPath,
-						})
-					case *annotations.HttpRule_Post:
-						methods = append(methods, Method{
-							HttpMethod: http.MethodPost,
-							HttpPath:   adjustHttpPath(httpRule.Post),
-							RpcPath:    rpcPath,
-						})
-					case *annotations.HttpRule_Put:
-						methods = append(methods, Method{
-							HttpMethod: http.MethodPut,
-							HttpPath:   adjustHttpPath(httpRule.Put),
-							RpcPath:    rpcPath,
-						})
-					case *annotations.HttpRule_Delete:
-						methods = append(methods, Method{
-							HttpMethod: http.MethodDelete,
-							HttpPath:   adjustHttpPath(httpRule.Delete),
-							RpcPath:    rpcPath,
-						})
-					case *annotations.HttpRule_Patch:
-						methods = append(methods, Method{
-							HttpMethod: http.MethodPatch,
-							HttpPath:   adjustHttpPath(httpRule.Patch),
-							RpcPath:    rpcPath,
-						})
-					default:
-						methods = append(methods, Method{
-							RpcPath: rpcPath,
-						})
-					}
-				default:
-					methods = append(methods, Method{
-						RpcPath: rpcPath,
-					})
+				m := Method{
+					RpcPath:         fmt.Sprintf("%s/%s", svc, method.GetName()),
+					ClientStreaming: method.IsClientStreaming(),
+					ServerStreaming: method.IsServerStreaming(),
 				}
+
+				rule, ok := proto.GetExtension(method.GetMethodOptions(), annotations.E_Http).(*annotations.HttpRule)
+				if !ok || rule == nil {
+					methods = append(methods, m)
+					continue
+				}
+
+				// 注解有误时只记录日志并忽略注解，不影响该上游的其它方法
+				bindings, err := httpBindings(m, rule)
+				if err != nil {
+					logx.Errorf("%s: 忽略错误的 google.api.http 注解，%v", m.RpcPath, err)
+					methods = append(methods, m)
+					continue
+				}
+				if len(bindings) == 0 {
+					methods = append(methods, m)
+					continue
+				}
+				methods = append(methods, bindings...)
 			}
 		}
 	}
@@ -94,8 +88,124 @@ func GetMethods(source grpcurl.DescriptorSource) ([]Method, error) {
 	return methods, nil
 }
 
-func adjustHttpPath(path string) string {
-	path = strings.ReplaceAll(path, "{", ":")
-	path = strings.ReplaceAll(path, "}", "")
-	return path
+// httpBindings 按 HttpRule 生成路由，包括 additional_bindings
+func httpBindings(m Method, rule *annotations.HttpRule) ([]Method, error) {
+	var methods []Method
+	rules := append([]*annotations.HttpRule{rule}, rule.GetAdditionalBindings()...)
+	for _, r := range rules {
+		var httpMethod, template string
+		switch pattern := r.GetPattern().(type) {
+		case *annotations.HttpRule_Get:
+			httpMethod, template = http.MethodGet, pattern.Get
+		case *annotations.HttpRule_Post:
+			httpMethod, template = http.MethodPost, pattern.Post
+		case *annotations.HttpRule_Put:
+			httpMethod, template = http.MethodPut, pattern.Put
+		case *annotations.HttpRule_Delete:
+			httpMethod, template = http.MethodDelete, pattern.Delete
+		case *annotations.HttpRule_Patch:
+			httpMethod, template = http.MethodPatch, pattern.Patch
+		case *annotations.HttpRule_Custom:
+			httpMethod, template = strings.ToUpper(pattern.Custom.GetKind()), pattern.Custom.GetPath()
+		default:
+			continue
+		}
+
+		tpl, err := ParsePathTemplate(template)
+		if err != nil {
+			return nil, err
+		}
+
+		binding := m
+		binding.HttpMethod = httpMethod
+		binding.HttpPath = tpl.RoutePath
+		binding.HttpTemplate = template
+		binding.Body = r.GetBody()
+		binding.ResponseBody = r.GetResponseBody()
+		methods = append(methods, binding)
+	}
+
+	return methods, nil
+}
+
+// DescriptorSourceFromProtoFiles 编译 .proto 源文件作为描述来源，files 为相对 importPaths 的路径
+// google/protobuf 下的标准文件和 google/api/annotations.proto 等已链接到网关的文件无需放在 importPaths 中
+func DescriptorSourceFromProtoFiles(importPaths []string, files ...string) (grpcurl.DescriptorSource, error) {
+	compiler := protocompile.Compiler{
+		Resolver: protocompile.WithStandardImports(protocompile.CompositeResolver{
+			&protocompile.SourceResolver{ImportPaths: importPaths},
+			protocompile.ResolverFunc(func(path string) (protocompile.SearchResult, error) {
+				fd, err := protoregistry.GlobalFiles.FindFileByPath(path)
+				if err != nil {
+					return protocompile.SearchResult{}, err
+				}
+
+				return protocompile.SearchResult{Desc: fd}, nil
+			}),
+		}),
+		SourceInfoMode: protocompile.SourceInfoStandard,
+	}
+
+	compiled, err := compiler.Compile(context.Background(), files...)
+	if err != nil {
+		return nil, err
+	}
+
+	// 编译结果中的选项是动态消息，序列化后再解析，google.api.http 等选项才能按注册的类型读取
+	var (
+		fdSet descriptorpb.FileDescriptorSet
+		seen  = make(map[string]bool)
+		add   func(fd protoreflect.FileDescriptor)
+	)
+	add = func(fd protoreflect.FileDescriptor) {
+		if seen[fd.Path()] {
+			return
+		}
+		seen[fd.Path()] = true
+
+		imports := fd.Imports()
+		for i := 0; i < imports.Len(); i++ {
+			add(imports.Get(i).FileDescriptor)
+		}
+		fdSet.File = append(fdSet.File, protodesc.ToFileDescriptorProto(fd))
+	}
+	for _, f := range compiled {
+		add(f)
+	}
+
+	bs, err := proto.Marshal(&fdSet)
+	if err != nil {
+		return nil, err
+	}
+
+	var resolved descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(bs, &resolved); err != nil {
+		return nil, err
+	}
+
+	return grpcurl.DescriptorSourceFromFileDescriptorSet(&resolved)
+}
+
+// DescriptorDigest 计算 source 中全部文件描述的摘要，用于判断上游的描述是否变化
+func DescriptorDigest(source grpcurl.DescriptorSource) (string, error) {
+	files, err := grpcurl.GetAllFiles(source)
+	if err != nil {
+		return "", err
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].GetName() < files[j].GetName()
+	})
+
+	h := sha256.New()
+	for _, fd := range files {
+		bs, err := proto.MarshalOptions{Deterministic: true}.Marshal(fd.AsFileDescriptorProto())
+		if err != nil {
+			return "", err
+		}
+
+		h.Write(bs)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
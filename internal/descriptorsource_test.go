@@ -51,29 +51,39 @@ func TestGetMethodsWithAnnotations(t *testing.T) {
 	assert.Nil(t, err)
 	assert.EqualValues(t, []Method{
 		{
-			HttpMethod: http.MethodGet,
-			HttpPath:   "/v1/get/:foo",
-			RpcPath:    "hello.Hello/PingGet",
+			HttpMethod:   http.MethodGet,
+			HttpPath:     "/v1/get/:foo",
+			HttpTemplate: "/v1/get/{foo}",
+			Body:         "*",
+			RpcPath:      "hello.Hello/PingGet",
 		},
 		{
-			HttpMethod: http.MethodPost,
-			HttpPath:   "/v1/post",
-			RpcPath:    "hello.Hello/PingPost",
+			HttpMethod:   http.MethodPost,
+			HttpPath:     "/v1/post",
+			HttpTemplate: "/v1/post",
+			Body:         "*",
+			RpcPath:      "hello.Hello/PingPost",
 		},
 		{
-			HttpMethod: http.MethodPut,
-			HttpPath:   "/v1/put",
-			RpcPath:    "hello.Hello/PingPut",
+			HttpMethod:   http.MethodPut,
+			HttpPath:     "/v1/put",
+			HttpTemplate: "/v1/put",
+			Body:         "*",
+			RpcPath:      "hello.Hello/PingPut",
 		},
 		{
-			HttpMethod: http.MethodDelete,
-			HttpPath:   "/v1/delete",
-			RpcPath:    "hello.Hello/PingDelete",
+			HttpMethod:   http.MethodDelete,
+			HttpPath:     "/v1/delete",
+			HttpTemplate: "/v1/delete",
+			Body:         "*",
+			RpcPath:      "hello.Hello/PingDelete",
 		},
 		{
-			HttpMethod: http.MethodPatch,
-			HttpPath:   "/v1/patch",
-			RpcPath:    "hello.Hello/PingPatch",
+			HttpMethod:   http.MethodPatch,
+			HttpPath:     "/v1/patch",
+			HttpTemplate: "/v1/patch",
+			Body:         "*",
+			RpcPath:      "hello.Hello/PingPatch",
 		},
 	}, methods)
 }
@@ -124,3 +134,207 @@ func (m *mockDescriptorSource) FindSymbol(_ string) (desc.Descriptor, error) {
 func (m *mockDescriptorSource) ListServices() ([]string, error) {
 	return m.services, m.servicesErr
 }
+
+func TestDescriptorDigest(t *testing.T) {
+	digest := func(b64 string) string {
+		tmpfile, err := os.CreateTemp(os.TempDir(), hash.Md5Hex([]byte(b64)))
+		assert.Nil(t, err)
+		b, err := base64.StdEncoding.DecodeString(b64)
+		assert.Nil(t, err)
+		assert.Nil(t, os.WriteFile(tmpfile.Name(), b, os.ModeTemporary))
+		defer os.Remove(tmpfile.Name())
+
+		source, err := grpcurl.DescriptorSourceFromProtoSets(tmpfile.Name())
+		assert.Nil(t, err)
+		d, err := DescriptorDigest(source)
+		assert.Nil(t, err)
+		return d
+	}
+
+	assert.Equal(t, digest(b64pb), digest(b64pb))
+	assert.NotEqual(t, digest(b64pb), digest(b64pbWithAnnotations))
+}
+
+func TestDescriptorSourceFromProtoFiles(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.MkdirAll(dir+"/hello", 0o755))
+	assert.Nil(t, os.WriteFile(dir+"/hello/hello.proto", []byte(`syntax = "proto3";
+
+package hello;
+
+import "google/api/annotations.proto";
+import "google/protobuf/empty.proto";
+
+message Request {
+  string ping = 1;
+}
+
+message Response {
+  string pong = 1;
+}
+
+service Hello {
+  rpc Ping(Request) returns (Response);
+  rpc PingGet(Request) returns (Response) {
+    option (google.api.http) = {
+      get: "/v1/get/{ping}"
+    };
+  }
+  rpc Empty(google.protobuf.Empty) returns (google.protobuf.Empty);
+}
+`), 0o644))
+
+	source, err := DescriptorSourceFromProtoFiles([]string{dir}, "hello/hello.proto")
+	assert.Nil(t, err)
+	methods, err := GetMethods(source)
+	assert.Nil(t, err)
+	assert.EqualValues(t, []Method{
+		{
+			RpcPath: "hello.Hello/Ping",
+		},
+		{
+			HttpMethod:   http.MethodGet,
+			HttpPath:     "/v1/get/:ping",
+			HttpTemplate: "/v1/get/{ping}",
+			RpcPath:      "hello.Hello/PingGet",
+		},
+		{
+			RpcPath: "hello.Hello/Empty",
+		},
+	}, methods)
+
+	_, err = DescriptorSourceFromProtoFiles([]string{dir}, "hello/missing.proto")
+	assert.NotNil(t, err)
+}
+
+func TestGetMethodsWithHttpRule(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(dir+"/book.proto", []byte(`syntax = "proto3";
+
+package book;
+
+import "google/api/annotations.proto";
+
+message Book {
+  string name = 1;
+  string title = 2;
+}
+
+message UpdateBookRequest {
+  string name = 1;
+  Book book = 2;
+}
+
+message CancelRequest {
+  string name = 1;
+}
+
+message GetBookResponse {
+  Book book = 1;
+}
+
+service Library {
+  rpc UpdateBook(UpdateBookRequest) returns (Book) {
+    option (google.api.http) = {
+      patch: "/v1/{name=shelves/*/books/*}"
+      body: "book"
+      additional_bindings {
+        put: "/v1/books/{name}"
+        body: "*"
+      }
+    };
+  }
+  rpc Cancel(CancelRequest) returns (Book) {
+    option (google.api.http) = {
+      custom: {
+        kind: "head"
+        path: "/v1/books/{name}:cancel"
+      }
+    };
+  }
+  rpc GetBook(CancelRequest) returns (GetBookResponse) {
+    option (google.api.http) = {
+      get: "/v1/files/{name=**}"
+      response_body: "book"
+    };
+  }
+}
+`), 0o644))
+
+	source, err := DescriptorSourceFromProtoFiles([]string{dir}, "book.proto")
+	assert.Nil(t, err)
+	methods, err := GetMethods(source)
+	assert.Nil(t, err)
+	assert.EqualValues(t, []Method{
+		{
+			HttpMethod:   http.MethodPatch,
+			HttpPath:     "/v1/shelves/:name.1/books/:name.3",
+			HttpTemplate: "/v1/{name=shelves/*/books/*}",
+			RpcPath:      "book.Library/UpdateBook",
+			Body:         "book",
+		},
+		{
+			HttpMethod:   http.MethodPut,
+			HttpPath:     "/v1/books/:name",
+			HttpTemplate: "/v1/books/{name}",
+			RpcPath:      "book.Library/UpdateBook",
+			Body:         "*",
+		},
+		{
+			HttpMethod:   http.MethodHead,
+			HttpPath:     "/v1/books/:name:cancel",
+			HttpTemplate: "/v1/books/{name}:cancel",
+			RpcPath:      "book.Library/Cancel",
+		},
+		{
+			HttpMethod:   http.MethodGet,
+			HttpPath:     "/v1/files/*name",
+			HttpTemplate: "/v1/files/{name=**}",
+			RpcPath:      "book.Library/GetBook",
+			ResponseBody: "book",
+		},
+	}, methods)
+}
+
+func TestGetMethodsWithBadHttpRule(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(dir+"/bad.proto", []byte(`syntax = "proto3";
+
+package bad;
+
+import "google/api/annotations.proto";
+
+message Req {
+  string name = 1;
+}
+
+service Bad {
+  rpc Broken(Req) returns (Req) {
+    option (google.api.http) = {
+      get: "/v1/{name"
+    };
+  }
+  rpc Get(Req) returns (Req) {
+    option (google.api.http) = {
+      get: "/v1/items/{name}"
+    };
+  }
+}
+`), 0o644))
+
+	source, err := DescriptorSourceFromProtoFiles([]string{dir}, "bad.proto")
+	assert.Nil(t, err)
+	methods, err := GetMethods(source)
+	assert.Nil(t, err)
+	assert.EqualValues(t, []Method{
+		{
+			RpcPath: "bad.Bad/Broken",
+		},
+		{
+			HttpMethod:   http.MethodGet,
+			HttpPath:     "/v1/items/:name",
+			HttpTemplate: "/v1/items/{name}",
+			RpcPath:      "bad.Bad/Get",
+		},
+	}, methods)
+}
@@ -0,0 +1,44 @@
+package internal
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/punpeo/punpeo-lib/rest/result"
+	"github.com/punpeo/punpeo-lib/rest/xerr"
+	"google.golang.org/grpc/metadata"
+)
+
+const envelopeSuccessMsg = "成功"
+
+// JzEnvelope 简知的成功响应 {code,msg,data}
+// rpc 可以通过 X-Status-Code、X-Error-Message 和 X-Data 响应头替换 code、msg 和 data
+func JzEnvelope(data string, md metadata.MD) *result.ResponseSuccessBean {
+	bean := &result.ResponseSuccessBean{Code: xerr.OK, Msg: envelopeSuccessMsg}
+
+	if vals := md.Get("X-Status-Code"); len(vals) > 0 {
+		code, _ := strconv.ParseUint(vals[0], 10, 32)
+		bean.Code = uint32(code)
+	}
+	if vals := md.Get("X-Error-Message"); len(vals) > 0 {
+		bean.Msg = vals[0]
+	}
+	if vals := md.Get("X-Data"); len(vals) > 0 {
+		data = vals[0]
+	}
+	bean.Data = RawJson(data)
+
+	return bean
+}
+
+// RawJson 合法的 JSON 原样输出，否则作为字符串输出，空串输出 null
+func RawJson(data string) interface{} {
+	if len(data) == 0 {
+		return nil
+	}
+	if json.Valid([]byte(data)) {
+		return json.RawMessage(data)
+	}
+
+	return data
+}
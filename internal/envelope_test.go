@@ -0,0 +1,49 @@
+package internal
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestJzEnvelope(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		md     metadata.MD
+		expect string
+	}{
+		{
+			name:   "default",
+			data:   `{"id":1}`,
+			expect: `{"code":1000,"msg":"成功","data":{"id":1}}`,
+		},
+		{
+			name:   "headers",
+			data:   `{"id":1}`,
+			md:     metadata.Pairs("X-Status-Code", "2001", "X-Error-Message", `库存"不足"`, "X-Data", `[1,2]`),
+			expect: `{"code":2001,"msg":"库存\"不足\"","data":[1,2]}`,
+		},
+		{
+			name:   "invalid x-data",
+			data:   `{}`,
+			md:     metadata.Pairs("X-Data", `a"b`),
+			expect: `{"code":1000,"msg":"成功","data":"a\"b"}`,
+		},
+		{
+			name:   "empty",
+			expect: `{"code":1000,"msg":"成功","data":null}`,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			bs, err := json.Marshal(JzEnvelope(test.data, test.md))
+			assert.NoError(t, err)
+			assert.JSONEq(t, test.expect, string(bs))
+		})
+	}
+}
@@ -1,7 +1,7 @@
 package internal
 
 import (
-	"fmt"
+	"encoding/json"
 	"io"
 	"strconv"
 
@@ -40,19 +40,16 @@ func (h *EventHandler) OnReceiveResponse(message proto.Message) {
 	if err != nil {
 		logx.Error(err)
 	}
-	//成功返回 --- 最好转成struct 待优化。。。 //todo
-	respCode := 1000
-	respMsg := "成功"
+	bean := JzEnvelope(jsonStr, nil)
 	if h.XStatusCode != 0 {
-		respCode = int(h.XStatusCode)
+		bean.Code = h.XStatusCode
 	}
 	if h.XErrorMessage != "" {
-		respMsg = h.XErrorMessage
+		bean.Msg = h.XErrorMessage
+	}
+	if err := json.NewEncoder(h.writer).Encode(bean); err != nil {
+		logx.Error(err)
 	}
-	successStrPrefix := fmt.Sprintf("{\"code\":%d, \"msg\": \"%s\", \"data\":", respCode, respMsg)
-	io.WriteString(h.writer, successStrPrefix)
-	io.WriteString(h.writer, jsonStr)
-	io.WriteString(h.writer, "}")
 }
 
 func (h *EventHandler) OnReceiveTrailers(status *status.Status, _ metadata.MD) {
@@ -0,0 +1,248 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// MatchConf 请求匹配条件，配置的条件都满足时匹配，未配置任何条件时总是匹配
+type MatchConf struct {
+	// Headers 请求头都存在
+	Headers []string
+	// Query query 参数等于给定的值，值为 * 时只要求存在
+	Query map[string]string
+	// CIDRs 客户端 IP 在任一网段内，如 10.0.0.0/8、192.168.1.1，客户端 IP 由 RequestClientIP 确定
+	CIDRs []string
+	// UserAgent User-Agent 匹配的正则
+	UserAgent string
+	// AppTypes app_type 为其中之一
+	AppTypes []string
+	// AppVersion appversion 满足的版本约束，多个约束用逗号分隔，如 >=3.2.0,<4
+	AppVersion string
+	// Not 条件取反
+	Not bool
+}
+
+// Matcher 编译后的请求匹配条件
+type Matcher struct {
+	headers    []string
+	query      map[string]string
+	nets       []*net.IPNet
+	userAgent  *regexp.Regexp
+	appTypes   map[string]struct{}
+	appVersion []versionConstraint
+	not        bool
+}
+
+type versionConstraint struct {
+	op      string
+	version []int
+}
+
+// NewMatcher 编译匹配条件
+func NewMatcher(c MatchConf) (*Matcher, error) {
+	nets, err := parseCIDRs(c.CIDRs)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Matcher{
+		headers: c.Headers,
+		query:   c.Query,
+		nets:    nets,
+		not:     c.Not,
+	}
+
+	if len(c.UserAgent) > 0 {
+		re, err := regexp.Compile(c.UserAgent)
+		if err != nil {
+			return nil, err
+		}
+		m.userAgent = re
+	}
+
+	if len(c.AppTypes) > 0 {
+		m.appTypes = make(map[string]struct{}, len(c.AppTypes))
+		for _, t := range c.AppTypes {
+			m.appTypes[t] = struct{}{}
+		}
+	}
+
+	if len(c.AppVersion) > 0 {
+		for _, s := range strings.Split(c.AppVersion, ",") {
+			vc, err := parseVersionConstraint(strings.TrimSpace(s))
+			if err != nil {
+				return nil, err
+			}
+			m.appVersion = append(m.appVersion, vc)
+		}
+	}
+
+	return m, nil
+}
+
+// Match 请求是否匹配
+func (m *Matcher) Match(r *http.Request) bool {
+	return m.match(r) != m.not
+}
+
+func (m *Matcher) match(r *http.Request) bool {
+	for _, h := range m.headers {
+		if len(r.Header.Values(h)) == 0 {
+			return false
+		}
+	}
+
+	if len(m.query) > 0 {
+		query := r.URL.Query()
+		for k, v := range m.query {
+			if !query.Has(k) || (v != "*" && query.Get(k) != v) {
+				return false
+			}
+		}
+	}
+
+	if len(m.nets) > 0 && !containsIP(m.nets, RequestClientIP(r)) {
+		return false
+	}
+
+	if m.userAgent != nil && !m.userAgent.MatchString(r.UserAgent()) {
+		return false
+	}
+
+	if m.appTypes != nil {
+		if _, ok := m.appTypes[CommonParam(r, "app_type")]; !ok {
+			return false
+		}
+	}
+
+	if len(m.appVersion) > 0 {
+		version, ok := parseVersion(CommonParam(r, "appversion"))
+		if !ok {
+			return false
+		}
+		for _, vc := range m.appVersion {
+			if !vc.match(version) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// CommonParam 获取 app 公共参数，优先取请求头，其次取 query 参数，不读取请求体
+func CommonParam(r *http.Request, key string) string {
+	if val := r.Header.Get(key); len(val) > 0 {
+		return strings.TrimSpace(val)
+	}
+
+	return strings.TrimSpace(r.URL.Query().Get(key))
+}
+
+// ClientIP 尽最大努力实现获取客户端 IP 的算法。
+// 解析 X-Real-IP 和 X-Forwarded-For 以便于反向代理（nginx 或 haproxy）可以正常工作。
+// 请求头可以被客户端伪造，用于访问控制时应使用 RequestClientIP
+func ClientIP(r *http.Request) string {
+	xForwardedFor := r.Header.Get("X-Forwarded-For")
+	ip := strings.TrimSpace(strings.Split(xForwardedFor, ",")[0])
+	if ip != "" && net.ParseIP(ip) != nil {
+		return ip
+	}
+
+	ip = strings.TrimSpace(r.Header.Get("X-Real-Ip"))
+	if ip != "" && net.ParseIP(ip) != nil {
+		return ip
+	}
+	ip, _, err := net.SplitHostPort(strings.TrimSpace(r.RemoteAddr))
+
+	if err == nil && net.ParseIP(ip) != nil {
+		return ip
+	}
+
+	return ""
+}
+
+func parseVersionConstraint(s string) (versionConstraint, error) {
+	var vc versionConstraint
+	for _, op := range []string{">=", "<=", "!=", ">", "<", "="} {
+		if strings.HasPrefix(s, op) {
+			vc.op = op
+			s = strings.TrimSpace(s[len(op):])
+			break
+		}
+	}
+	if len(vc.op) == 0 {
+		vc.op = "="
+	}
+
+	version, ok := parseVersion(s)
+	if !ok {
+		return vc, fmt.Errorf("错误的版本约束：%s", s)
+	}
+	vc.version = version
+
+	return vc, nil
+}
+
+func (vc versionConstraint) match(version []int) bool {
+	c := compareVersion(version, vc.version)
+	switch vc.op {
+	case ">=":
+		return c >= 0
+	case "<=":
+		return c <= 0
+	case "!=":
+		return c != 0
+	case ">":
+		return c > 0
+	case "<":
+		return c < 0
+	default:
+		return c == 0
+	}
+}
+
+// parseVersion 解析点分隔的版本号，如 3.2.0
+func parseVersion(s string) ([]int, bool) {
+	if len(s) == 0 {
+		return nil, false
+	}
+
+	parts := strings.Split(strings.TrimPrefix(s, "v"), ".")
+	version := make([]int, len(parts))
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil, false
+		}
+		version[i] = n
+	}
+
+	return version, true
+}
+
+// compareVersion 比较版本号，缺少的部分按 0 处理，3.2 等于 3.2.0
+func compareVersion(a, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatcher(t *testing.T) {
+	tests := []struct {
+		name  string
+		conf  MatchConf
+		setup func(r *http.Request)
+		url   string
+		match bool
+	}{
+		{
+			name:  "empty",
+			match: true,
+		},
+		{
+			name:  "header",
+			conf:  MatchConf{Headers: []string{"X-Php-Caller"}},
+			setup: func(r *http.Request) { r.Header.Set("X-Php-Caller", "1") },
+			match: true,
+		},
+		{
+			name:  "header missing",
+			conf:  MatchConf{Headers: []string{"X-Php-Caller"}},
+			match: false,
+		},
+		{
+			name:  "query",
+			conf:  MatchConf{Query: map[string]string{"debug": "1"}},
+			url:   "/?debug=1",
+			match: true,
+		},
+		{
+			name:  "query value",
+			conf:  MatchConf{Query: map[string]string{"debug": "1"}},
+			url:   "/?debug=0",
+			match: false,
+		},
+		{
+			name:  "query exists",
+			conf:  MatchConf{Query: map[string]string{"debug": "*"}},
+			url:   "/?debug=",
+			match: true,
+		},
+		{
+			name:  "cidr",
+			conf:  MatchConf{CIDRs: []string{"10.0.0.0/8"}},
+			setup: func(r *http.Request) { r.RemoteAddr = "10.1.2.3:1234" },
+			match: true,
+		},
+		{
+			name: "cidr forwarded",
+			conf: MatchConf{CIDRs: []string{"192.168.1.1"}},
+			setup: func(r *http.Request) {
+				r.RemoteAddr = "10.0.0.2:1234"
+				r.Header.Set("X-Forwarded-For", "192.168.1.1, 10.0.0.1")
+			},
+			match: true,
+		},
+		{
+			name: "cidr forwarded untrusted",
+			conf: MatchConf{CIDRs: []string{"192.168.1.1"}},
+			setup: func(r *http.Request) {
+				r.RemoteAddr = "8.8.8.8:1234"
+				r.Header.Set("X-Forwarded-For", "192.168.1.1")
+			},
+			match: false,
+		},
+		{
+			name:  "cidr miss",
+			conf:  MatchConf{CIDRs: []string{"10.0.0.0/8"}},
+			setup: func(r *http.Request) { r.RemoteAddr = "8.8.8.8:1234" },
+			match: false,
+		},
+		{
+			name:  "user agent",
+			conf:  MatchConf{UserAgent: "(?i)android"},
+			setup: func(r *http.Request) { r.Header.Set("User-Agent", "okhttp Android/12") },
+			match: true,
+		},
+		{
+			name:  "app type",
+			conf:  MatchConf{AppTypes: []string{"ios", "android"}},
+			url:   "/?app_type=ios",
+			match: true,
+		},
+		{
+			name:  "app type header",
+			conf:  MatchConf{AppTypes: []string{"ios"}},
+			setup: func(r *http.Request) { r.Header.Set("app_type", "android") },
+			url:   "/?app_type=ios",
+			match: false,
+		},
+		{
+			name:  "app version",
+			conf:  MatchConf{AppVersion: ">=3.2, <4"},
+			setup: func(r *http.Request) { r.Header.Set("appversion", "3.10.1") },
+			match: true,
+		},
+		{
+			name:  "app version too low",
+			conf:  MatchConf{AppVersion: ">=3.2.0"},
+			setup: func(r *http.Request) { r.Header.Set("appversion", "3.1.9") },
+			match: false,
+		},
+		{
+			name:  "app version missing",
+			conf:  MatchConf{AppVersion: ">=3.2.0"},
+			match: false,
+		},
+		{
+			name:  "all",
+			conf:  MatchConf{Headers: []string{"X-Php-Caller"}, CIDRs: []string{"10.0.0.0/8"}},
+			setup: func(r *http.Request) { r.Header.Set("X-Php-Caller", "1") },
+			match: false,
+		},
+		{
+			name:  "not",
+			conf:  MatchConf{CIDRs: []string{"10.0.0.0/8"}, Not: true},
+			setup: func(r *http.Request) { r.RemoteAddr = "8.8.8.8:1234" },
+			match: true,
+		},
+	}
+
+	proxies, err := NewTrustedProxies([]string{"10.0.0.0/8"})
+	assert.NoError(t, err)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, err := NewMatcher(test.conf)
+			assert.NoError(t, err)
+
+			url := test.url
+			if len(url) == 0 {
+				url = "/"
+			}
+			r := httptest.NewRequest(http.MethodGet, url, http.NoBody)
+			if test.setup != nil {
+				test.setup(r)
+			}
+			r = WithClientIP(r, proxies.ClientIP(r))
+			assert.Equal(t, test.match, m.Match(r))
+		})
+	}
+}
+
+func TestNewMatcherError(t *testing.T) {
+	_, err := NewMatcher(MatchConf{CIDRs: []string{"10.0.0.0/33"}})
+	assert.Error(t, err)
+	_, err = NewMatcher(MatchConf{CIDRs: []string{"localhost"}})
+	assert.Error(t, err)
+	_, err = NewMatcher(MatchConf{UserAgent: "("})
+	assert.Error(t, err)
+	_, err = NewMatcher(MatchConf{AppVersion: ">=x.y"})
+	assert.Error(t, err)
+}
+
+func TestCompareVersion(t *testing.T) {
+	assert.Equal(t, 0, compareVersion([]int{3, 2}, []int{3, 2, 0}))
+	assert.Equal(t, 1, compareVersion([]int{3, 10}, []int{3, 9, 9}))
+	assert.Equal(t, -1, compareVersion([]int{2}, []int{3}))
+}
@@ -0,0 +1,34 @@
+package internal
+
+import (
+	"net/url"
+	"strings"
+)
+
+// OriginAllowed origin 是否在 allowed 中，allowed 为空或包含 * 时允许所有 origin
+// allowed 的每一项为 scheme://host[:port]，host 可以用 *. 开头匹配子域名，如 https://*.example.com
+func OriginAllowed(origin *url.URL, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+
+	scheme, host := strings.ToLower(origin.Scheme), strings.ToLower(origin.Host)
+	for _, a := range allowed {
+		if a == "*" {
+			return true
+		}
+
+		u, err := url.Parse(strings.ToLower(strings.TrimSuffix(a, "/")))
+		if err != nil || u.Scheme != scheme {
+			continue
+		}
+		if u.Host == host {
+			return true
+		}
+		if suffix, ok := strings.CutPrefix(u.Host, "*"); ok && strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+
+	return false
+}
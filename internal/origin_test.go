@@ -0,0 +1,35 @@
+package internal
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOriginAllowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		origin  string
+		allowed []string
+		expect  bool
+	}{
+		{name: "empty", origin: "https://evil.com", expect: true},
+		{name: "any", origin: "https://evil.com", allowed: []string{"*"}, expect: true},
+		{name: "exact", origin: "https://app.example.com", allowed: []string{"https://app.example.com/"}, expect: true},
+		{name: "case", origin: "https://App.Example.com", allowed: []string{"https://app.example.com"}, expect: true},
+		{name: "scheme", origin: "http://app.example.com", allowed: []string{"https://app.example.com"}, expect: false},
+		{name: "port", origin: "https://app.example.com:8443", allowed: []string{"https://app.example.com"}, expect: false},
+		{name: "subdomain", origin: "https://a.b.example.com", allowed: []string{"https://*.example.com"}, expect: true},
+		{name: "subdomain suffix", origin: "https://evilexample.com", allowed: []string{"https://*.example.com"}, expect: false},
+		{name: "other", origin: "https://evil.com", allowed: []string{"https://app.example.com"}, expect: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			origin, err := url.Parse(test.origin)
+			assert.NoError(t, err)
+			assert.Equal(t, test.expect, OriginAllowed(origin, test.allowed))
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PathTemplate 路由路径模板
+// 支持 /users/:id、/users/{id}、/v1/{name=shelves/*}、/v1/{name=files/**} 以及 /v1/books/{id}:cancel 的写法，
+// 统一转换成网关路由可识别的路径
+type PathTemplate struct {
+	// Template 配置的原始路径
+	Template string
+	// RoutePath 注册到网关路由的路径，变量统一为 :name 的形式，** 通配为 *name 的形式，
+	// 自定义方法以 :verb 结尾，如 /v1/books/:id:cancel
+	RoutePath string
+	// Verb 自定义方法，如 cancel
+	Verb string
+
+	vars []pathVariable
+}
+
+// pathVariable 带有子模板的变量，如 {name=shelves/*}
+type pathVariable struct {
+	name  string
+	parts []string
+}
+
+// ParsePathTemplate 解析路由路径模板
+func ParsePathTemplate(path string) (*PathTemplate, error) {
+	if len(path) == 0 || path[0] != '/' {
+		return nil, fmt.Errorf("路由路径必须以 / 开头：%s", path)
+	}
+
+	tpl := &PathTemplate{Template: path}
+	rawSegments := splitTemplate(path[1:])
+	// 最后一段中变量之外的 : 之后为自定义方法
+	if last := rawSegments[len(rawSegments)-1]; len(last) > 0 {
+		if i := verbIndex(last); i > 0 {
+			tpl.Verb = last[i+1:]
+			if !validVarName(tpl.Verb) {
+				return nil, fmt.Errorf("自定义方法有误：%s", path)
+			}
+			rawSegments[len(rawSegments)-1] = last[:i]
+		}
+	}
+
+	var (
+		segments []string
+		wildcard bool
+	)
+	for _, seg := range rawSegments {
+		if len(seg) == 0 {
+			continue
+		}
+		if wildcard {
+			return nil, fmt.Errorf("** 必须是路由路径的最后一段：%s", path)
+		}
+
+		switch {
+		case seg == "*":
+			segments = append(segments, fmt.Sprintf(":-%d", len(segments)))
+		case seg == "**":
+			segments = append(segments, fmt.Sprintf("*-%d", len(segments)))
+			wildcard = true
+		case seg[0] == '{':
+			if seg[len(seg)-1] != '}' {
+				return nil, fmt.Errorf("路由变量格式有误：%s", path)
+			}
+
+			name, pattern, hasPattern := strings.Cut(seg[1:len(seg)-1], "=")
+			if !validVarName(name) {
+				return nil, fmt.Errorf("路由变量名有误：%s", path)
+			}
+			if !hasPattern || pattern == "*" {
+				segments = append(segments, ":"+name)
+				continue
+			}
+			if pattern == "**" {
+				segments = append(segments, "*"+name)
+				wildcard = true
+				continue
+			}
+
+			v := pathVariable{name: name}
+			parts := strings.Split(pattern, "/")
+			for i, p := range parts {
+				switch {
+				case p == "*":
+					param := fmt.Sprintf("%s.%d", name, i)
+					segments = append(segments, ":"+param)
+					v.parts = append(v.parts, ":"+param)
+				case p == "**":
+					if i != len(parts)-1 {
+						return nil, fmt.Errorf("** 必须是路由路径的最后一段：%s", path)
+					}
+					param := fmt.Sprintf("%s.%d", name, i)
+					segments = append(segments, "*"+param)
+					v.parts = append(v.parts, "*"+param)
+					wildcard = true
+				case len(p) == 0 || strings.ContainsAny(p, ":{}*"):
+					return nil, fmt.Errorf("路由变量格式有误：%s", path)
+				default:
+					segments = append(segments, p)
+					v.parts = append(v.parts, p)
+				}
+			}
+			tpl.vars = append(tpl.vars, v)
+		case seg[0] == ':':
+			if !validVarName(seg[1:]) {
+				return nil, fmt.Errorf("路由变量名有误：%s", path)
+			}
+			segments = append(segments, seg)
+		default:
+			if strings.ContainsAny(seg, ":{}*") {
+				return nil, fmt.Errorf("路由变量必须占据完整的路径段：%s", path)
+			}
+			segments = append(segments, seg)
+		}
+	}
+
+	tpl.RoutePath = "/" + strings.Join(segments, "/")
+	if len(tpl.Verb) > 0 {
+		tpl.RoutePath += ":" + tpl.Verb
+	}
+	return tpl, nil
+}
+
+// Vars 将路由匹配出的变量还原成模板里的变量，如 {name=shelves/*} 还原为 name=shelves/xxx，
+// 未命名的 * 和 ** 不会返回
+func (t *PathTemplate) Vars(vars map[string]string) map[string]string {
+	ret := make(map[string]string, len(vars))
+	for k, v := range vars {
+		if !strings.HasPrefix(k, "-") {
+			ret[k] = v
+		}
+	}
+	for _, v := range t.vars {
+		parts := make([]string, len(v.parts))
+		for i, p := range v.parts {
+			if strings.HasPrefix(p, ":") || strings.HasPrefix(p, "*") {
+				parts[i] = ret[p[1:]]
+				delete(ret, p[1:])
+			} else {
+				parts[i] = p
+			}
+		}
+		ret[v.name] = strings.Join(parts, "/")
+	}
+
+	return ret
+}
+
+// SplitVerb 将路径最后一段中的自定义方法切分出来，如 /v1/books/1:cancel 切分为 /v1/books/1 和 cancel
+func SplitVerb(path string) (string, string) {
+	start := strings.LastIndexByte(path, '/') + 1
+	if i := strings.LastIndexByte(path[start:], ':'); i > 0 {
+		return path[:start+i], path[start+i+1:]
+	}
+
+	return path, ""
+}
+
+// verbIndex 返回路径段中自定义方法的 : 的位置，变量内和段首的 : 不算
+func verbIndex(seg string) int {
+	var depth int
+	for i := len(seg) - 1; i > 0; i-- {
+		switch seg[i] {
+		case '}':
+			depth++
+		case '{':
+			depth--
+		case ':':
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
+
+// splitTemplate 按 / 切分路径，{} 内的 / 不切分
+func splitTemplate(path string) []string {
+	var (
+		segments []string
+		depth    int
+		start    int
+	)
+	for i := 0; i < len(path); i++ {
+		switch path[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case '/':
+			if depth == 0 {
+				segments = append(segments, path[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	return append(segments, path[start:])
+}
+
+func validVarName(name string) bool {
+	if len(name) == 0 {
+		return false
+	}
+
+	for _, c := range name {
+		if c != '_' && c != '.' && (c < '0' || c > '9') && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePathTemplate(t *testing.T) {
+	tests := []struct {
+		path      string
+		routePath string
+	}{
+		{"/users", "/users"},
+		{"//users//list", "/users/list"},
+		{"/users/:id", "/users/:id"},
+		{"/users/{id}", "/users/:id"},
+		{"/users/{id=*}/books/{book_id}", "/users/:id/books/:book_id"},
+		{"/v1/{name=shelves/*}", "/v1/shelves/:name.1"},
+		{"/v1/{name=shelves/*/books/*}", "/v1/shelves/:name.1/books/:name.3"},
+		{"/v1/{name=shelves/**}", "/v1/shelves/*name.1"},
+		{"/v1/files/{path=**}", "/v1/files/*path"},
+		{"/v1/*/books/**", "/v1/:-1/books/*-3"},
+		{"/v1/books/{id}:cancel", "/v1/books/:id:cancel"},
+		{"/v1/books:batchGet", "/v1/books:batchGet"},
+		{"/v1/{name=shelves/*}:move", "/v1/shelves/:name.1:move"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			tpl, err := ParsePathTemplate(test.path)
+			assert.Nil(t, err)
+			assert.Equal(t, test.routePath, tpl.RoutePath)
+		})
+	}
+}
+
+func TestParsePathTemplateBadCases(t *testing.T) {
+	paths := []string{
+		"",
+		"users",
+		"/users/{id",
+		"/users/{}",
+		"/users/{id}.json",
+		"/users/v{id}",
+		"/users/:",
+		"/v1/{name=shelves/**/books}",
+		"/v1/**/books",
+		"/v1/books:",
+		"/v1/books:can-cel",
+		"/v1/{name=shelves//*}",
+		"/v1/{name=shelves/{id}}",
+	}
+
+	for _, path := range paths {
+		t.Run(path, func(t *testing.T) {
+			_, err := ParsePathTemplate(path)
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+func TestPathTemplateVars(t *testing.T) {
+	tpl, err := ParsePathTemplate("/v1/{name=shelves/*/books/*}/{id}")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"name": "shelves/1/books/2",
+		"id":   "3",
+	}, tpl.Vars(map[string]string{
+		"name.1": "1",
+		"name.3": "2",
+		"id":     "3",
+	}))
+
+	tpl, err = ParsePathTemplate("/users/{id}")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"id": "1"}, tpl.Vars(map[string]string{"id": "1"}))
+}
+
+func TestPathTemplateWildcardVars(t *testing.T) {
+	tpl, err := ParsePathTemplate("/v1/{name=shelves/**}/*")
+	assert.NotNil(t, err)
+
+	tpl, err = ParsePathTemplate("/v1/*/{name=shelves/**}:get")
+	assert.Nil(t, err)
+	assert.Equal(t, "get", tpl.Verb)
+	assert.Equal(t, map[string]string{
+		"name": "shelves/1/books/2",
+	}, tpl.Vars(map[string]string{
+		"-1":     "x",
+		"name.1": "1/books/2",
+	}))
+}
+
+func TestSplitVerb(t *testing.T) {
+	tests := []struct {
+		path string
+		base string
+		verb string
+	}{
+		{"/v1/books/1:cancel", "/v1/books/1", "cancel"},
+		{"/v1/books:batchGet", "/v1/books", "batchGet"},
+		{"/v1/books/:id", "/v1/books/:id", ""},
+		{"/v1:x/books", "/v1:x/books", ""},
+		{"/v1/books", "/v1/books", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			base, verb := SplitVerb(test.path)
+			assert.Equal(t, test.base, base)
+			assert.Equal(t, test.verb, verb)
+		})
+	}
+}
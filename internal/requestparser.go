@@ -6,10 +6,12 @@ import (
 	"fmt"
 	"github.com/fullstorydev/grpcurl"
 	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
 	"github.com/zeromicro/go-zero/rest/httpx"
 	"github.com/zeromicro/go-zero/rest/pathvar"
 	"io"
 	"net/http"
+	"strings"
 )
 
 //c端：公共参数 https://jz-tech.yuque.com/jz-tech/lg6nsn/pql09s
@@ -30,19 +32,19 @@ var unSetKeys = []string{
 
 // NewRequestParser creates a new request parser from the given http.Request and resolver.
 func NewRequestParser(r *http.Request, resolver jsonpb.AnyResolver) (grpcurl.RequestParser, error) {
-	vars := pathvar.Vars(r)
+	vars := getVars(r)
 	params, err := httpx.GetFormValues(r)
 	if err != nil {
 		return nil, err
 	}
-	for k, v := range vars {
-		params[k] = v
-	}
 	//X-Forwarded-For 数据处理
 	unsetCheckVal(params)
 
 	body, ok := getBody(r)
 	if !ok {
+		if err := setVars(params, vars); err != nil {
+			return nil, err
+		}
 		return buildJsonRequestParser(params, resolver)
 	}
 
@@ -54,7 +56,7 @@ func NewRequestParser(r *http.Request, resolver jsonpb.AnyResolver) (grpcurl.Req
 	//body 数据处理
 	unsetCheckVal(m)
 
-	if len(params) == 0 {
+	if len(params) == 0 && len(vars) == 0 {
 		formatJson, _ := json.Marshal(m)
 		formatReader := bytes.NewReader(formatJson)
 		return grpcurl.NewJSONRequestParserWithUnmarshaler(formatReader, jsonpb.Unmarshaler{
@@ -65,10 +67,113 @@ func NewRequestParser(r *http.Request, resolver jsonpb.AnyResolver) (grpcurl.Req
 	for k, v := range params {
 		m[k] = v
 	}
+	if err := setVars(m, vars); err != nil {
+		return nil, err
+	}
 
 	return buildJsonRequestParser(m, resolver)
 }
 
+// NewRequestParserWithBody creates a request parser which maps the request body as google.api.HttpRule.body describes.
+// annotated 表示路由来自 google.api.http 注解，body 为 * 时与 NewRequestParser 相同，为空时请求体不映射字段，只使用 query 参数，
+// 否则请求体映射到该字段，路径变量和 query 参数映射到其它字段；
+// 配置文件中的路由 annotated 为 false，没有 body，与 NewRequestParser 相同，请求体合并到请求消息中
+func NewRequestParserWithBody(r *http.Request, resolver jsonpb.AnyResolver, body string, annotated bool) (grpcurl.RequestParser, error) {
+	if body == "*" || (len(body) == 0 && !annotated) {
+		return NewRequestParser(r, resolver)
+	}
+
+	if len(body) == 0 {
+		m := getQueryValues(r)
+		if err := setVars(m, getVars(r)); err != nil {
+			return nil, err
+		}
+		return buildJsonRequestParser(m, resolver)
+	}
+
+	m, err := httpx.GetFormValues(r)
+	if err != nil {
+		return nil, err
+	}
+	unsetCheckVal(m)
+
+	if reader, ok := getBody(r); ok {
+		var v any
+		if err := json.NewDecoder(reader).Decode(&v); err != nil {
+			return nil, err
+		}
+
+		if err := setField(m, body, v); err != nil {
+			return nil, err
+		}
+	}
+	if err := setVars(m, getVars(r)); err != nil {
+		return nil, err
+	}
+
+	return buildJsonRequestParser(m, resolver)
+}
+
+// getQueryValues 返回 query 参数，与 httpx.GetFormValues 一样每个参数只取第一个值并忽略空值，不读取请求体
+func getQueryValues(r *http.Request) map[string]any {
+	query := r.URL.Query()
+	params := make(map[string]any, len(query))
+	for name := range query {
+		if val := query.Get(name); len(val) > 0 {
+			params[name] = val
+		}
+	}
+	unsetCheckVal(params)
+
+	return params
+}
+
+// getVars 返回路径变量，变量名为 HttpRule 中的字段路径，如 book.name
+func getVars(r *http.Request) map[string]any {
+	vars := make(map[string]any)
+	for k, v := range pathvar.Vars(r) {
+		vars[k] = v
+	}
+	unsetCheckVal(vars)
+
+	return vars
+}
+
+// setVars 将路径变量按字段路径设置到 m 中，query 和表单参数不展开 a.b 形式的字段路径
+func setVars(m, vars map[string]any) error {
+	for k, v := range vars {
+		if err := setField(m, k, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setField 按字段路径设置值，如 book.name 设置到 m["book"]["name"]，
+// 路径中间的字段已有非对象的值时返回错误，不覆盖
+func setField(m map[string]any, path string, v any) error {
+	names := strings.Split(path, ".")
+	for i, name := range names[:len(names)-1] {
+		val, ok := m[name]
+		if !ok {
+			sub := make(map[string]any)
+			m[name] = sub
+			m = sub
+			continue
+		}
+
+		sub, ok := val.(map[string]any)
+		if !ok {
+			return fmt.Errorf("字段 %s 与 %s 冲突", strings.Join(names[:i+1], "."), path)
+		}
+		m = sub
+	}
+
+	m[names[len(names)-1]] = v
+	return nil
+}
+
 func buildJsonRequestParser(m map[string]any, resolver jsonpb.AnyResolver) (
 	grpcurl.RequestParser, error) {
 	var buf bytes.Buffer
@@ -109,3 +214,71 @@ func unsetCheckVal(m map[string]any) {
 		delete(m, key)
 	}
 }
+
+// frameRequestParser 将 WebSocket 的每一帧解析为一条请求消息
+type frameRequestParser struct {
+	params       map[string]any
+	next         func() (string, error)
+	unmarshaler  jsonpb.Unmarshaler
+	requestCount int
+	done         bool
+}
+
+// NewFrameRequestParser creates a request parser which parses each frame returned by next as one request message.
+// Path variables and form values of r are merged into every message, an empty frame ends the request stream.
+func NewFrameRequestParser(r *http.Request, resolver jsonpb.AnyResolver,
+	next func() (string, error)) (grpcurl.RequestParser, error) {
+	params, err := httpx.GetFormValues(r)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range pathvar.Vars(r) {
+		params[k] = v
+	}
+	unsetCheckVal(params)
+
+	return &frameRequestParser{
+		params: params,
+		next:   next,
+		unmarshaler: jsonpb.Unmarshaler{
+			AllowUnknownFields: true,
+			AnyResolver:        resolver,
+		},
+	}, nil
+}
+
+func (p *frameRequestParser) Next(msg proto.Message) error {
+	if p.done {
+		return io.EOF
+	}
+
+	frame, err := p.next()
+	if err == nil && len(strings.TrimSpace(frame)) == 0 {
+		err = io.EOF
+	}
+	if err != nil {
+		p.done = true
+		return err
+	}
+
+	m := make(map[string]any)
+	if err := json.Unmarshal([]byte(frame), &m); err != nil {
+		return err
+	}
+	unsetCheckVal(m)
+	for k, v := range p.params {
+		m[k] = v
+	}
+
+	bs, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	p.requestCount++
+	return p.unmarshaler.Unmarshal(bytes.NewReader(bs), msg)
+}
+
+func (p *frameRequestParser) NumRequests() int {
+	return p.requestCount
+}
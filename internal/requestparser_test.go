@@ -2,6 +2,7 @@ package internal
 
 import (
 	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -9,6 +10,7 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/zeromicro/go-zero/rest/pathvar"
+	"google.golang.org/protobuf/types/known/structpb"
 )
 
 func TestNewRequestParserNoVar(t *testing.T) {
@@ -93,7 +95,152 @@ func TestRequestParser_buildJsonRequestParser(t *testing.T) {
 	assert.Nil(t, parser)
 }
 
+func TestNewFrameRequestParser(t *testing.T) {
+	req := httptest.NewRequest("GET", "/room?room=1&security_key=sk", http.NoBody)
+	req = pathvar.WithVars(req, map[string]string{"c": "d"})
+	frames := []string{`{"a": "b", "timestamp": 1}`, `{"a": "c"}`, ""}
+	parser, err := NewFrameRequestParser(req, nil, func() (string, error) {
+		frame := frames[0]
+		frames = frames[1:]
+		return frame, nil
+	})
+	assert.Nil(t, err)
+
+	var msg structpb.Struct
+	assert.Nil(t, parser.Next(&msg))
+	assert.Equal(t, map[string]any{"a": "b", "c": "d", "room": "1"}, msg.AsMap())
+	msg.Reset()
+	assert.Nil(t, parser.Next(&msg))
+	assert.Equal(t, map[string]any{"a": "c", "c": "d", "room": "1"}, msg.AsMap())
+	assert.Equal(t, io.EOF, parser.Next(&msg))
+	assert.Equal(t, io.EOF, parser.Next(&msg))
+	assert.Equal(t, 2, parser.NumRequests())
+}
+
+func TestNewFrameRequestParserWithBadFrame(t *testing.T) {
+	req := httptest.NewRequest("GET", "/room", http.NoBody)
+	parser, err := NewFrameRequestParser(req, nil, func() (string, error) {
+		return `{"a": `, nil
+	})
+	assert.Nil(t, err)
+	assert.NotNil(t, parser.Next(&structpb.Struct{}))
+
+	parser, err = NewFrameRequestParser(req, nil, func() (string, error) {
+		return "", errors.New("closed")
+	})
+	assert.Nil(t, err)
+	assert.NotNil(t, parser.Next(&structpb.Struct{}))
+	assert.Equal(t, io.EOF, parser.Next(&structpb.Struct{}))
+}
+
 type badBody struct{}
 
 func (badBody) Read([]byte) (int, error) { return 0, errors.New("something bad") }
 func (badBody) Close() error             { return nil }
+
+func TestNewRequestParserWithBody(t *testing.T) {
+	req := httptest.NewRequest("PATCH", "/v1/books/1?book.title=x", strings.NewReader(`{"title": "y", "pages": [1, 2]}`))
+	req = pathvar.WithVars(req, map[string]string{"name": "books/1"})
+	parser, err := NewRequestParserWithBody(req, nil, "book", true)
+	assert.Nil(t, err)
+
+	var msg structpb.Struct
+	assert.Nil(t, parser.Next(&msg))
+	assert.Equal(t, "books/1", msg.Fields["name"].GetStringValue())
+	book := msg.Fields["book"].GetStructValue()
+	assert.Equal(t, "y", book.Fields["title"].GetStringValue())
+	assert.Len(t, book.Fields["pages"].GetListValue().GetValues(), 2)
+}
+
+func TestNewRequestParserWithBodyNestedVars(t *testing.T) {
+	req := httptest.NewRequest("GET", "/v1/books/1", http.NoBody)
+	req = pathvar.WithVars(req, map[string]string{"book.name": "1"})
+	parser, err := NewRequestParserWithBody(req, nil, "", true)
+	assert.Nil(t, err)
+
+	var msg structpb.Struct
+	assert.Nil(t, parser.Next(&msg))
+	assert.Equal(t, "1", msg.Fields["book"].GetStructValue().Fields["name"].GetStringValue())
+}
+
+func TestNewRequestParserWithBadBodyField(t *testing.T) {
+	req := httptest.NewRequest("POST", "/v1/books", strings.NewReader(`{"title": `))
+	_, err := NewRequestParserWithBody(req, nil, "book", true)
+	assert.NotNil(t, err)
+}
+
+func TestNewRequestParserQueryNotExpanded(t *testing.T) {
+	req := httptest.NewRequest("GET", "/?a=1&a.b=2", http.NoBody)
+	parser, err := NewRequestParser(req, nil)
+	assert.Nil(t, err)
+
+	var msg structpb.Struct
+	assert.Nil(t, parser.Next(&msg))
+	assert.Equal(t, "1", msg.Fields["a"].GetStringValue())
+	assert.Equal(t, "2", msg.Fields["a.b"].GetStringValue())
+}
+
+func TestNewRequestParserConflictVars(t *testing.T) {
+	req := httptest.NewRequest("GET", "/v1/books/1?book=x", http.NoBody)
+	req = pathvar.WithVars(req, map[string]string{"book.name": "1"})
+	_, err := NewRequestParser(req, nil)
+	assert.NotNil(t, err)
+
+	req = httptest.NewRequest("PATCH", "/v1/books/1", strings.NewReader(`"x"`))
+	req = pathvar.WithVars(req, map[string]string{"book.name": "1"})
+	_, err = NewRequestParserWithBody(req, nil, "book", true)
+	assert.NotNil(t, err)
+}
+
+func TestNewRequestParserWithBodyAndNestedVars(t *testing.T) {
+	req := httptest.NewRequest("PATCH", "/v1/books/1", strings.NewReader(`{"title": "y"}`))
+	req = pathvar.WithVars(req, map[string]string{"book.name": "1"})
+	parser, err := NewRequestParserWithBody(req, nil, "book", true)
+	assert.Nil(t, err)
+
+	var msg structpb.Struct
+	assert.Nil(t, parser.Next(&msg))
+	book := msg.Fields["book"].GetStructValue()
+	assert.Equal(t, "1", book.Fields["name"].GetStringValue())
+	assert.Equal(t, "y", book.Fields["title"].GetStringValue())
+}
+
+func TestNewRequestParserWithoutBody(t *testing.T) {
+	newReq := func() *http.Request {
+		req := httptest.NewRequest("POST", "/v1/books/1:publish?force=true", strings.NewReader(`{"title": "y"}`))
+		req.Header.Set("Content-Type", "application/json")
+		return pathvar.WithVars(req, map[string]string{"name": "1"})
+	}
+
+	// 注解没有 body 时请求体不映射字段
+	parser, err := NewRequestParserWithBody(newReq(), nil, "", true)
+	assert.Nil(t, err)
+	var msg structpb.Struct
+	assert.Nil(t, parser.Next(&msg))
+	assert.Equal(t, "1", msg.Fields["name"].GetStringValue())
+	assert.Equal(t, "true", msg.Fields["force"].GetStringValue())
+	assert.NotContains(t, msg.Fields, "title")
+
+	// 表单请求体也不映射
+	req := httptest.NewRequest("POST", "/v1/books/1:publish", strings.NewReader("title=y"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	parser, err = NewRequestParserWithBody(req, nil, "", true)
+	assert.Nil(t, err)
+	msg = structpb.Struct{}
+	assert.Nil(t, parser.Next(&msg))
+	assert.NotContains(t, msg.Fields, "title")
+
+	// 配置文件中的路由请求体合并到请求消息中
+	parser, err = NewRequestParserWithBody(newReq(), nil, "", false)
+	assert.Nil(t, err)
+	msg = structpb.Struct{}
+	assert.Nil(t, parser.Next(&msg))
+	assert.Equal(t, "1", msg.Fields["name"].GetStringValue())
+	assert.Equal(t, "y", msg.Fields["title"].GetStringValue())
+
+	parser, err = NewRequestParserWithBody(newReq(), nil, "*", true)
+	assert.Nil(t, err)
+	msg = structpb.Struct{}
+	assert.Nil(t, parser.Next(&msg))
+	assert.Equal(t, "y", msg.Fields["title"].GetStringValue())
+}
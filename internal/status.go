@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// HttpStatusFromCode gRPC 状态码对应的标准 HTTP 状态码
+func HttpStatusFromCode(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// ParseCode 解析 gRPC 状态码，支持数字、NotFound 以及 NOT_FOUND 的写法
+func ParseCode(s string) (codes.Code, error) {
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		if n > uint64(codes.Unauthenticated) {
+			return 0, fmt.Errorf("gRPC 状态码有误：%s", s)
+		}
+		return codes.Code(n), nil
+	}
+
+	name := strings.ToLower(strings.ReplaceAll(s, "_", ""))
+	for c := codes.OK; c <= codes.Unauthenticated; c++ {
+		if strings.ToLower(c.String()) == name {
+			return c, nil
+		}
+	}
+	// codes.Canceled 的字符串为 Canceled，兼容 Cancelled 的写法
+	if name == "cancelled" {
+		return codes.Canceled, nil
+	}
+
+	return 0, fmt.Errorf("gRPC 状态码有误：%s", s)
+}
+
+// ErrorDetails 将 status 中的 BadRequest、RetryInfo 和 ErrorInfo 转换为 JSON 对象，没有这些详情时返回 nil
+func ErrorDetails(st *status.Status) map[string]any {
+	details := make(map[string]any)
+	for _, d := range st.Details() {
+		switch detail := d.(type) {
+		case *errdetails.BadRequest:
+			violations, _ := details["field_violations"].([]map[string]string)
+			for _, v := range detail.GetFieldViolations() {
+				violations = append(violations, map[string]string{
+					"field":       v.GetField(),
+					"description": v.GetDescription(),
+				})
+			}
+			details["field_violations"] = violations
+		case *errdetails.RetryInfo:
+			if delay := detail.GetRetryDelay(); delay != nil {
+				details["retry_delay"] = delay.AsDuration().String()
+			}
+		case *errdetails.ErrorInfo:
+			details["error_info"] = map[string]any{
+				"reason":   detail.GetReason(),
+				"domain":   detail.GetDomain(),
+				"metadata": detail.GetMetadata(),
+			}
+		}
+	}
+
+	if len(details) == 0 {
+		return nil
+	}
+
+	return details
+}
+
+// RetryAfter status 中 RetryInfo 的重试间隔，向上取整到秒，没有时返回 0
+func RetryAfter(st *status.Status) int {
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.RetryInfo); ok && info.GetRetryDelay() != nil {
+			delay := info.GetRetryDelay().AsDuration()
+			secs := int(delay.Seconds())
+			if delay > 0 && float64(secs) < delay.Seconds() {
+				secs++
+			}
+			return secs
+		}
+	}
+
+	return 0
+}
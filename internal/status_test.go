@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+func TestHttpStatusFromCode(t *testing.T) {
+	assert.Equal(t, http.StatusOK, HttpStatusFromCode(codes.OK))
+	assert.Equal(t, http.StatusNotFound, HttpStatusFromCode(codes.NotFound))
+	assert.Equal(t, http.StatusServiceUnavailable, HttpStatusFromCode(codes.Unavailable))
+	assert.Equal(t, http.StatusBadRequest, HttpStatusFromCode(codes.InvalidArgument))
+	assert.Equal(t, http.StatusInternalServerError, HttpStatusFromCode(codes.DataLoss))
+}
+
+func TestParseCode(t *testing.T) {
+	tests := []struct {
+		s    string
+		code codes.Code
+	}{
+		{"5", codes.NotFound},
+		{"NotFound", codes.NotFound},
+		{"NOT_FOUND", codes.NotFound},
+		{"unavailable", codes.Unavailable},
+		{"CANCELLED", codes.Canceled},
+	}
+
+	for _, test := range tests {
+		t.Run(test.s, func(t *testing.T) {
+			code, err := ParseCode(test.s)
+			assert.Nil(t, err)
+			assert.Equal(t, test.code, code)
+		})
+	}
+
+	for _, s := range []string{"", "17", "NotExist"} {
+		_, err := ParseCode(s)
+		assert.NotNil(t, err)
+	}
+}
+
+func TestErrorDetails(t *testing.T) {
+	st := status.New(codes.InvalidArgument, "bad")
+	assert.Nil(t, ErrorDetails(st))
+	assert.Equal(t, 0, RetryAfter(st))
+
+	st, err := st.WithDetails(&errdetails.BadRequest{
+		FieldViolations: []*errdetails.BadRequest_FieldViolation{
+			{Field: "name", Description: "required"},
+		},
+	}, &errdetails.RetryInfo{
+		RetryDelay: durationpb.New(1500 * time.Millisecond),
+	}, &errdetails.ErrorInfo{
+		Reason:   "NAME_EMPTY",
+		Domain:   "study",
+		Metadata: map[string]string{"k": "v"},
+	})
+	assert.Nil(t, err)
+
+	assert.Equal(t, map[string]any{
+		"field_violations": []map[string]string{
+			{"field": "name", "description": "required"},
+		},
+		"retry_delay": "1.5s",
+		"error_info": map[string]any{
+			"reason":   "NAME_EMPTY",
+			"domain":   "study",
+			"metadata": map[string]string{"k": "v"},
+		},
+	}, ErrorDetails(st))
+	assert.Equal(t, 2, RetryAfter(st))
+}
@@ -0,0 +1,167 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/zeromicro/go-zero/core/logx"
+)
+
+// healthCheckTimeout 启动时和就绪检查时等待插件 HealthCheck 的时间
+const healthCheckTimeout = 5 * time.Second
+
+type (
+	// PluginIniter 可选接口，插件在构造路由之前按注册顺序调用，用于检查配置、建立连接
+	// 返回错误时启动失败，配置热更新时新创建的插件返回错误则本次热更新失败
+	PluginIniter interface {
+		Init(c *GatewayConf) error
+	}
+
+	// PluginStarter 可选接口，所有待启动的插件 Init 之后按注册顺序调用，用于启动后台任务
+	PluginStarter interface {
+		Start() error
+	}
+
+	// PluginStopper 可选接口，网关停止时按注册的逆序调用，用于关闭连接、停止后台任务
+	PluginStopper interface {
+		Stop()
+	}
+
+	// PluginHealthChecker 可选接口，启动时和就绪检查时调用，返回错误表示插件未就绪
+	PluginHealthChecker interface {
+		HealthCheck(ctx context.Context) error
+	}
+)
+
+// startPlugins 按注册顺序 Init 和 Start 还未启动的插件
+func (s *Server) startPlugins(c *GatewayConf) error {
+	pm := s.plugin
+	var pending []string
+	for _, name := range pm.order {
+		if !pm.started[name] {
+			pending = append(pending, name)
+		}
+	}
+
+	for _, name := range pending {
+		if pm.inited[name] {
+			continue
+		}
+		if initer, ok := pm.plugins[name].(PluginIniter); ok {
+			if err := initer.Init(c); err != nil {
+				return fmt.Errorf("插件 %s 初始化失败：%w", name, err)
+			}
+		}
+		pm.inited[name] = true
+	}
+
+	for _, name := range pending {
+		if starter, ok := pm.plugins[name].(PluginStarter); ok {
+			if err := starter.Start(); err != nil {
+				return fmt.Errorf("插件 %s 启动失败：%w", name, err)
+			}
+		}
+		pm.started[name] = true
+	}
+
+	return nil
+}
+
+// stopPlugins 按注册的逆序停止已启动的插件
+func (s *Server) stopPlugins() {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+
+	pm := s.plugin
+	for i := len(pm.order) - 1; i >= 0; i-- {
+		name := pm.order[i]
+		if !pm.started[name] {
+			continue
+		}
+
+		if stopper, ok := pm.plugins[name].(PluginStopper); ok {
+			stopper.Stop()
+		}
+		delete(pm.started, name)
+		delete(pm.inited, name)
+	}
+}
+
+// removePlugins 配置热更新失败时按创建的逆序停止并移除本次创建的插件，下次热更新时重新创建
+// 已经 Init 的插件也会调用 Stop，释放 Init 中建立的连接
+func (s *Server) removePlugins(names []string) {
+	if len(names) == 0 {
+		return
+	}
+
+	pm := s.plugin
+	removed := make(map[string]bool, len(names))
+	for i := len(names) - 1; i >= 0; i-- {
+		name := names[i]
+		if stopper, ok := pm.plugins[name].(PluginStopper); ok && pm.inited[name] {
+			stopper.Stop()
+		}
+		delete(pm.plugins, name)
+		delete(pm.started, name)
+		delete(pm.inited, name)
+		removed[name] = true
+	}
+
+	order := make([]string, 0, len(pm.order))
+	for _, name := range pm.order {
+		if !removed[name] {
+			order = append(order, name)
+		}
+	}
+	pm.order = order
+}
+
+// CheckHealth 检查所有插件是否就绪，未就绪的插件一起返回
+func (s *Server) CheckHealth(ctx context.Context) error {
+	s.reloadLock.Lock()
+	var (
+		names    []string
+		checkers []PluginHealthChecker
+	)
+	for _, name := range s.plugin.order {
+		if checker, ok := s.plugin.plugins[name].(PluginHealthChecker); ok {
+			names = append(names, name)
+			checkers = append(checkers, checker)
+		}
+	}
+	s.reloadLock.Unlock()
+
+	var errs []string
+	for i, checker := range checkers {
+		if err := checker.HealthCheck(ctx); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", names[i], err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("插件未就绪：%s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// checkHealth 带超时的 CheckHealth
+func (s *Server) checkHealth() error {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+
+	return s.CheckHealth(ctx)
+}
+
+// readyHandler 就绪检查，所有插件就绪时返回 200，否则返回 503
+func (s *Server) readyHandler(w http.ResponseWriter, _ *http.Request) {
+	if err := s.checkHealth(); err != nil {
+		logx.Error(err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	_, _ = w.Write([]byte("OK"))
+}
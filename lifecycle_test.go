@@ -0,0 +1,185 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// lifecyclePlugin 记录生命周期方法调用的插件
+type lifecyclePlugin struct {
+	plainPlugin
+	calls     *callRecorder
+	initErr   error
+	startErr  error
+	healthErr error
+}
+
+func (p *lifecyclePlugin) Init(*GatewayConf) error {
+	p.calls.add(p.name + ".Init")
+	return p.initErr
+}
+
+func (p *lifecyclePlugin) Start() error {
+	p.calls.add(p.name + ".Start")
+	return p.startErr
+}
+
+func (p *lifecyclePlugin) Stop() {
+	p.calls.add(p.name + ".Stop")
+}
+
+func (p *lifecyclePlugin) HealthCheck(context.Context) error {
+	return p.healthErr
+}
+
+func newLifecyclePlugin(name string, calls *callRecorder) *lifecyclePlugin {
+	return &lifecyclePlugin{plainPlugin: plainPlugin{name: name}, calls: calls}
+}
+
+func newLifecycleServer(plugins ...Plugin) *Server {
+	svr := MustNewServer(&GatewayConf{})
+	for _, pl := range plugins {
+		svr.Register(pl)
+	}
+
+	return svr
+}
+
+func TestStartPlugins(t *testing.T) {
+	calls := new(callRecorder)
+	svr := newLifecycleServer(newLifecyclePlugin("a", calls), plain("plain"), newLifecyclePlugin("b", calls))
+
+	// 全部 Init 之后再按注册顺序 Start
+	assert.NoError(t, svr.startPlugins(svr.Config))
+	assert.Equal(t, []string{"a.Init", "b.Init", "a.Start", "b.Start"}, calls.list())
+	assert.True(t, svr.plugin.started["plain"])
+
+	// 已启动的插件不再调用
+	svr.Register(newLifecyclePlugin("c", calls))
+	assert.NoError(t, svr.startPlugins(svr.Config))
+	assert.Equal(t, []string{"a.Init", "b.Init", "a.Start", "b.Start", "c.Init", "c.Start"}, calls.list())
+}
+
+func TestStartPluginsFailed(t *testing.T) {
+	calls := new(callRecorder)
+	b := newLifecyclePlugin("b", calls)
+	b.initErr = errors.New("init")
+	svr := newLifecycleServer(newLifecyclePlugin("a", calls), b)
+
+	assert.EqualError(t, svr.startPlugins(svr.Config), "插件 b 初始化失败：init")
+	assert.Equal(t, []string{"a.Init", "b.Init"}, calls.list())
+	assert.True(t, svr.plugin.inited["a"])
+	assert.False(t, svr.plugin.inited["b"])
+	assert.Empty(t, svr.plugin.started)
+
+	// 之后 Init 成功时已 Init 的插件不再调用 Init
+	b.initErr = nil
+	b.startErr = errors.New("start")
+	assert.EqualError(t, svr.startPlugins(svr.Config), "插件 b 启动失败：start")
+	assert.Equal(t, []string{"a.Init", "b.Init", "b.Init", "a.Start", "b.Start"}, calls.list())
+	assert.True(t, svr.plugin.started["a"])
+	assert.False(t, svr.plugin.started["b"])
+}
+
+func TestStopPlugins(t *testing.T) {
+	calls := new(callRecorder)
+	svr := newLifecycleServer(newLifecyclePlugin("a", calls), newLifecyclePlugin("b", calls))
+	assert.NoError(t, svr.startPlugins(svr.Config))
+	svr.Register(newLifecyclePlugin("c", calls))
+
+	// 按注册的逆序停止，未启动的插件不调用 Stop
+	svr.stopPlugins()
+	assert.Equal(t, []string{"a.Init", "b.Init", "a.Start", "b.Start", "b.Stop", "a.Stop"}, calls.list())
+	assert.Empty(t, svr.plugin.started)
+	assert.Empty(t, svr.plugin.inited)
+	assert.Len(t, svr.plugin.plugins, 3)
+}
+
+func TestRemovePlugins(t *testing.T) {
+	calls := new(callRecorder)
+	svr := newLifecycleServer(newLifecyclePlugin("a", calls), newLifecyclePlugin("b", calls),
+		newLifecyclePlugin("c", calls), newLifecyclePlugin("d", calls))
+	b := svr.plugin.plugins["b"].(*lifecyclePlugin)
+	b.startErr = errors.New("start")
+	assert.Error(t, svr.startPlugins(svr.Config))
+
+	// 已 Init 的插件都调用 Stop，按创建的逆序
+	svr.removePlugins([]string{"b", "c"})
+	assert.Equal(t, []string{"a.Init", "b.Init", "c.Init", "d.Init", "a.Start", "b.Start", "c.Stop", "b.Stop"}, calls.list())
+	assert.Equal(t, []string{"a", "d"}, svr.plugin.order)
+	assert.NotContains(t, svr.plugin.plugins, "b")
+	assert.NotContains(t, svr.plugin.inited, "c")
+	assert.True(t, svr.plugin.started["a"])
+
+	svr.removePlugins(nil)
+	assert.Equal(t, []string{"a", "d"}, svr.plugin.order)
+}
+
+func TestCheckHealth(t *testing.T) {
+	a, b := newLifecyclePlugin("a", new(callRecorder)), newLifecyclePlugin("b", new(callRecorder))
+	svr := newLifecycleServer(a, plain("plain"), b)
+	assert.NoError(t, svr.CheckHealth(context.Background()))
+
+	w := httptest.NewRecorder()
+	svr.readyHandler(w, httptest.NewRequest(http.MethodGet, "/ready", http.NoBody))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "OK", w.Body.String())
+
+	// 未就绪的插件一起返回
+	a.healthErr = errors.New("down")
+	b.healthErr = errors.New("timeout")
+	assert.EqualError(t, svr.CheckHealth(context.Background()), "插件未就绪：a: down; b: timeout")
+
+	w = httptest.NewRecorder()
+	svr.readyHandler(w, httptest.NewRequest(http.MethodGet, "/ready", http.NoBody))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "插件未就绪")
+}
+
+func TestReloadRollback(t *testing.T) {
+	addr, _ := newTestUpstream(t)
+	calls := new(callRecorder)
+	var created []*lifecyclePlugin
+	startErr := errors.New("start")
+	svr := MustNewServer(&GatewayConf{}, WithPluginFactories(map[string]PluginFactory{
+		"created": func(*GatewayConf) (Plugin, error) {
+			pl := newLifecyclePlugin("created", calls)
+			pl.startErr = startErr
+			created = append(created, pl)
+			return pl, nil
+		},
+	}))
+	svr.Register(newLifecyclePlugin("test", calls))
+	c := newTestConf(addr, testMapping(http.MethodGet, "/health", testHealthCheck))
+	assert.NoError(t, svr.Reload(c))
+	defer svr.releaseConns(svr.current, nil)
+	old := svr.current
+
+	// 新创建的插件启动失败时停止并移除，已注册的插件不受影响
+	next := newTestConf(addr, RouteMapping{Method: http.MethodGet, Path: "/health", RpcPath: testHealthCheck,
+		Plugins: []string{"test", "created"}})
+	assert.EqualError(t, svr.Reload(next), "插件 created 启动失败：start")
+	assert.Equal(t, []string{"test.Init", "test.Start", "created.Init", "created.Start", "created.Stop"}, calls.list())
+	assert.Equal(t, []string{"test"}, svr.plugin.order)
+	assert.Same(t, old, svr.current)
+
+	// 构造路由失败时同样回滚，下次热更新重新创建
+	startErr = nil
+	bad := newTestConf(addr, RouteMapping{Method: http.MethodGet, Path: "/missing", RpcPath: "grpc.health.v1.Health/Missing",
+		Plugins: []string{"test", "created"}})
+	assert.Error(t, svr.Reload(bad))
+	assert.Equal(t, []string{"created.Init", "created.Start", "created.Stop"}, calls.list()[5:])
+	assert.NotContains(t, svr.plugin.plugins, "created")
+	assert.Same(t, old, svr.current)
+
+	assert.NoError(t, svr.Reload(next))
+	assert.Len(t, created, 3)
+	assert.Same(t, created[2], svr.plugin.plugins["created"])
+	assert.True(t, svr.plugin.started["created"])
+	assert.Equal(t, `{"status":"SERVING"}`, serveServer(svr, http.MethodGet, "/health", "").Body.String())
+}
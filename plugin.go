@@ -1,13 +1,17 @@
 package gateway
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 
 	"github.com/golang/protobuf/jsonpb"
+	"github.com/punpeo/pun-gateway-lib/internal"
+	"github.com/zeromicro/go-zero/core/conf"
 	"github.com/zeromicro/go-zero/core/logx"
 	"github.com/zeromicro/go-zero/rest"
 	"net/http"
+	"sort"
 	"strings"
 )
 
@@ -17,15 +21,56 @@ var pluginDefault = []string{"empty"}
 
 // Plugin 插件，可以拦截和添加中间件
 // 默认需要实现以下接口，若个别部分不需要则可返回nil
+// 还需要实现 RpcHandler 或 ContextRpcHandler，如果不需要请嵌入 BasicRpcHandler 或 BasicContextRpcHandler
 type Plugin interface {
 	// Name 插件名
 	Name() string
 
 	// Middleware http 请求中间件
 	Middleware() rest.Middleware
+}
+
+// PluginFactory 插件的构造函数
+type PluginFactory func(c *GatewayConf) (Plugin, error)
+
+// RoutePlugin 可选接口，插件实现后按路由上配置的参数为每条路由创建插件对象
+// 配置热更新时重新创建，返回错误时本次配置加载失败；未实现该接口的插件不能配置参数
+type RoutePlugin interface {
+	// ForRoute 返回用于 method、path 路由的插件，path 为路由模板，如 /users/:id
+	ForRoute(method, path string, args PluginArgs) (Plugin, error)
+}
+
+// RouteOutputChecker 可选接口，构造路由时检查插件能否用于路由的输出方式，返回错误时本次配置加载失败
+type RouteOutputChecker interface {
+	// CheckOutput 检查 ForRoute 返回的插件，未实现 RoutePlugin 时检查插件本身
+	CheckOutput(out RouteOutput) error
+}
+
+// RouteOutput 路由的输出方式
+type RouteOutput struct {
+	// Formatted 配置了 Formatter，响应由 Formatter 在插件之后写入
+	Formatted bool
+	// WebSocket WebSocket 路由，响应写入已升级的连接，不能再设置响应头和状态码
+	WebSocket bool
+	// Stream 服务端流路由，响应头在第一条消息之前写入
+	Stream bool
+}
+
+// PluginArgs 插件在路由上的参数
+type PluginArgs map[string]interface{}
+
+// Unmarshal 按 go-zero 配置的规则解析参数，支持 optional、default、options 等标签，key 不区分大小写
+func (a PluginArgs) Unmarshal(v interface{}) error {
+	if a == nil {
+		a = PluginArgs{}
+	}
 
-	// RpcHandler 实现 RpcHandler 的接口，如果不需要请导入 internal.BasicRpcHandler
-	RpcHandler
+	bs, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	return conf.LoadFromJsonBytes(bs, v)
 }
 
 // PluginManager 插件管理，在网关启动时接入插件
@@ -35,12 +80,28 @@ type PluginManager struct {
 
 	// pluginRoutes 路由到插件名称的映射
 	pluginRoutes map[string][]Plugin
+
+	// order 插件的注册顺序，inited、started 记录已经 Init 和 Start 的插件
+	order   []string
+	inited  map[string]bool
+	started map[string]bool
 }
 
 func NewPluginManager() *PluginManager {
 	return &PluginManager{
 		plugins:      make(map[string]Plugin),
 		pluginRoutes: map[string][]Plugin{},
+		inited:       make(map[string]bool),
+		started:      make(map[string]bool),
+	}
+}
+
+// fork 复制插件管理，共用已注册的插件，路由映射重新加载
+// 配置热更新时每份路由快照使用各自的插件管理
+func (pm *PluginManager) fork() *PluginManager {
+	return &PluginManager{
+		plugins:      pm.plugins,
+		pluginRoutes: map[string][]Plugin{},
 	}
 }
 
@@ -62,9 +123,86 @@ func (pm *PluginManager) Register(p Plugin) {
 		logx.Must(errors.New("插件名称为空"))
 	} else if _, has := pm.plugins[p.Name()]; has {
 		logx.Must(errors.New("已存在同名插件"))
+	} else if _, ok := contextPlugin(p); !ok {
+		logx.Must(fmt.Errorf("插件 %s 未实现 RpcHandler 或 ContextRpcHandler", p.Name()))
 	}
 
 	pm.plugins[p.Name()] = p
+	pm.order = append(pm.order, p.Name())
+}
+
+// loadPlugins 创建配置中用到但未注册的插件，返回本次创建的插件名称，找不到的插件名称一起返回
+// 只在启动和配置热更新时调用，由 reloadLock 保证不会并发
+// 插件都创建成功后才注册，任一失败时已创建的插件不会留在插件管理中
+func (s *Server) loadPlugins(c *GatewayConf) ([]string, error) {
+	var (
+		unknown []string
+		names   []string
+		created = make(map[string]Plugin)
+	)
+	for _, name := range pluginNames(c) {
+		if _, ok := s.plugin.plugins[name]; ok {
+			continue
+		}
+
+		factory, ok := s.factories[name]
+		if !ok {
+			unknown = append(unknown, name)
+			continue
+		}
+
+		pl, err := factory(c)
+		if err != nil {
+			return nil, fmt.Errorf("创建插件 %s 失败：%w", name, err)
+		}
+		if _, ok := contextPlugin(pl); !ok {
+			return nil, fmt.Errorf("插件 %s 未实现 RpcHandler 或 ContextRpcHandler", name)
+		}
+		created[name] = pl
+		names = append(names, name)
+	}
+
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("找不到插件：%s", strings.Join(unknown, ", "))
+	}
+
+	for _, name := range names {
+		s.plugin.plugins[name] = created[name]
+		s.plugin.order = append(s.plugin.order, name)
+	}
+
+	return names, nil
+}
+
+// pluginNames 配置中用到的插件名称，已排序去重，路由和上游都未配置插件时包括默认插件
+func pluginNames(c *GatewayConf) []string {
+	set := make(map[string]struct{})
+	add := func(names []string, confs []PluginConf) bool {
+		for _, name := range names {
+			set[name] = struct{}{}
+		}
+		for _, pc := range confs {
+			set[pc.Name] = struct{}{}
+		}
+		return len(names) > 0 || len(confs) > 0
+	}
+
+	for _, up := range c.Upstreams {
+		upHas := add(up.Plugins, up.PluginConfs)
+		for _, m := range up.Mappings {
+			if !add(m.Plugins, m.PluginConfs) && !upHas {
+				add(pluginDefault, nil)
+			}
+		}
+	}
+
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
 }
 
 // RouteKey 唯一确定一个路由
@@ -74,69 +212,182 @@ func (pm *PluginManager) RouteKey(method, httpPath string) string {
 	return strings.ToUpper(method) + httpPath
 }
 
-// LoadRouteMapping 加载路由并记录插件
-func (pm *PluginManager) LoadRouteMapping(up *Upstream, rm *RouteMapping) {
+// LoadRouteMapping 加载路由并记录插件，插件按阶段和优先级排序并检查依赖
+// rm.Path 支持 /users/:id、/users/{id} 以及 /v1/{name=shelves/*} 形式的路径模板
+func (pm *PluginManager) LoadRouteMapping(up *Upstream, rm *RouteMapping) error {
 	// 如果设置了插件，则用插件
-	plugins := rm.Plugins
+	plugins, err := pluginConfs(rm.Plugins, rm.PluginConfs)
+	if err != nil {
+		return err
+	}
 
-	// 如果未设置插件，则用默认插件
-	if len(rm.Plugins) == 0 && len(up.Plugins) == 0 {
+	// 如果未设置插件，则用全局插件，都未设置则用默认插件
+	if len(plugins) == 0 {
+		if plugins, err = pluginConfs(up.Plugins, up.PluginConfs); err != nil {
+			return err
+		}
+	}
+	if len(plugins) == 0 {
 		//默认插件 PluginJzAuth
-		plugins = pluginDefault
-	} else if len(rm.Plugins) == 0 {
-		plugins = up.Plugins
+		plugins, _ = pluginConfs(pluginDefault, nil)
+	}
+
+	tpl, err := internal.ParsePathTemplate(rm.Path)
+	if err != nil {
+		return err
+	}
+
+	method := strings.ToUpper(rm.Method)
+	k := pm.RouteKey(method, tpl.RoutePath)
+	chain := make([]chainPlugin, 0, len(plugins))
+	for _, pc := range plugins {
+		// 热更新时不能因为配置错误退出进程，所以这里不用 MustGetPlugin
+		pl, ok := pm.plugins[pc.Name]
+		if !ok {
+			return fmt.Errorf("找不到插件：%s", pc.Name)
+		}
+
+		if rp, ok := pl.(RoutePlugin); ok {
+			if pl, err = rp.ForRoute(method, tpl.RoutePath, pc.Args); err != nil {
+				return fmt.Errorf("插件 %s 参数错误，%s %s: %w", pc.Name, method, rm.Path, err)
+			}
+		} else if len(pc.Args) > 0 {
+			return fmt.Errorf("插件 %s 不支持参数", pc.Name)
+		}
+		wrapped, ok := contextPlugin(pl)
+		if !ok {
+			return fmt.Errorf("插件 %s 未实现 RpcHandler 或 ContextRpcHandler，%s %s", pc.Name, method, rm.Path)
+		}
+		if pc.When != nil {
+			if wrapped, err = newWhenPlugin(wrapped, pc.When); err != nil {
+				return fmt.Errorf("插件 %s 条件错误，%s %s: %w", pc.Name, method, rm.Path, err)
+			}
+		}
+		chain = append(chain, chainPlugin{name: pc.Name, pl: pl, wrapped: wrapped, when: pc.When})
 	}
 
-	k := pm.RouteKey(rm.Method, rm.Path)
-	if strings.Contains(rm.Path, ":") {
-		logx.Must(errors.New(fmt.Sprintf("路由配置有误，不允许在uri配置变量参数 ： %s ", rm.Path)))
+	// 按阶段和优先级排序，而不是配置的顺序
+	if err := sortChain(chain, rm); err != nil {
+		return fmt.Errorf("%s %s: %w", method, rm.Path, err)
 	}
-	for _, name := range plugins {
-		pl := pm.MustGetPlugin(name)
-		pm.pluginRoutes[k] = append(pm.pluginRoutes[k], pl)
+	for _, cp := range chain {
+		pm.pluginRoutes[k] = append(pm.pluginRoutes[k], cp.wrapped)
 	}
+
+	return nil
+}
+
+// CheckRouteOutput 检查路由上的插件能否用于路由的输出方式
+func (pm *PluginManager) CheckRouteOutput(method, httpPath string, out RouteOutput) error {
+	for _, pl := range pm.pluginRoutes[pm.RouteKey(method, httpPath)] {
+		c, ok := unwrapPlugin(pl).(RouteOutputChecker)
+		if !ok {
+			continue
+		}
+		if err := c.CheckOutput(out); err != nil {
+			return fmt.Errorf("插件 %s 不能用于 %s %s: %w", pl.Name(), strings.ToUpper(method), httpPath, err)
+		}
+	}
+
+	return nil
+}
+
+// unwrapPlugin 返回 When 和 RpcHandler 包装前的插件
+func unwrapPlugin(pl Plugin) Plugin {
+	for {
+		switch p := pl.(type) {
+		case *whenPlugin:
+			pl = p.Plugin
+		case whenMessagePlugin:
+			pl = p.Plugin
+		case *rpcPlugin:
+			pl = p.Plugin
+		case rpcMessagePlugin:
+			pl = p.Plugin
+		default:
+			return pl
+		}
+	}
+}
+
+// pluginConfs 合并插件名称和带参数的插件配置，两者不能同时配置
+func pluginConfs(names []string, confs []PluginConf) ([]PluginConf, error) {
+	if len(names) > 0 && len(confs) > 0 {
+		return nil, errors.New("Plugins 和 PluginConfs 不能同时配置")
+	}
+	if len(confs) > 0 {
+		return confs, nil
+	}
+
+	ret := make([]PluginConf, 0, len(names))
+	for _, name := range names {
+		ret = append(ret, PluginConf{Name: name})
+	}
+
+	return ret, nil
 }
 
 // WrapMiddleware 注入中间件
+// 最外层的中间件会记录命中的路由模板，供插件通过 RoutePath 获取，并为请求创建 PluginContext，判断 When 条件
+// 插件在中间件中中止请求后，之后的插件中间件不再调用
 func (pm *PluginManager) WrapMiddleware(r *rest.Route) rest.Route {
 	var (
 		plgs = pm.pluginRoutes[pm.RouteKey(r.Method, r.Path)]
-		mws  = make([]rest.Middleware, 0, len(plgs))
+		mws  = make([]rest.Middleware, 0, len(plgs)+2)
 	)
 
+	mws = append(mws, routePathMiddleware(r.Path), pluginContextMiddleware)
+	if mw := whenMiddleware(plgs); mw != nil {
+		mws = append(mws, mw)
+	}
+
 	for _, plg := range plgs {
 		mw := plg.Middleware()
 		if nil == mw {
 			continue
 		}
 
-		mws = append(mws, mw)
+		mws = append(mws, abortMiddleware(mw))
 	}
 
-	rs := rest.WithMiddlewares(mws, *r)
-	if len(rs) == 0 {
-		return *r
+	return rest.WithMiddlewares(mws, *r)[0]
+}
+
+// abortMiddleware 请求已被中止时跳过插件的中间件，交给网关输出错误
+func abortMiddleware(mw rest.Middleware) rest.Middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		h := mw(next)
+		return func(w http.ResponseWriter, r *http.Request) {
+			if PluginContextFromRequest(r).Err() != nil {
+				next(w, r)
+				return
+			}
+			h(w, r)
+		}
 	}
-	return rs[0]
 }
 
 // GetRpcHandler 设置 RPC 处理插件
-func (pm *PluginManager) GetRpcHandler(w http.ResponseWriter, r *http.Request, resolver jsonpb.AnyResolver, origName bool) *GrpcChainHandler {
-	plgs := pm.pluginRoutes[pm.RouteKey(r.Method, r.URL.Path)]
-	handlers := make([]RpcHandler, len(plgs))
+// stream 为路由配置的流式输出方式，仅对服务端流式方法生效，为空时按 Accept 头选择
+func (pm *PluginManager) GetRpcHandler(w http.ResponseWriter, r *http.Request, resolver jsonpb.AnyResolver, origName bool, stream string) *GrpcChainHandler {
+	plgs := pm.pluginRoutes[pm.RouteKey(r.Method, RoutePath(r))]
+	handlers := make([]ContextRpcHandler, len(plgs))
 
+	// 路由上的插件加载时已经包装为 ContextRpcHandler
 	for i, pl := range plgs {
-		handlers[i] = pl
+		handlers[i], _ = pl.(ContextRpcHandler)
 	}
 
 	return &GrpcChainHandler{
 		writer:  w,
 		request: r,
+		pc:      PluginContextFromRequest(r),
 		marshaler: jsonpb.Marshaler{
 			OrigName:     origName,
 			EmitDefaults: true,
 			AnyResolver:  resolver,
 		},
-		chains: handlers,
+		chains:     handlers,
+		streamMode: streamMode(r, stream),
 	}
 }
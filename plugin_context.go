@@ -0,0 +1,215 @@
+package gateway
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/jhump/protoreflect/desc"
+	"google.golang.org/grpc/metadata"
+)
+
+type pluginContextKey struct{}
+
+// PluginContext 一次请求内插件共享的状态
+// 网关路由的每个请求都有一个 PluginContext，插件在 Middleware 中通过 PluginContextFromRequest 获取，
+// 在 ContextRpcHandler 的各个方法中作为第一个参数传入；插件对象本身仍然不应该保存请求的状态
+type PluginContext struct {
+	lock   sync.RWMutex
+	values map[string]interface{}
+	// md 发送给 rpc 的 metadata，在 OnSendHeaders 之前合并到请求的 metadata 中
+	md metadata.MD
+	// err 中止请求的错误，cancel 取消进行中的 rpc 调用
+	err    error
+	cancel context.CancelFunc
+	// method 调用的 rpc 方法，解析到方法之前为 nil
+	method *desc.MethodDescriptor
+	// formatted 路由配置了 Formatter
+	formatted bool
+	// skips When 条件不满足，本次请求跳过的插件
+	skips map[*whenPlugin]struct{}
+}
+
+func NewPluginContext() *PluginContext {
+	return &PluginContext{
+		values: make(map[string]interface{}),
+		md:     metadata.MD{},
+	}
+}
+
+// PluginContextFromRequest 获取请求的 PluginContext
+// 请求不是由网关路由处理时返回一个新的 PluginContext，写入的值不会被后续的处理看到
+func PluginContextFromRequest(r *http.Request) *PluginContext {
+	return PluginContextFromContext(r.Context())
+}
+
+// PluginContextFromContext 获取 ctx 中的 PluginContext，没有时返回一个新的 PluginContext
+func PluginContextFromContext(ctx context.Context) *PluginContext {
+	if pc, ok := ctx.Value(pluginContextKey{}).(*PluginContext); ok {
+		return pc
+	}
+
+	return NewPluginContext()
+}
+
+// ContextWithPluginContext 返回带有 pc 的 ctx，用于在网关路由之外调用插件，如插件的单元测试
+func ContextWithPluginContext(ctx context.Context, pc *PluginContext) context.Context {
+	return context.WithValue(ctx, pluginContextKey{}, pc)
+}
+
+// Set 保存一个值
+func (pc *PluginContext) Set(key string, val interface{}) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+
+	pc.values[key] = val
+}
+
+// Get 获取一个值
+func (pc *PluginContext) Get(key string) (interface{}, bool) {
+	pc.lock.RLock()
+	defer pc.lock.RUnlock()
+
+	val, ok := pc.values[key]
+	return val, ok
+}
+
+// GetString 获取一个字符串值，不存在或不是字符串时返回空串
+func (pc *PluginContext) GetString(key string) string {
+	val, _ := pc.Get(key)
+	s, _ := val.(string)
+	return s
+}
+
+// SetMetadata 设置发送给 rpc 的 metadata，替换已有的值
+func (pc *PluginContext) SetMetadata(key string, vals ...string) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+
+	pc.md.Set(key, vals...)
+}
+
+// AppendMetadata 追加发送给 rpc 的 metadata
+func (pc *PluginContext) AppendMetadata(key string, vals ...string) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+
+	pc.md.Append(key, vals...)
+}
+
+// MetadataValue 获取发送给 rpc 的 metadata 的第一个值，没有时返回空串
+func (pc *PluginContext) MetadataValue(key string) string {
+	pc.lock.RLock()
+	defer pc.lock.RUnlock()
+
+	if vals := pc.md.Get(key); len(vals) > 0 {
+		return vals[0]
+	}
+
+	return ""
+}
+
+// Metadata 发送给 rpc 的 metadata 的副本
+func (pc *PluginContext) Metadata() metadata.MD {
+	pc.lock.RLock()
+	defer pc.lock.RUnlock()
+
+	return pc.md.Copy()
+}
+
+// Method 本次请求调用的 rpc 方法，在 OnResolveMethod 之前为 nil
+func (pc *PluginContext) Method() *desc.MethodDescriptor {
+	pc.lock.RLock()
+	defer pc.lock.RUnlock()
+
+	return pc.method
+}
+
+func (pc *PluginContext) setMethod(method *desc.MethodDescriptor) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+
+	pc.method = method
+}
+
+// Formatted 路由是否配置了 Formatter，配置时 OnReceiveResponse 返回的响应交给 ResponseFormatter 输出，
+// 插件不需要再包装 {code,msg,data}，也不应该写入状态码
+func (pc *PluginContext) Formatted() bool {
+	pc.lock.RLock()
+	defer pc.lock.RUnlock()
+
+	return pc.formatted
+}
+
+func (pc *PluginContext) setFormatted(formatted bool) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+
+	pc.formatted = formatted
+}
+
+// Abort 中止请求，之后的插件方法不再调用，已收到的响应不再输出，err 按 Errors 和 Formatter 配置输出
+// 可以在 Middleware 和 ContextRpcHandler 的任意方法中调用，err 一般为 *Error，只保留第一次的错误
+func (pc *PluginContext) Abort(err error) {
+	if err == nil {
+		return
+	}
+
+	pc.lock.Lock()
+	if pc.err != nil {
+		pc.lock.Unlock()
+		return
+	}
+	pc.err = err
+	cancel := pc.cancel
+	pc.lock.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// Err 中止请求的错误，未中止时返回 nil
+func (pc *PluginContext) Err() error {
+	pc.lock.RLock()
+	defer pc.lock.RUnlock()
+
+	return pc.err
+}
+
+// withCancel 返回中止请求时会被取消的 ctx
+func (pc *PluginContext) withCancel(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	pc.lock.Lock()
+	pc.cancel = cancel
+	pc.lock.Unlock()
+
+	return ctx, cancel
+}
+
+func (pc *PluginContext) skip(p *whenPlugin) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+
+	if pc.skips == nil {
+		pc.skips = make(map[*whenPlugin]struct{})
+	}
+	pc.skips[p] = struct{}{}
+}
+
+func (pc *PluginContext) skipped(p *whenPlugin) bool {
+	pc.lock.RLock()
+	defer pc.lock.RUnlock()
+
+	_, ok := pc.skips[p]
+	return ok
+}
+
+// pluginContextMiddleware 为请求创建 PluginContext
+func pluginContextMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := ContextWithPluginContext(r.Context(), NewPluginContext())
+		next(w, r.WithContext(ctx))
+	}
+}
@@ -0,0 +1,93 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestPluginContextValues(t *testing.T) {
+	pc := NewPluginContext()
+	pc.Set("uid", "7")
+	pc.Set("count", 3)
+
+	val, ok := pc.Get("count")
+	assert.True(t, ok)
+	assert.Equal(t, 3, val)
+	assert.Equal(t, "7", pc.GetString("uid"))
+	// 不存在或不是字符串时为空串
+	assert.Equal(t, "", pc.GetString("count"))
+	_, ok = pc.Get("missing")
+	assert.False(t, ok)
+	assert.Equal(t, "", pc.GetString("missing"))
+}
+
+func TestPluginContextMetadata(t *testing.T) {
+	pc := NewPluginContext()
+	assert.Equal(t, "", pc.MetadataValue("x-uid"))
+
+	pc.SetMetadata("X-Uid", "7")
+	pc.AppendMetadata("x-role", "a")
+	pc.AppendMetadata("x-role", "b", "c")
+	assert.Equal(t, "7", pc.MetadataValue("x-uid"))
+	assert.Equal(t, "a", pc.MetadataValue("x-role"))
+	assert.Equal(t, metadata.MD{"x-uid": {"7"}, "x-role": {"a", "b", "c"}}, pc.Metadata())
+
+	// SetMetadata 替换已有的值
+	pc.SetMetadata("x-role", "d")
+	assert.Equal(t, []string{"d"}, pc.Metadata().Get("x-role"))
+
+	// Metadata 返回副本
+	md := pc.Metadata()
+	md.Set("x-uid", "8")
+	assert.Equal(t, "7", pc.MetadataValue("x-uid"))
+}
+
+func TestPluginContextAbort(t *testing.T) {
+	pc := NewPluginContext()
+	pc.Abort(nil)
+	assert.NoError(t, pc.Err())
+
+	ctx, cancel := pc.withCancel(context.Background())
+	defer cancel()
+
+	first := errors.New("first")
+	pc.Abort(first)
+	// 中止时取消进行中的 rpc 调用
+	assert.ErrorIs(t, ctx.Err(), context.Canceled)
+	// 只保留第一次的错误
+	pc.Abort(errors.New("second"))
+	assert.Same(t, first, pc.Err())
+}
+
+func TestPluginContextSkip(t *testing.T) {
+	pc := NewPluginContext()
+	a, b := &whenPlugin{Plugin: plain("a")}, &whenPlugin{Plugin: plain("b")}
+	assert.False(t, pc.skipped(a))
+
+	pc.skip(a)
+	assert.True(t, pc.skipped(a))
+	assert.False(t, pc.skipped(b))
+}
+
+func TestPluginContextFromRequest(t *testing.T) {
+	// 不经过网关路由的请求每次得到新的 PluginContext
+	r := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
+	assert.NotSame(t, PluginContextFromRequest(r), PluginContextFromRequest(r))
+
+	pc := NewPluginContext()
+	r = r.WithContext(ContextWithPluginContext(r.Context(), pc))
+	assert.Same(t, pc, PluginContextFromRequest(r))
+
+	var got *PluginContext
+	pluginContextMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		got = PluginContextFromRequest(r)
+	})(httptest.NewRecorder(), r)
+	assert.NotNil(t, got)
+	assert.NotSame(t, pc, got)
+}
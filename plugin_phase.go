@@ -0,0 +1,118 @@
+package gateway
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// PluginPhase 插件执行的阶段，路由上的插件先按阶段、再按优先级排序，中间件和 RpcHandler 都按这个顺序调用
+type PluginPhase int
+
+const (
+	// PhaseAuth 鉴权，如 jzAuth
+	PhaseAuth PluginPhase = iota + 1
+	// PhaseDispatch 分流，如 uriDispatch
+	PhaseDispatch
+	// PhaseTransform 改写请求和响应，未声明阶段的插件属于这个阶段
+	PhaseTransform
+	// PhaseObserve 日志、指标等只观察请求的插件
+	PhaseObserve
+)
+
+var phaseNames = map[PluginPhase]string{
+	PhaseAuth:      "auth",
+	PhaseDispatch:  "dispatch",
+	PhaseTransform: "transform",
+	PhaseObserve:   "observe",
+}
+
+func (p PluginPhase) String() string {
+	if name, ok := phaseNames[p]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("phase(%d)", int(p))
+}
+
+type (
+	// PluginPhaser 可选接口，声明插件的阶段，未实现时为 PhaseTransform
+	PluginPhaser interface {
+		Phase() PluginPhase
+	}
+
+	// PluginPrioritizer 可选接口，声明插件在阶段内的优先级，大的先执行，未实现时为 0，相同时按配置顺序
+	PluginPrioritizer interface {
+		Priority() int
+	}
+
+	// PluginRequirer 可选接口，声明插件在路由上依赖的插件，依赖的插件必须配置在同一路由上并先于它执行
+	// 构造路由时检查，不满足时加载失败
+	PluginRequirer interface {
+		Requires(rm *RouteMapping) []string
+	}
+)
+
+// chainPlugin 路由上的一个插件，pl 为 ForRoute 返回的插件，wrapped 为按 When 包装后的插件，when 为插件配置的 When
+type chainPlugin struct {
+	name    string
+	pl      Plugin
+	wrapped Plugin
+	when    *PluginWhen
+}
+
+func pluginPhase(pl Plugin) PluginPhase {
+	if p, ok := pl.(PluginPhaser); ok {
+		return p.Phase()
+	}
+
+	return PhaseTransform
+}
+
+func pluginPriority(pl Plugin) int {
+	if p, ok := pl.(PluginPrioritizer); ok {
+		return p.Priority()
+	}
+
+	return 0
+}
+
+// sortChain 按阶段和优先级排序，并检查插件的依赖
+// 依赖的插件配置了 When 时，依赖它的插件需要配置相同的 When，否则条件不满足的请求缺少依赖插件的处理
+func sortChain(chain []chainPlugin, rm *RouteMapping) error {
+	sort.SliceStable(chain, func(i, j int) bool {
+		pi, pj := pluginPhase(chain[i].pl), pluginPhase(chain[j].pl)
+		if pi != pj {
+			return pi < pj
+		}
+
+		return pluginPriority(chain[i].pl) > pluginPriority(chain[j].pl)
+	})
+
+	index := make(map[string]int, len(chain))
+	for i, cp := range chain {
+		index[cp.name] = i
+	}
+	for i, cp := range chain {
+		r, ok := cp.pl.(PluginRequirer)
+		if !ok {
+			continue
+		}
+
+		for _, dep := range r.Requires(rm) {
+			j, ok := index[dep]
+			if !ok {
+				return fmt.Errorf("插件 %s 依赖插件 %s，路由未配置", cp.name, dep)
+			}
+			if j > i {
+				return fmt.Errorf("插件 %s 依赖插件 %s，但 %s 排在它之后，阶段为 %s，优先级为 %d",
+					cp.name, dep, dep, pluginPhase(chain[j].pl), pluginPriority(chain[j].pl))
+			}
+			if chain[j].when != nil && !reflect.DeepEqual(chain[j].when, cp.when) {
+				return fmt.Errorf("插件 %s 依赖插件 %s，但 %s 配置了 when，%s 需要配置相同的 when", cp.name, dep, dep, cp.name)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,192 @@
+package gateway
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zeromicro/go-zero/rest"
+)
+
+// plainPlugin 未声明阶段、优先级和依赖的插件
+type plainPlugin struct {
+	BasicContextRpcHandler
+	name string
+}
+
+func (p *plainPlugin) Name() string { return p.name }
+
+func (p *plainPlugin) Middleware() rest.Middleware { return nil }
+
+// phasedPlugin 声明了阶段、优先级和依赖的插件
+type phasedPlugin struct {
+	plainPlugin
+	phase    PluginPhase
+	priority int
+	requires []string
+}
+
+func (p *phasedPlugin) Phase() PluginPhase { return p.phase }
+
+func (p *phasedPlugin) Priority() int { return p.priority }
+
+func (p *phasedPlugin) Requires(*RouteMapping) []string { return p.requires }
+
+func testChain(plugins ...Plugin) []chainPlugin {
+	chain := make([]chainPlugin, len(plugins))
+	for i, pl := range plugins {
+		chain[i] = chainPlugin{name: pl.Name(), pl: pl, wrapped: pl}
+	}
+
+	return chain
+}
+
+// withWhen 按顺序设置插件的 When
+func withWhen(chain []chainPlugin, whens ...*PluginWhen) []chainPlugin {
+	for i, when := range whens {
+		chain[i].when = when
+	}
+
+	return chain
+}
+
+func phased(name string, phase PluginPhase, priority int, requires ...string) Plugin {
+	return &phasedPlugin{
+		plainPlugin: plainPlugin{name: name},
+		phase:       phase,
+		priority:    priority,
+		requires:    requires,
+	}
+}
+
+func plain(name string) Plugin {
+	return &plainPlugin{name: name}
+}
+
+func TestSortChain(t *testing.T) {
+	tests := []struct {
+		name    string
+		chain   []chainPlugin
+		expect  []string
+		wantErr string
+	}{
+		{
+			name:   "empty",
+			expect: []string{},
+		},
+		{
+			name: "phase",
+			chain: testChain(
+				phased("log", PhaseObserve, 0),
+				phased("dispatch", PhaseDispatch, 0),
+				plain("transform"),
+				phased("auth", PhaseAuth, 0),
+			),
+			expect: []string{"auth", "dispatch", "transform", "log"},
+		},
+		{
+			name: "priority",
+			chain: testChain(
+				phased("low", PhaseAuth, -100),
+				phased("high", PhaseAuth, 100),
+				phased("default", PhaseAuth, 0),
+			),
+			expect: []string{"high", "default", "low"},
+		},
+		{
+			name: "stable ties",
+			chain: testChain(
+				plain("c"),
+				phased("a", PhaseTransform, 0),
+				plain("b"),
+				phased("auth", PhaseAuth, 0),
+			),
+			expect: []string{"auth", "c", "a", "b"},
+		},
+		{
+			name: "requires satisfied",
+			chain: testChain(
+				phased("rateLimit", PhaseAuth, -100, "jzAuth"),
+				phased("jzAuth", PhaseAuth, 0),
+			),
+			expect: []string{"jzAuth", "rateLimit"},
+		},
+		{
+			name: "missing prerequisite",
+			chain: testChain(
+				phased("uriDispatch", PhaseDispatch, 0, "jzAuth"),
+			),
+			wantErr: "插件 uriDispatch 依赖插件 jzAuth，路由未配置",
+		},
+		{
+			name: "misordered prerequisite",
+			chain: testChain(
+				phased("jzAuth", PhaseObserve, 0),
+				phased("uriDispatch", PhaseDispatch, 0, "jzAuth"),
+			),
+			wantErr: "插件 uriDispatch 依赖插件 jzAuth，但 jzAuth 排在它之后，阶段为 observe，优先级为 0",
+		},
+		{
+			name: "requires same when",
+			chain: withWhen(testChain(
+				phased("rateLimit", PhaseAuth, -100, "jzAuth"),
+				phased("jzAuth", PhaseAuth, 0),
+			), &PluginWhen{Headers: []string{"X-App"}}, &PluginWhen{Headers: []string{"X-App"}}),
+			expect: []string{"jzAuth", "rateLimit"},
+		},
+		{
+			name: "requires without when",
+			chain: withWhen(testChain(
+				phased("rateLimit", PhaseAuth, -100, "jzAuth"),
+				phased("jzAuth", PhaseAuth, 0),
+			), &PluginWhen{Headers: []string{"X-App"}}, nil),
+			expect: []string{"jzAuth", "rateLimit"},
+		},
+		{
+			name: "requires when not shared",
+			chain: withWhen(testChain(
+				phased("rateLimit", PhaseAuth, -100, "jzAuth"),
+				phased("jzAuth", PhaseAuth, 0),
+			), nil, &PluginWhen{Headers: []string{"X-App"}}),
+			wantErr: "插件 rateLimit 依赖插件 jzAuth，但 jzAuth 配置了 when，rateLimit 需要配置相同的 when",
+		},
+		{
+			name: "requires different when",
+			chain: withWhen(testChain(
+				phased("rateLimit", PhaseAuth, -100, "jzAuth"),
+				phased("jzAuth", PhaseAuth, 0),
+			), &PluginWhen{Headers: []string{"X-Web"}}, &PluginWhen{Headers: []string{"X-App"}}),
+			wantErr: "插件 rateLimit 依赖插件 jzAuth，但 jzAuth 配置了 when，rateLimit 需要配置相同的 when",
+		},
+		{
+			name: "misordered by priority",
+			chain: testChain(
+				phased("first", PhaseAuth, 10, "second"),
+				phased("second", PhaseAuth, 0),
+			),
+			wantErr: "插件 first 依赖插件 second，但 second 排在它之后，阶段为 auth，优先级为 0",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := sortChain(test.chain, &RouteMapping{})
+			if len(test.wantErr) > 0 {
+				assert.EqualError(t, err, test.wantErr)
+				return
+			}
+
+			assert.NoError(t, err)
+			names := make([]string, 0, len(test.chain))
+			for _, cp := range test.chain {
+				names = append(names, cp.name)
+			}
+			assert.Equal(t, test.expect, names)
+		})
+	}
+}
+
+func TestPluginPhaseString(t *testing.T) {
+	assert.Equal(t, "auth", PhaseAuth.String())
+	assert.Equal(t, "observe", PhaseObserve.String())
+	assert.Equal(t, "phase(9)", PluginPhase(9).String())
+}
@@ -0,0 +1,241 @@
+package gateway
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// argsPlugin 按路由参数创建插件
+type argsPlugin struct {
+	plainPlugin
+	method, path string
+	args         argsPluginArgs
+}
+
+type argsPluginArgs struct {
+	Rate int    `json:",default=10"`
+	Key  string `json:",optional,options=ip|uid"`
+	Bare bool   `json:",optional"`
+	Fail bool   `json:",optional"`
+}
+
+func (p *argsPlugin) ForRoute(method, path string, args PluginArgs) (Plugin, error) {
+	var a argsPluginArgs
+	if err := args.Unmarshal(&a); err != nil {
+		return nil, err
+	}
+	if a.Fail {
+		return nil, errors.New("fail")
+	}
+	if a.Bare {
+		return &barePlugin{name: p.name}, nil
+	}
+
+	cp := *p
+	cp.method, cp.path, cp.args = method, path, a
+	return &cp, nil
+}
+
+func TestPluginArgsUnmarshal(t *testing.T) {
+	var a argsPluginArgs
+	assert.NoError(t, PluginArgs(nil).Unmarshal(&a))
+	assert.Equal(t, argsPluginArgs{Rate: 10}, a)
+
+	// key 不区分大小写
+	a = argsPluginArgs{}
+	assert.NoError(t, PluginArgs{"RATE": 3, "key": "uid"}.Unmarshal(&a))
+	assert.Equal(t, argsPluginArgs{Rate: 3, Key: "uid"}, a)
+
+	assert.Error(t, PluginArgs{"key": "channel"}.Unmarshal(&a))
+	assert.Error(t, PluginArgs{"rate": "fast"}.Unmarshal(&a))
+
+	var required struct {
+		Name string
+	}
+	assert.Error(t, PluginArgs{}.Unmarshal(&required))
+}
+
+func newTestPluginManager(plugins ...Plugin) *PluginManager {
+	pm := NewPluginManager()
+	for _, pl := range plugins {
+		pm.Register(pl)
+	}
+
+	return pm
+}
+
+func TestLoadRouteMapping(t *testing.T) {
+	pm := newTestPluginManager(&argsPlugin{plainPlugin: plainPlugin{name: "args"}}, plain("up"), plain("empty"))
+	up := &Upstream{Plugins: []string{"up"}}
+
+	// 路由上的参数按路由创建插件，路径模板转为路由的路径
+	assert.NoError(t, pm.LoadRouteMapping(up, &RouteMapping{
+		Method:      "post",
+		Path:        "/users/{id}",
+		PluginConfs: []PluginConf{{Name: "args", Args: PluginArgs{"rate": 5}}},
+	}))
+	plgs := pm.pluginRoutes[pm.RouteKey(http.MethodPost, "/users/:id")]
+	if assert.Len(t, plgs, 1) {
+		pl := plgs[0].(*argsPlugin)
+		assert.Equal(t, http.MethodPost, pl.method)
+		assert.Equal(t, "/users/:id", pl.path)
+		assert.Equal(t, argsPluginArgs{Rate: 5}, pl.args)
+	}
+
+	// 路由未配置插件时使用上游的插件，都未配置时使用默认插件
+	assert.NoError(t, pm.LoadRouteMapping(up, &RouteMapping{Method: http.MethodGet, Path: "/up"}))
+	assert.Equal(t, []Plugin{pm.plugins["up"]}, pm.pluginRoutes[pm.RouteKey(http.MethodGet, "/up")])
+	assert.NoError(t, pm.LoadRouteMapping(&Upstream{}, &RouteMapping{Method: http.MethodGet, Path: "/default"}))
+	assert.Equal(t, []Plugin{pm.plugins["empty"]}, pm.pluginRoutes[pm.RouteKey(http.MethodGet, "/default")])
+}
+
+func TestLoadRouteMappingErrors(t *testing.T) {
+	pm := newTestPluginManager(&argsPlugin{plainPlugin: plainPlugin{name: "args"}}, plain("plain"),
+		phased("dep", PhaseTransform, 0, "auth"), phased("auth", PhaseAuth, 0))
+
+	tests := []struct {
+		name   string
+		up     Upstream
+		rm     RouteMapping
+		expect string
+	}{
+		{
+			name:   "plugins and confs",
+			rm:     RouteMapping{Plugins: []string{"plain"}, PluginConfs: []PluginConf{{Name: "plain"}}},
+			expect: "Plugins 和 PluginConfs 不能同时配置",
+		},
+		{
+			name:   "upstream plugins and confs",
+			up:     Upstream{Plugins: []string{"plain"}, PluginConfs: []PluginConf{{Name: "plain"}}},
+			expect: "Plugins 和 PluginConfs 不能同时配置",
+		},
+		{
+			name:   "unknown plugin",
+			rm:     RouteMapping{Plugins: []string{"unknown"}},
+			expect: "找不到插件：unknown",
+		},
+		{
+			name:   "args not supported",
+			rm:     RouteMapping{PluginConfs: []PluginConf{{Name: "plain", Args: PluginArgs{"rate": 1}}}},
+			expect: "插件 plain 不支持参数",
+		},
+		{
+			name:   "invalid args",
+			rm:     RouteMapping{PluginConfs: []PluginConf{{Name: "args", Args: PluginArgs{"key": "channel"}}}},
+			expect: "插件 args 参数错误，GET /users/:id",
+		},
+		{
+			name:   "for route failed",
+			rm:     RouteMapping{PluginConfs: []PluginConf{{Name: "args", Args: PluginArgs{"fail": true}}}},
+			expect: "插件 args 参数错误，GET /users/:id: fail",
+		},
+		{
+			name:   "no rpc handler",
+			rm:     RouteMapping{PluginConfs: []PluginConf{{Name: "args", Args: PluginArgs{"bare": true}}}},
+			expect: "插件 args 未实现 RpcHandler 或 ContextRpcHandler",
+		},
+		{
+			name:   "invalid when",
+			rm:     RouteMapping{PluginConfs: []PluginConf{{Name: "plain", When: &PluginWhen{CIDRs: []string{"10.0.0"}}}}},
+			expect: "插件 plain 条件错误，GET /users/:id",
+		},
+		{
+			name:   "missing requires",
+			rm:     RouteMapping{Plugins: []string{"dep"}},
+			expect: "GET /users/:id: 插件 dep 依赖插件 auth，路由未配置",
+		},
+		{
+			name: "requires when",
+			rm: RouteMapping{PluginConfs: []PluginConf{
+				{Name: "auth", When: &PluginWhen{Headers: []string{"X-App"}}},
+				{Name: "dep"},
+			}},
+			expect: "GET /users/:id: 插件 dep 依赖插件 auth，但 auth 配置了 when，dep 需要配置相同的 when",
+		},
+		{
+			name:   "invalid path",
+			rm:     RouteMapping{Path: "/users/{id", Plugins: []string{"plain"}},
+			expect: "",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rm := test.rm
+			rm.Method = http.MethodGet
+			if len(rm.Path) == 0 {
+				rm.Path = "/users/:id"
+			}
+
+			err := pm.LoadRouteMapping(&test.up, &rm)
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), test.expect)
+			}
+			assert.Empty(t, pm.pluginRoutes)
+		})
+	}
+}
+
+// outputPlugin 记录路由的输出方式，reject 时拒绝配置了 Formatter 的路由
+type outputPlugin struct {
+	plainPlugin
+	reject  bool
+	outputs map[string]RouteOutput
+}
+
+func (p *outputPlugin) CheckOutput(out RouteOutput) error {
+	if p.reject && out.Formatted {
+		return errors.New("formatted")
+	}
+	p.outputs[p.name] = out
+
+	return nil
+}
+
+func TestCheckRouteOutput(t *testing.T) {
+	addr, _ := newTestUpstream(t)
+	outputs := map[string]RouteOutput{}
+	when := &PluginWhen{Query: map[string]string{"debug": "*"}}
+	c := newTestConf(addr,
+		RouteMapping{
+			Method:      http.MethodGet,
+			Path:        "/health",
+			RpcPath:     testHealthCheck,
+			PluginConfs: []PluginConf{{Name: "unary", When: when}},
+		},
+		RouteMapping{
+			Method:    http.MethodGet,
+			Path:      "/health/formatted",
+			RpcPath:   testHealthCheck,
+			Formatter: FormatterRaw,
+			Plugins:   []string{"formatted"},
+		},
+		RouteMapping{
+			Method:  http.MethodGet,
+			Path:    "/health/watch",
+			RpcPath: testHealthWatch,
+			Plugins: []string{"stream"},
+		},
+	)
+	svr := newTestServer(t, c,
+		&outputPlugin{plainPlugin: plainPlugin{name: "unary"}, outputs: outputs},
+		&outputPlugin{plainPlugin: plainPlugin{name: "formatted"}, outputs: outputs},
+		&outputPlugin{plainPlugin: plainPlugin{name: "stream"}, outputs: outputs},
+		&outputPlugin{plainPlugin: plainPlugin{name: "reject"}, reject: true, outputs: outputs},
+	)
+
+	// 配置了 When 的插件检查包装前的插件
+	assert.Equal(t, map[string]RouteOutput{
+		"unary":     {},
+		"formatted": {Formatted: true},
+		"stream":    {Stream: true},
+	}, outputs)
+
+	// 检查失败时本次配置加载失败，保留当前路由
+	c.Upstreams[0].Mappings[1].Plugins = []string{"reject"}
+	assert.ErrorContains(t, svr.Reload(c), "插件 reject 不能用于 GET /health/formatted: formatted")
+	assert.Equal(t, http.StatusOK, serveServer(svr, http.MethodGet, "/health/formatted", "").Code)
+}
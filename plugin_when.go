@@ -0,0 +1,141 @@
+package gateway
+
+import (
+	"net/http"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/punpeo/pun-gateway-lib/internal"
+	"github.com/zeromicro/go-zero/rest"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// whenPlugin 配置了 When 的插件，条件不满足的请求跳过插件的中间件和 RpcHandler
+type whenPlugin struct {
+	Plugin
+	handler ContextRpcHandler
+	matcher *internal.Matcher
+}
+
+// whenMessagePlugin 实现了 MessageHandler 的 whenPlugin
+type whenMessagePlugin struct {
+	*whenPlugin
+}
+
+// newWhenPlugin 按 When 条件包装插件，pl 需要实现 ContextRpcHandler
+func newWhenPlugin(pl Plugin, when *PluginWhen) (Plugin, error) {
+	matcher, err := internal.NewMatcher(internal.MatchConf{
+		Headers:    when.Headers,
+		Query:      when.Query,
+		CIDRs:      when.CIDRs,
+		UserAgent:  when.UserAgent,
+		AppTypes:   when.AppTypes,
+		AppVersion: when.AppVersion,
+		Not:        when.Not,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	wp := &whenPlugin{Plugin: pl, handler: pl.(ContextRpcHandler), matcher: matcher}
+	if _, ok := pl.(MessageHandler); ok {
+		return whenMessagePlugin{wp}, nil
+	}
+
+	return wp, nil
+}
+
+// whenMiddleware 在插件的中间件之前判断本次请求跳过哪些插件
+func whenMiddleware(plgs []Plugin) rest.Middleware {
+	var wps []*whenPlugin
+	for _, pl := range plgs {
+		switch p := pl.(type) {
+		case *whenPlugin:
+			wps = append(wps, p)
+		case whenMessagePlugin:
+			wps = append(wps, p.whenPlugin)
+		}
+	}
+	if len(wps) == 0 {
+		return nil
+	}
+
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			pc := PluginContextFromRequest(r)
+			for _, wp := range wps {
+				if !wp.matcher.Match(r) {
+					pc.skip(wp)
+				}
+			}
+			next(w, r)
+		}
+	}
+}
+
+func (p *whenPlugin) Middleware() rest.Middleware {
+	mw := p.Plugin.Middleware()
+	if mw == nil {
+		return nil
+	}
+
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		h := mw(next)
+		return func(w http.ResponseWriter, r *http.Request) {
+			if PluginContextFromRequest(r).skipped(p) {
+				next(w, r)
+				return
+			}
+			h(w, r)
+		}
+	}
+}
+
+func (p *whenPlugin) OnReceiveResponse(pc *PluginContext, respJson string, md metadata.MD, w http.ResponseWriter) string {
+	if pc.skipped(p) {
+		return respJson
+	}
+
+	return p.handler.OnReceiveResponse(pc, respJson, md, w)
+}
+
+func (p *whenPlugin) OnReceiveTrailers(pc *PluginContext, stat *status.Status, md metadata.MD) metadata.MD {
+	if pc.skipped(p) {
+		return md
+	}
+
+	return p.handler.OnReceiveTrailers(pc, stat, md)
+}
+
+func (p *whenPlugin) OnResolveMethod(pc *PluginContext, method *desc.MethodDescriptor) {
+	if pc.skipped(p) {
+		return
+	}
+
+	p.handler.OnResolveMethod(pc, method)
+}
+
+func (p *whenPlugin) OnSendHeaders(pc *PluginContext, r *http.Request, md metadata.MD) metadata.MD {
+	if pc.skipped(p) {
+		return md
+	}
+
+	return p.handler.OnSendHeaders(pc, r, md)
+}
+
+func (p *whenPlugin) OnReceiveHeaders(pc *PluginContext, md metadata.MD) metadata.MD {
+	if pc.skipped(p) {
+		return md
+	}
+
+	return p.handler.OnReceiveHeaders(pc, md)
+}
+
+func (p whenMessagePlugin) OnReceiveMessage(pc *PluginContext, r *http.Request, method *desc.MethodDescriptor, msg *dynamic.Message) *dynamic.Message {
+	if pc.skipped(p.whenPlugin) {
+		return nil
+	}
+
+	return p.Plugin.(MessageHandler).OnReceiveMessage(pc, r, method, msg)
+}
@@ -1,7 +1,6 @@
 package plugins
 
 import (
-	"context"
 	gateway "github.com/punpeo/pun-gateway-lib"
 	"github.com/zeromicro/go-zero/rest"
 	"google.golang.org/grpc/metadata"
@@ -10,8 +9,6 @@ import (
 	"strings"
 )
 
-const customMdKey = "customMd"
-
 var customHeaders = []string{
 	"wechatpay-signature-type",
 	"wechatpay-signature",
@@ -25,6 +22,12 @@ type PluginCustom struct {
 	gateway.BasicRpcHandler
 }
 
+func init() {
+	Register("custom", func(*gateway.GatewayConf) (gateway.Plugin, error) {
+		return NewPluginCustom(), nil
+	})
+}
+
 func NewPluginCustom() *PluginCustom {
 	return &PluginCustom{}
 }
@@ -36,11 +39,11 @@ func (p *PluginCustom) Name() string {
 func (p *PluginCustom) Middleware() rest.Middleware {
 	hdl := func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ctx := r.Context()
-			moreMd := GetCustomHeader(r)
-
-			ctx = context.WithValue(ctx, customMdKey, moreMd)
-			r = r.WithContext(ctx)
+			// 微信支付回调的签名头通过 PluginContext 发送给 rpc
+			pc := gateway.PluginContextFromRequest(r)
+			for k, vals := range GetCustomHeader(r) {
+				pc.SetMetadata(k, vals...)
+			}
 			next.ServeHTTP(w, r)
 		})
 	}
@@ -48,23 +51,8 @@ func (p *PluginCustom) Middleware() rest.Middleware {
 	return rest.ToMiddleware(hdl)
 }
 
-func (p *PluginCustom) OnSendHeaders(r *http.Request, md metadata.MD) metadata.MD {
-	//提取uid加载到md
-	ctx := r.Context()
-	switch ctx.Value(customMdKey).(type) {
-	case []string:
-		if uidData, ok := ctx.Value(customMdKey).([]string); ok {
-			for _, uid := range uidData {
-				sep := strings.Split(uid, ":")
-				if len(sep) != 2 {
-					continue
-				}
-				md.Append(sep[0], sep[1])
-			}
-		}
-		return md
-	}
-	return md
+func (p *PluginCustom) CheckOutput(out gateway.RouteOutput) error {
+	return checkRawOutput(out, "按 X-Http-Status 设置状态码")
 }
 
 func (p *PluginCustom) OnReceiveResponse(respJson string, md metadata.MD, w http.ResponseWriter) string {
@@ -79,14 +67,15 @@ func (p *PluginCustom) OnReceiveResponse(respJson string, md metadata.MD, w http
 	return respJson
 }
 
-func GetCustomHeader(req *http.Request) []string {
-	var commonHeader []string
+// GetCustomHeader 提取微信支付回调的签名头，优先取请求头，其次取表单
+func GetCustomHeader(req *http.Request) metadata.MD {
+	commonHeader := metadata.MD{}
 	for _, s := range customHeaders {
 		headerKey := req.Header.Values(s)
 		if len(headerKey) > 0 {
-			commonHeader = append(commonHeader, s+":"+strings.Trim(headerKey[0], "\n"))
+			commonHeader.Set(s, strings.Trim(headerKey[0], "\n"))
 		} else {
-			commonHeader = append(commonHeader, s+":"+strings.Trim(req.FormValue(s), "\n"))
+			commonHeader.Set(s, strings.Trim(req.FormValue(s), "\n"))
 		}
 	}
 	return commonHeader
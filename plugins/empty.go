@@ -10,6 +10,12 @@ type PluginEmpty struct {
 	gateway.BasicRpcHandler
 }
 
+func init() {
+	Register("empty", func(*gateway.GatewayConf) (gateway.Plugin, error) {
+		return NewPluginEmpty(), nil
+	})
+}
+
 func NewPluginEmpty() *PluginEmpty {
 	return &PluginEmpty{}
 }
@@ -13,6 +13,12 @@ type PluginHls struct {
 	gateway.BasicRpcHandler
 }
 
+func init() {
+	Register("hls", func(*gateway.GatewayConf) (gateway.Plugin, error) {
+		return NewPluginHls(), nil
+	})
+}
+
 func NewPluginHls() *PluginHls {
 	return &PluginHls{}
 }
@@ -33,6 +39,10 @@ func (p *PluginHls) Middleware() rest.Middleware {
 	return rest.ToMiddleware(hdl)
 }
 
+func (p *PluginHls) CheckOutput(out gateway.RouteOutput) error {
+	return checkRawOutput(out, "设置 Content-Type")
+}
+
 func (p *PluginHls) OnReceiveResponse(respJson string, md metadata.MD, w http.ResponseWriter) string {
 	//设置响应头部
 	//获取metadata
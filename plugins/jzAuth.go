@@ -2,7 +2,9 @@ package plugins
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -12,22 +14,24 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	gateway "github.com/punpeo/pun-gateway-lib"
+	"github.com/punpeo/pun-gateway-lib/internal"
 
-	"context"
 	"net/http"
 
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/pkg/errors"
-	"github.com/punpeo/punpeo-lib/rest/result"
 	"github.com/punpeo/punpeo-lib/rest/xerr"
 	"github.com/punpeo/punpeo-lib/utils/jzcrypto"
 	"github.com/spf13/cast"
+	"github.com/zeromicro/go-zero/core/logx"
 	"github.com/zeromicro/go-zero/rest"
-	"github.com/zeromicro/go-zero/rest/httpx"
 	"github.com/zeromicro/go-zero/zrpc"
 
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/metadata"
 )
 
@@ -47,14 +51,37 @@ var appCommHeader = []string{
 
 // PluginJzAuth 简知校验插件
 type PluginJzAuth struct {
-	gateway.BasicRpcHandler
+	gateway.BasicContextRpcHandler
 
 	gw               *gateway.Server
 	config           *gateway.GatewayConf
 	accessControlRpc controlClient.Control
+	// cli Init 中建立的 accessControl 连接，Stop 时关闭
+	cli zrpc.Client
+	// cache 配置了 AuthCache 时缓存 accessControl 的结果
+	cache *cachedControl
+	// revoked 配置了 Revocation 时为吊销列表
+	revoked *revocationList
+	// replay 配置了 SignReplay 时校验 sign 请求的 timestamp 和 nonce
+	replay *signReplay
+	// args 路由上配置的参数，未配置时为 nil
+	args *JzAuthArgs
 }
 
-const mdKey = "moreMd"
+// JzAuthArgs jzAuth 的路由参数，未配置的项使用 RouteMapping 的 AuthCheck 和 VerifyFuncControl
+type JzAuthArgs struct {
+	// AuthCheck token检查
+	AuthCheck *bool `json:",optional"`
+	// VerifyFuncControl 功能权限检查
+	VerifyFuncControl *bool `json:",optional"`
+}
+
+func init() {
+	Register("jzAuth", func(c *gateway.GatewayConf) (gateway.Plugin, error) {
+		// accessControl 的连接在 Init 中建立
+		return &PluginJzAuth{config: c}, nil
+	})
+}
 
 func NewPluginJzAuth(c *gateway.GatewayConf) *PluginJzAuth {
 	return &PluginJzAuth{
@@ -63,22 +90,150 @@ func NewPluginJzAuth(c *gateway.GatewayConf) *PluginJzAuth {
 	}
 }
 
+// Init 未传入 accessControl 客户端时建立连接，配置了 AuthCache 时缓存调用的结果，配置了 jwt 密钥时在本地校验 token
+func (p *PluginJzAuth) Init(c *gateway.GatewayConf) error {
+	if p.accessControlRpc == nil {
+		cli, err := zrpc.NewClient(c.AccessControlRpc)
+		if err != nil {
+			return err
+		}
+		p.cli = cli
+		p.accessControlRpc = controlClient.NewControl(cli)
+	}
+
+	if c.AuthCache != nil && p.cache == nil {
+		cache, err := newCachedControl(p.accessControlRpc, *c.AuthCache)
+		if err != nil {
+			return err
+		}
+		p.cache = cache
+		p.accessControlRpc = cache
+	}
+
+	// 本地校验在缓存之前，无法在本地校验的 token 才调用 accessControl
+	verifier, err := newJwtVerifier(c)
+	if err != nil {
+		return err
+	}
+	if verifier != nil {
+		p.accessControlRpc = &jwtControl{Control: p.accessControlRpc, verifier: verifier}
+	}
+
+	if p.revoked == nil {
+		if p.revoked, err = newRevocationList(c); err != nil {
+			return err
+		}
+	}
+	if p.replay == nil {
+		if p.replay, err = newSignReplay(c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Start 定期重新加载吊销列表
+func (p *PluginJzAuth) Start() error {
+	if p.revoked != nil {
+		p.revoked.start()
+	}
+
+	return nil
+}
+
+// InvalidateToken 删除 token 的缓存，如管理后台退出登录，未配置 AuthCache 时不做处理
+func (p *PluginJzAuth) InvalidateToken(token string) {
+	if p.cache != nil {
+		p.cache.InvalidateToken(token)
+	}
+}
+
+// InvalidateAdmin 使管理员功能权限的缓存失效，如修改了管理员的角色
+func (p *PluginJzAuth) InvalidateAdmin(adminId int64) {
+	if p.cache != nil {
+		p.cache.InvalidateAdmin(adminId)
+	}
+}
+
+// InvalidateAll 使所有缓存失效
+func (p *PluginJzAuth) InvalidateAll() {
+	if p.cache != nil {
+		p.cache.InvalidateAll()
+	}
+}
+
+// Stop 关闭 Init 中建立的连接，停止加载吊销列表
+func (p *PluginJzAuth) Stop() {
+	if p.revoked != nil {
+		p.revoked.stop()
+	}
+	if p.cli == nil {
+		return
+	}
+
+	if err := p.cli.Conn().Close(); err != nil {
+		logx.Error(err)
+	}
+}
+
+// HealthCheck accessControl 的连接断开时未就绪
+func (p *PluginJzAuth) HealthCheck(_ context.Context) error {
+	if p.cli == nil {
+		return nil
+	}
+
+	switch state := p.cli.Conn().GetState(); state {
+	case connectivity.TransientFailure, connectivity.Shutdown:
+		return fmt.Errorf("accessControl 连接状态：%s", state)
+	}
+
+	return nil
+}
+
+// Phase 鉴权阶段，先于 uriDispatch 等依赖 uid 的插件执行
+func (p *PluginJzAuth) Phase() gateway.PluginPhase {
+	return gateway.PhaseAuth
+}
+
 func (p *PluginJzAuth) Name() string {
 	return "jzAuth"
 }
 
+// ForRoute 按路由参数创建插件，如 - name: jzAuth, args: {authCheck: false}
+func (p *PluginJzAuth) ForRoute(_, _ string, args gateway.PluginArgs) (gateway.Plugin, error) {
+	if len(args) == 0 {
+		return p, nil
+	}
+
+	var a JzAuthArgs
+	if err := args.Unmarshal(&a); err != nil {
+		return nil, err
+	}
+
+	cp := *p
+	cp.args = &a
+	return &cp, nil
+}
+
 func (p *PluginJzAuth) Middleware() rest.Middleware {
 	hdl := func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ctx := r.Context()
-			moreMd, err, code := HeaderProcess(p.config, p.accessControlRpc, r)
+			md, err, code := headerProcess(p.config, p.accessControlRpc, r, p.args, p.revoked, p.replay)
+			pc := gateway.PluginContextFromRequest(r)
 			if err != nil {
-				httpx.WriteJson(w, http.StatusOK, &result.ResponseSuccessBean{Code: code, Msg: err.Error(), Data: nil})
+				// 业务码不变，按 Errors 和 Formatter 配置输出
+				e := gateway.NewError(authErrorCode(code), err.Error())
+				e.BizCode = code
+				pc.Abort(e)
+				next.ServeHTTP(w, r)
 				return
 			}
 
-			ctx = context.WithValue(ctx, mdKey, moreMd)
-			r = r.WithContext(ctx)
+			// uid 和 app 公共参数通过 PluginContext 发送给 rpc
+			for k, vals := range md {
+				pc.SetMetadata(k, vals...)
+			}
 			next.ServeHTTP(w, r)
 		})
 	}
@@ -86,75 +241,90 @@ func (p *PluginJzAuth) Middleware() rest.Middleware {
 	return rest.ToMiddleware(hdl)
 }
 
-func (p *PluginJzAuth) OnSendHeaders(r *http.Request, md metadata.MD) metadata.MD {
-	//提取uid加载到md
-	ctx := r.Context()
-	switch ctx.Value(mdKey).(type) {
-	case []string:
-		if uidData, ok := ctx.Value(mdKey).([]string); ok {
-			for _, uid := range uidData {
-				sep := strings.Split(uid, ":")
-				if len(sep) != 2 {
-					continue
-				}
-
-				md.Append(sep[0], sep[1])
-			}
-		}
-		return md
+// authErrorCode 鉴权失败的业务码对应的 gRPC 状态码，用于确定 HTTP 状态码
+func authErrorCode(code uint32) codes.Code {
+	switch code {
+	case xerr.MISSED_FUNC_PERMISSIONS_ERROR:
+		return codes.PermissionDenied
+	case 0:
+		// 路由没有鉴权配置
+		return codes.Internal
+	default:
+		return codes.Unauthenticated
 	}
-	return md
 }
 
-func (p *PluginJzAuth) OnReceiveResponse(respJson string, md metadata.MD, _ http.ResponseWriter) string {
-	respCode, respMsg := 1000, "成功"
-
-	xStatusCodeArr := md.Get("X-Status-Code")
-	if len(xStatusCodeArr) > 0 {
-		codeInt64, _ := strconv.ParseInt(xStatusCodeArr[0], 10, 64)
-		respCode = int(codeInt64)
+// OnReceiveResponse 未配置 Formatter 的路由输出 {code,msg,data}，与 jz-envelope 格式相同，配置了 Formatter 的路由由 Formatter 输出
+func (p *PluginJzAuth) OnReceiveResponse(pc *gateway.PluginContext, respJson string, md metadata.MD, _ http.ResponseWriter) string {
+	if pc.Formatted() {
+		return respJson
 	}
 
-	xErrorMessage := md.Get("X-Error-Message")
-	if len(xErrorMessage) > 0 {
-		respMsg = xErrorMessage[0]
+	bs, err := json.Marshal(internal.JzEnvelope(respJson, md))
+	if err != nil {
+		logx.Error(err)
+		return respJson
 	}
 
-	xData := md.Get("X-Data")
-	if len(xData) > 0 {
-		respJson = xData[0]
-	}
+	return string(bs)
+}
 
-	return fmt.Sprintf("{\"code\":%d, \"msg\": \"%s\", \"data\":%s}", respCode, respMsg, respJson)
+// HeaderProcess http header处理校验和提取uid，返回需要发送给 rpc 的 metadata
+func HeaderProcess(config *gateway.GatewayConf, accessControlRpc controlClient.Control, req *http.Request) (md metadata.MD, err error, code uint32) {
+	return headerProcess(config, accessControlRpc, req, nil, nil, nil)
 }
 
-// HeaderProcess http header处理校验和提取uid
-func HeaderProcess(config *gateway.GatewayConf, accessControlRpc controlClient.Control, req *http.Request) (moreMd []string, err error, code uint32) {
+// headerProcess args 为路由参数，配置了的项优先于 RouteMapping，revoked 为吊销列表，replay 为 sign 的防重放，都可以为 nil
+func headerProcess(config *gateway.GatewayConf, accessControlRpc controlClient.Control, req *http.Request, args *JzAuthArgs,
+	revoked *revocationList, replay *signReplay) (md metadata.MD, err error, code uint32) {
+	//multipart 按原始请求体签名，需要在 getCheckInfo 解析表单之前读取
+	if err = prepareSignBody(req); err != nil {
+		code = xerr.SERVER_COMMON_ERROR
+		return
+	}
 	sk, sign, auth, sysType, bodyData := getCheckInfo(req)
+	//热更新后按请求所属的配置校验
+	config = gateway.RequestConfig(req, config)
+	//默认检验Authorization / security_key / sign
+	//按命中的路由模板匹配配置，/users/:id 这类路由不受路径变量影响
+	uri := gateway.RoutePath(req)
+	methodMatch, hasMethod := config.AuthCheckMapping[strings.ToLower(req.Method)]
+	authCheck, hasRoute := methodMatch[strings.ToLower(uri)]
+	verifyFuncControl := config.VerifyFuncControlMapping[strings.ToLower(req.Method)][strings.ToLower(uri)]
+	if args != nil {
+		if args.AuthCheck != nil {
+			authCheck, hasRoute = *args.AuthCheck, true
+		}
+		if args.VerifyFuncControl != nil {
+			verifyFuncControl = *args.VerifyFuncControl
+		}
+	}
 	//校验配置文件
-	if _, ok := config.AuthCheckMapping[strings.ToLower(req.Method)]; !ok {
+	if !hasMethod && !hasRoute {
 		err = fmt.Errorf(fmt.Sprintf("route mapping http request method empty：%s | %s", req.RequestURI, req.Method))
 		return
 	}
-	methodMatch := config.AuthCheckMapping[strings.ToLower(req.Method)]
-	verifyFuncControlMatch := config.VerifyFuncControlMapping[strings.ToLower(req.Method)]
-	//默认检验Authorization / security_key / sign
-	uri := strings.Split(req.RequestURI, "?")[0]
-	uri = strings.Replace(uri, "//", "/", 1)
 	var uid string
-	if AuthCheck, ok := methodMatch[strings.ToLower(uri)]; ok {
-		if AuthCheck {
+	if hasRoute {
+		if authCheck {
 			if len(sign) > 0 { //php请求较多，优先判断
-				if !VerifySign(bodyData, config.SignKey) {
-					err = fmt.Errorf("sign校验失败")
+				if err = verifyRequestSign(req, config, bodyData); err != nil {
 					code = xerr.SERVER_COMMON_ERROR
 					return
 				}
+				//签名通过后再校验 timestamp 和 nonce，伪造的请求不会占用 nonce
+				if err = replay.check(req, bodyData); err != nil {
+					code = replay.c.Code
+					return
+				}
 			} else if len(sk) > 0 { //用户端
-				uid, err = DecodeSecurityKey(sk, config.Safe.Key, config.Safe.Iv)
+				uid, err = decodeSecurityKey(sk, config.Safe, revoked)
+				if err != nil {
+					code = xerr.LOGIN_EXPIRE_ERROR
+				}
 				//app公共头部提取
 				ret := GetAppCommonHeader(req)
-				ret = append(ret, "uid:"+uid)
+				ret.Set("uid", uid)
 				return ret, err, code
 			} else if len(auth) > 0 { //管理后台js
 				//校验 Authorization => uid
@@ -167,7 +337,7 @@ func HeaderProcess(config *gateway.GatewayConf, accessControlRpc controlClient.C
 					return
 				}
 
-				if VerifyFuncControl, ok := verifyFuncControlMatch[strings.ToLower(uri)]; ok && VerifyFuncControl {
+				if verifyFuncControl {
 					sysType, _ := strconv.Atoi(sysType)
 					// 校验 功能权限
 					resp, rpcErr := accessControlRpc.VerifyFuncControl(req.Context(), &controlClient.VerifyFuncControlReq{
@@ -183,7 +353,7 @@ func HeaderProcess(config *gateway.GatewayConf, accessControlRpc controlClient.C
 					}
 				}
 
-				return []string{"uid:" + uid}, err, code
+				return metadata.Pairs("uid", uid), err, code
 			} else {
 				err = fmt.Errorf("签名检验失败，请先登录或授权")
 				code = xerr.LOGIN_EXPIRE_ERROR
@@ -192,15 +362,15 @@ func HeaderProcess(config *gateway.GatewayConf, accessControlRpc controlClient.C
 		} else {
 			if len(sk) > 0 {
 				//家长端首页不强制登录，但是如果有传递security_key，也需要获取用户id
-				uid, _ = DecodeSecurityKey(sk, config.Safe.Key, config.Safe.Iv)
+				uid, _ = decodeSecurityKey(sk, config.Safe, revoked)
 			}
 			ret := GetAppCommonHeader(req)
-			ret = append(ret, "uid:"+uid)
+			ret.Set("uid", uid)
 			return ret, err, code
 		}
 	} else {
 		ret := GetAppCommonHeader(req)
-		ret = append(ret, "uid:"+uid)
+		ret.Set("uid", uid)
 		return ret, err, code
 	}
 	return
@@ -339,8 +509,31 @@ func ToUrlParams(data map[string]interface{}, keys ...[]string) string {
 	return strings.Join(params, "&")
 }
 
-// DecodeSecurityKey 简知security_key解析
+// DecodeSecurityKey 简知security_key解析，过期的 security_key 返回错误
 func DecodeSecurityKey(sk, key, iv string) (string, error) {
+	info, err := ParseSecurityKey(sk, key, iv)
+	if err != nil {
+		return "", err
+	}
+	if info.Expired(time.Now(), 0) {
+		return "", errSecurityKeyExpired
+	}
+
+	return info.UserId, nil
+}
+
+// SecurityKey 解密后的 security_key
+type SecurityKey struct {
+	UserId     string
+	ExpireTime time.Time
+	// Fingerprint 解密内容的 sha256，用于吊销单个 security_key
+	Fingerprint string
+}
+
+var errSecurityKeyExpired = errors.New("security_key已过期，请重新登录")
+
+// ParseSecurityKey 解密 security_key，不检查是否过期
+func ParseSecurityKey(sk, key, iv string) (*SecurityKey, error) {
 	if sk != "" {
 		if strings.Contains(sk, " ") {
 			sk = url.QueryEscape(sk)
@@ -353,16 +546,58 @@ func DecodeSecurityKey(sk, key, iv string) (string, error) {
 			if err != nil {
 				dataStr, err = jzcrypto.TripleDesDecrypt(sk, key, iv)
 				if err != nil {
-					return "", err
+					return nil, err
 				}
 			}
 		}
-		data, _ := url.ParseQuery(dataStr)
-		if data.Has("user_id") && data.Has("expire_time") {
-			return data["user_id"][0], err
-		}
+		return parseSecurityKeyData(dataStr)
+	}
+	return nil, fmt.Errorf("info为空")
+}
+
+// parseSecurityKeyData 解析解密后的 user_id=1&expire_time=1700000000
+func parseSecurityKeyData(dataStr string) (*SecurityKey, error) {
+	data, _ := url.ParseQuery(dataStr)
+	if !data.Has("user_id") || !data.Has("expire_time") {
+		return nil, fmt.Errorf("info为空")
+	}
+
+	expire, err := strconv.ParseInt(data.Get("expire_time"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("security_key有误：%w", err)
+	}
+	// 兼容毫秒的 expire_time
+	if expire > 1e12 {
+		expire /= 1000
+	}
+	sum := sha256.Sum256([]byte(dataStr))
+
+	return &SecurityKey{
+		UserId:      data.Get("user_id"),
+		ExpireTime:  time.Unix(expire, 0),
+		Fingerprint: hex.EncodeToString(sum[:]),
+	}, nil
+}
+
+// Expired 是否已过期，skew 为允许的时钟偏差
+func (k *SecurityKey) Expired(now time.Time, skew time.Duration) bool {
+	return now.After(k.ExpireTime.Add(skew))
+}
+
+// decodeSecurityKey 解析 security_key，检查是否过期和被吊销
+func decodeSecurityKey(sk string, safe gateway.Safe, revoked *revocationList) (string, error) {
+	info, err := ParseSecurityKey(sk, safe.Key, safe.Iv)
+	if err != nil {
+		return "", err
+	}
+	if info.Expired(time.Now(), safe.ClockSkew) {
+		return "", errSecurityKeyExpired
 	}
-	return "", fmt.Errorf("info为空")
+	if revoked.Revoked(info.UserId, info.Fingerprint) {
+		return "", errors.New("登录已失效，请重新登录")
+	}
+
+	return info.UserId, nil
 }
 
 // JwtParseToken 解析管理后台 jwt
@@ -406,23 +641,21 @@ type LoginAccount struct {
 	ExpireTime int64  `json:"expire_time"`
 }
 
-func GetAppCommonHeader(req *http.Request) []string {
-	var commonHeader []string
+// GetAppCommonHeader 提取 app 公共参数，优先取请求头，其次取表单
+func GetAppCommonHeader(req *http.Request) metadata.MD {
+	commonHeader := metadata.MD{}
 	for _, s := range appCommHeader {
+		var val string
 		headerKey := req.Header.Values(strings.ToUpper(s))
 		if len(headerKey) > 0 {
-			if s == "brand" {
-				commonHeader = append(commonHeader, s+":"+url.QueryEscape(strings.Trim(headerKey[0], "\n")))
-			} else {
-				commonHeader = append(commonHeader, s+":"+strings.Trim(headerKey[0], "\n"))
-			}
+			val = strings.Trim(headerKey[0], "\n")
 		} else {
-			if s == "brand" {
-				commonHeader = append(commonHeader, s+":"+url.QueryEscape(strings.Trim(req.FormValue(s), "\n")))
-			} else {
-				commonHeader = append(commonHeader, s+":"+strings.Trim(req.FormValue(s), "\n"))
-			}
+			val = strings.Trim(req.FormValue(s), "\n")
+		}
+		if s == "brand" {
+			val = url.QueryEscape(val)
 		}
+		commonHeader.Set(s, val)
 	}
 	return commonHeader
 }
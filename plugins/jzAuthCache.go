@@ -0,0 +1,191 @@
+package plugins
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	gateway "github.com/punpeo/pun-gateway-lib"
+	"github.com/punpeo/pun-gateway-lib/access/control/controlClient"
+	"github.com/zeromicro/go-zero/core/collection"
+	"github.com/zeromicro/go-zero/core/logx"
+	"github.com/zeromicro/go-zero/core/syncx"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// cachedControl 缓存 ParseAuthToken 和 VerifyFuncControl 结果的 controlClient.Control
+type cachedControl struct {
+	// generation 整体失效的版本，admins 为每个管理员失效的版本，失效时增加版本，旧的缓存等过期后删除
+	// generation 放在第一个字段以保证 32 位平台上的原子操作对齐
+	generation uint64
+	admins     sync.Map
+
+	controlClient.Control
+	c       gateway.AuthCacheConf
+	cache   *collection.Cache
+	barrier syncx.SingleFlight
+}
+
+// cacheResult 缓存的结果，err 不为 nil 时为失败的结果
+// 结果在 expire 之后再保留 stale，期间 accessControl 不可用时仍使用它
+type cacheResult struct {
+	val    interface{}
+	err    error
+	ttl    time.Duration
+	stale  time.Duration
+	expire time.Time
+}
+
+// detachedContext 保留 ctx 中的值，不继承取消和超时
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+func newCachedControl(ctl controlClient.Control, c gateway.AuthCacheConf) (*cachedControl, error) {
+	cache, err := collection.NewCache(c.TokenTTL, collection.WithLimit(c.Limit), collection.WithName("jzAuth"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &cachedControl{
+		Control: ctl,
+		c:       c,
+		cache:   cache,
+		barrier: syncx.NewSingleFlight(),
+	}, nil
+}
+
+func (cc *cachedControl) ParseAuthToken(ctx context.Context, in *controlClient.ParseAuthTokenReq,
+	opts ...grpc.CallOption) (*controlClient.ParseAuthTokenResp, error) {
+	key := fmt.Sprintf("token|%d|%s", atomic.LoadUint64(&cc.generation), in.Token)
+	val, err := cc.take(ctx, key, func(ctx context.Context) cacheResult {
+		resp, err := cc.Control.ParseAuthToken(ctx, in, opts...)
+		if err != nil || resp == nil || resp.AdminId == 0 {
+			return cacheResult{val: resp, err: err, ttl: cc.c.NegativeTTL}
+		}
+
+		ret := cacheResult{val: resp, ttl: cc.c.TokenTTL, stale: cc.c.StaleTTL}
+		if resp.ExpireTime > 0 {
+			left := time.Until(time.Unix(resp.ExpireTime, 0))
+			if left < ret.ttl {
+				ret.ttl = left
+			}
+			if left-ret.ttl < ret.stale {
+				ret.stale = left - ret.ttl
+			}
+		}
+		return ret
+	})
+
+	resp, _ := val.(*controlClient.ParseAuthTokenResp)
+	return resp, err
+}
+
+func (cc *cachedControl) VerifyFuncControl(ctx context.Context, in *controlClient.VerifyFuncControlReq,
+	opts ...grpc.CallOption) (*controlClient.VerifyFuncControlResp, error) {
+	key := fmt.Sprintf("func|%d|%d|%d|%s|%s|%d", atomic.LoadUint64(&cc.generation), cc.adminGeneration(int64(in.AdminId)),
+		in.AdminId, in.Url, in.Method, in.SysType)
+	val, err := cc.take(ctx, key, func(ctx context.Context) cacheResult {
+		resp, err := cc.Control.VerifyFuncControl(ctx, in, opts...)
+		if err != nil || resp == nil || !resp.Result {
+			return cacheResult{val: resp, err: err, ttl: cc.c.NegativeTTL}
+		}
+
+		return cacheResult{val: resp, ttl: cc.c.FuncTTL, stale: cc.c.StaleTTL}
+	})
+
+	resp, _ := val.(*controlClient.VerifyFuncControlResp)
+	return resp, err
+}
+
+// take 从缓存获取结果，没有或已过期时调用 fetch，同一个 key 只有一个请求调用 accessControl
+// fetch 使用与请求的取消无关、带 Timeout 的 context，accessControl 不可用时使用过期但仍保留的成功结果
+func (cc *cachedControl) take(ctx context.Context, key string, fetch func(ctx context.Context) cacheResult) (interface{}, error) {
+	var stale *cacheResult
+	if v, ok := cc.cache.Get(key); ok {
+		ret := v.(cacheResult)
+		if time.Now().Before(ret.expire) {
+			return ret.val, ret.err
+		}
+		// 缓存按秒清理，过期的结果需要检查是否还在保留期内
+		if ret.err == nil && time.Now().Before(ret.expire.Add(ret.stale)) {
+			stale = &ret
+		}
+	}
+
+	v, err := cc.barrier.Do(key, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(detachedContext{ctx}, cc.c.Timeout)
+		defer cancel()
+
+		ret := fetch(ctx)
+		if ret.err != nil && isUnavailable(ret.err) {
+			return nil, ret.err
+		}
+
+		if ret.ttl > 0 {
+			ret.expire = time.Now().Add(ret.ttl)
+			cc.cache.SetWithExpire(key, ret, ret.ttl+ret.stale)
+		}
+		return ret, nil
+	})
+	if err != nil {
+		if stale != nil {
+			logx.WithContext(ctx).Errorf("accessControl 不可用，使用过期的缓存：%v", err)
+			return stale.val, stale.err
+		}
+		return nil, err
+	}
+
+	ret := v.(cacheResult)
+	return ret.val, ret.err
+}
+
+func (cc *cachedControl) adminGeneration(adminId int64) uint64 {
+	if v, ok := cc.admins.Load(adminId); ok {
+		return atomic.LoadUint64(v.(*uint64))
+	}
+
+	return 0
+}
+
+// InvalidateToken 删除 token 的缓存，如退出登录
+func (cc *cachedControl) InvalidateToken(token string) {
+	cc.cache.Del(fmt.Sprintf("token|%d|%s", atomic.LoadUint64(&cc.generation), token))
+}
+
+// InvalidateAdmin 使管理员功能权限的缓存失效，如修改了管理员的角色
+func (cc *cachedControl) InvalidateAdmin(adminId int64) {
+	v, _ := cc.admins.LoadOrStore(adminId, new(uint64))
+	atomic.AddUint64(v.(*uint64), 1)
+}
+
+// InvalidateAll 使所有缓存失效
+func (cc *cachedControl) InvalidateAll() {
+	atomic.AddUint64(&cc.generation, 1)
+}
+
+// isUnavailable accessControl 不可用的错误，不缓存
+func isUnavailable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Canceled, codes.ResourceExhausted, codes.Unknown:
+		return true
+	default:
+		return false
+	}
+}
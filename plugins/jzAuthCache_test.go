@@ -0,0 +1,210 @@
+package plugins
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	gateway "github.com/punpeo/pun-gateway-lib"
+	"github.com/punpeo/pun-gateway-lib/access/control/controlClient"
+	"github.com/stretchr/testify/assert"
+	"github.com/zeromicro/go-zero/core/conf"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type fakeControl struct {
+	controlClient.Control
+	tokenCalls int
+	funcCalls  int
+	err        error
+	expire     int64
+	allowed    bool
+}
+
+func (f *fakeControl) ParseAuthToken(ctx context.Context, in *controlClient.ParseAuthTokenReq,
+	_ ...grpc.CallOption) (*controlClient.ParseAuthTokenResp, error) {
+	f.tokenCalls++
+	if err := ctx.Err(); err != nil {
+		return nil, status.FromContextError(err).Err()
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	if in.Token != "good" {
+		return &controlClient.ParseAuthTokenResp{}, nil
+	}
+
+	return &controlClient.ParseAuthTokenResp{AdminId: 1, ExpireTime: f.expire}, nil
+}
+
+func (f *fakeControl) VerifyFuncControl(_ context.Context, _ *controlClient.VerifyFuncControlReq,
+	_ ...grpc.CallOption) (*controlClient.VerifyFuncControlResp, error) {
+	f.funcCalls++
+	return &controlClient.VerifyFuncControlResp{Result: f.allowed}, nil
+}
+
+func newTestCachedControl(t *testing.T, f *fakeControl, opts ...func(c *gateway.AuthCacheConf)) *cachedControl {
+	var c gateway.AuthCacheConf
+	assert.NoError(t, conf.FillDefault(&c))
+	for _, opt := range opts {
+		opt(&c)
+	}
+	cc, err := newCachedControl(f, c)
+	assert.NoError(t, err)
+
+	return cc
+}
+
+func TestCachedControlToken(t *testing.T) {
+	f := &fakeControl{}
+	cc := newTestCachedControl(t, f)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		resp, err := cc.ParseAuthToken(ctx, &controlClient.ParseAuthTokenReq{Token: "good"})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), resp.AdminId)
+	}
+	assert.Equal(t, 1, f.tokenCalls)
+
+	// 无效的 token 缓存失败的结果
+	for i := 0; i < 2; i++ {
+		resp, err := cc.ParseAuthToken(ctx, &controlClient.ParseAuthTokenReq{Token: "bad"})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), resp.AdminId)
+	}
+	assert.Equal(t, 2, f.tokenCalls)
+
+	cc.InvalidateToken("good")
+	_, _ = cc.ParseAuthToken(ctx, &controlClient.ParseAuthTokenReq{Token: "good"})
+	assert.Equal(t, 3, f.tokenCalls)
+
+	cc.InvalidateAll()
+	_, _ = cc.ParseAuthToken(ctx, &controlClient.ParseAuthTokenReq{Token: "good"})
+	assert.Equal(t, 4, f.tokenCalls)
+}
+
+func TestCachedControlExpired(t *testing.T) {
+	// token 已过期时不缓存
+	f := &fakeControl{expire: time.Now().Add(-time.Minute).Unix()}
+	cc := newTestCachedControl(t, f)
+	for i := 0; i < 2; i++ {
+		_, _ = cc.ParseAuthToken(context.Background(), &controlClient.ParseAuthTokenReq{Token: "good"})
+	}
+	assert.Equal(t, 2, f.tokenCalls)
+}
+
+func TestCachedControlUnavailable(t *testing.T) {
+	f := &fakeControl{err: status.Error(codes.Unavailable, "down")}
+	cc := newTestCachedControl(t, f)
+	for i := 0; i < 2; i++ {
+		_, err := cc.ParseAuthToken(context.Background(), &controlClient.ParseAuthTokenReq{Token: "good"})
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+	}
+	assert.Equal(t, 2, f.tokenCalls)
+
+	f.err = status.Error(codes.InvalidArgument, "bad token")
+	for i := 0; i < 2; i++ {
+		_, err := cc.ParseAuthToken(context.Background(), &controlClient.ParseAuthTokenReq{Token: "x"})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	}
+	assert.Equal(t, 3, f.tokenCalls)
+}
+
+func TestCachedControlStale(t *testing.T) {
+	f := &fakeControl{}
+	cc := newTestCachedControl(t, f, func(c *gateway.AuthCacheConf) {
+		c.TokenTTL = 20 * time.Millisecond
+	})
+	ctx := context.Background()
+	req := &controlClient.ParseAuthTokenReq{Token: "good"}
+
+	_, err := cc.ParseAuthToken(ctx, req)
+	assert.NoError(t, err)
+	time.Sleep(30 * time.Millisecond)
+
+	// 过期后 accessControl 不可用时使用过期的结果
+	f.err = status.Error(codes.Unavailable, "down")
+	resp, err := cc.ParseAuthToken(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), resp.AdminId)
+	assert.Equal(t, 2, f.tokenCalls)
+
+	// 没有缓存时返回错误
+	_, err = cc.ParseAuthToken(ctx, &controlClient.ParseAuthTokenReq{Token: "other"})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	// 恢复后重新获取
+	f.err = nil
+	_, err = cc.ParseAuthToken(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, f.tokenCalls)
+
+	// 未开启时不使用过期的结果
+	cc = newTestCachedControl(t, f, func(c *gateway.AuthCacheConf) {
+		c.TokenTTL = 20 * time.Millisecond
+		c.StaleTTL = 0
+	})
+	_, err = cc.ParseAuthToken(ctx, req)
+	assert.NoError(t, err)
+	time.Sleep(30 * time.Millisecond)
+	f.err = status.Error(codes.Unavailable, "down")
+	_, err = cc.ParseAuthToken(ctx, req)
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestCachedControlDetachedContext(t *testing.T) {
+	f := &fakeControl{}
+	cc := newTestCachedControl(t, f)
+
+	// 发起调用的请求已取消时，调用结果仍然有效并被缓存
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	resp, err := cc.ParseAuthToken(ctx, &controlClient.ParseAuthTokenReq{Token: "good"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), resp.AdminId)
+
+	_, _ = cc.ParseAuthToken(context.Background(), &controlClient.ParseAuthTokenReq{Token: "good"})
+	assert.Equal(t, 1, f.tokenCalls)
+}
+
+func TestCachedControlFunc(t *testing.T) {
+	f := &fakeControl{allowed: true}
+	cc := newTestCachedControl(t, f)
+	ctx := context.Background()
+	req := &controlClient.VerifyFuncControlReq{AdminId: 1, Url: "/users/:id", Method: "get", SysType: 1}
+
+	for i := 0; i < 2; i++ {
+		resp, err := cc.VerifyFuncControl(ctx, req)
+		assert.NoError(t, err)
+		assert.True(t, resp.Result)
+	}
+	assert.Equal(t, 1, f.funcCalls)
+
+	_, _ = cc.VerifyFuncControl(ctx, &controlClient.VerifyFuncControlReq{AdminId: 1, Url: "/users", Method: "get", SysType: 1})
+	assert.Equal(t, 2, f.funcCalls)
+
+	cc.InvalidateAdmin(1)
+	f.allowed = false
+	resp, err := cc.VerifyFuncControl(ctx, req)
+	assert.NoError(t, err)
+	assert.False(t, resp.Result)
+	assert.Equal(t, 3, f.funcCalls)
+}
+
+func TestPluginJzAuthCacheConf(t *testing.T) {
+	var v struct {
+		AuthCache *gateway.AuthCacheConf `json:",optional"`
+	}
+	assert.NoError(t, conf.LoadFromYamlBytes([]byte("AuthCache:\n  FuncTTL: 30s\n"), &v))
+	c := gateway.GatewayConf{AuthCache: v.AuthCache}
+	assert.Equal(t, 30*time.Second, c.AuthCache.FuncTTL)
+	assert.Equal(t, 5*time.Minute, c.AuthCache.TokenTTL)
+
+	p := &PluginJzAuth{accessControlRpc: &fakeControl{}}
+	assert.NoError(t, p.Init(&c))
+	assert.NotNil(t, p.cache)
+	p.InvalidateAll()
+}
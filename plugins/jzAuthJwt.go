@@ -0,0 +1,195 @@
+package plugins
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	gateway "github.com/punpeo/pun-gateway-lib"
+	"github.com/punpeo/pun-gateway-lib/access/control/controlClient"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// jwtMethods 本地校验支持的签名算法，不支持 none
+var jwtMethods = []string{
+	"HS256", "HS384", "HS512",
+	"RS256", "RS384", "RS512",
+	"PS256", "PS384", "PS512",
+	"ES256", "ES384", "ES512",
+	"EdDSA",
+}
+
+// errJwtUnverifiable token 无法在本地校验，如不是 jwt、kid 未配置
+var errJwtUnverifiable = errors.New("无法在本地校验 token")
+
+// jwtVerifier 按密钥集合在本地校验管理后台的 jwt
+type jwtVerifier struct {
+	// kids 有 kid 的密钥，keys 所有的密钥，token 没有 kid 时依次尝试
+	kids   map[string]interface{}
+	keys   []interface{}
+	issuer string
+	leeway time.Duration
+	parser *jwt.Parser
+	now    func() time.Time
+}
+
+// newJwtVerifier 没有配置密钥时返回 nil
+func newJwtVerifier(c *gateway.GatewayConf) (*jwtVerifier, error) {
+	keys := append([]gateway.JwtKey(nil), c.Jwt.Keys...)
+	if len(c.AuthKey) > 0 {
+		keys = append(keys, gateway.JwtKey{Secret: c.AuthKey})
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	v := &jwtVerifier{
+		kids:   make(map[string]interface{}),
+		issuer: c.Jwt.Issuer,
+		leeway: c.Jwt.Leeway,
+		// exp、nbf 按 leeway 自行校验
+		parser: jwt.NewParser(jwt.WithValidMethods(jwtMethods), jwt.WithoutClaimsValidation()),
+		now:    time.Now,
+	}
+	for _, k := range keys {
+		key, err := parseJwtKey(k)
+		if err != nil {
+			return nil, fmt.Errorf("jwt 密钥 %s 有误：%w", k.Kid, err)
+		}
+		if len(k.Kid) > 0 {
+			if _, ok := v.kids[k.Kid]; ok {
+				return nil, fmt.Errorf("jwt 密钥 %s 重复", k.Kid)
+			}
+			v.kids[k.Kid] = key
+		}
+		v.keys = append(v.keys, key)
+	}
+
+	return v, nil
+}
+
+func parseJwtKey(k gateway.JwtKey) (interface{}, error) {
+	switch {
+	case len(k.Secret) > 0 && len(k.PublicKey) > 0:
+		return nil, errors.New("Secret 和 PublicKey 只能配置一个")
+	case len(k.Secret) > 0:
+		return []byte(k.Secret), nil
+	case len(k.PublicKey) > 0:
+		pem := []byte(k.PublicKey)
+		if key, err := jwt.ParseRSAPublicKeyFromPEM(pem); err == nil {
+			return key, nil
+		}
+		if key, err := jwt.ParseECPublicKeyFromPEM(pem); err == nil {
+			return key, nil
+		}
+		if key, err := jwt.ParseEdPublicKeyFromPEM(pem); err == nil {
+			return key, nil
+		}
+		return nil, errors.New("不是 RSA、ECDSA 或 Ed25519 公钥")
+	default:
+		return nil, errors.New("未配置 Secret 或 PublicKey")
+	}
+}
+
+// verify 校验 token，无法在本地校验时返回 errJwtUnverifiable
+func (v *jwtVerifier) verify(tokenString string) (*JwtClaims, error) {
+	tokenString = strings.TrimSpace(strings.TrimPrefix(tokenString, "Bearer "))
+	unverified, _, err := v.parser.ParseUnverified(tokenString, &JwtClaims{})
+	if err != nil {
+		return nil, errJwtUnverifiable
+	}
+
+	var keys []interface{}
+	kid, _ := unverified.Header["kid"].(string)
+	if len(kid) > 0 {
+		key, ok := v.kids[kid]
+		if !ok {
+			return nil, errJwtUnverifiable
+		}
+		keys = []interface{}{key}
+	} else {
+		keys = v.keys
+	}
+
+	for _, key := range keys {
+		claims := &JwtClaims{}
+		token, err := v.parser.ParseWithClaims(tokenString, claims, func(*jwt.Token) (interface{}, error) {
+			return key, nil
+		})
+		if err != nil || !token.Valid {
+			continue
+		}
+
+		if err := v.validate(claims); err != nil {
+			return nil, err
+		}
+		if claims.LoginAccount.AdminId == 0 {
+			return nil, errJwtUnverifiable
+		}
+		return claims, nil
+	}
+
+	// 有 kid 时签名错误说明 token 被篡改，没有 kid 时可能是未配置的新密钥签发的
+	if len(kid) > 0 {
+		return nil, errors.New("token签名错误，请重新登录")
+	}
+
+	return nil, errJwtUnverifiable
+}
+
+func (v *jwtVerifier) validate(claims *JwtClaims) error {
+	now := v.now()
+	exp := claims.ExpiresAt
+	if exp == nil && claims.LoginAccount.ExpireTime > 0 {
+		exp = jwt.NewNumericDate(time.Unix(claims.LoginAccount.ExpireTime, 0))
+	}
+	// 没有过期时间的 token 永久有效，不接受
+	if exp == nil {
+		return errors.New("token缺少过期时间，请重新登录")
+	}
+	if now.After(exp.Add(v.leeway)) {
+		return errors.New("token已过期，请重新登录")
+	}
+	if claims.NotBefore != nil && now.Add(v.leeway).Before(claims.NotBefore.Time) {
+		return errors.New("token无效，请重新登录")
+	}
+	if len(v.issuer) > 0 && claims.Issuer != v.issuer {
+		return errors.New("token签发者错误，请重新登录")
+	}
+
+	return nil
+}
+
+// jwtControl 先在本地校验 ParseAuthToken 的 token，无法在本地校验时调用 accessControl
+type jwtControl struct {
+	controlClient.Control
+	verifier *jwtVerifier
+}
+
+func (jc *jwtControl) ParseAuthToken(ctx context.Context, in *controlClient.ParseAuthTokenReq,
+	opts ...grpc.CallOption) (*controlClient.ParseAuthTokenResp, error) {
+	claims, err := jc.verifier.verify(in.Token)
+	if errors.Is(err, errJwtUnverifiable) {
+		return jc.Control.ParseAuthToken(ctx, in, opts...)
+	}
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	resp := &controlClient.ParseAuthTokenResp{
+		AdminId:    claims.LoginAccount.AdminId,
+		ExpireTime: claims.LoginAccount.ExpireTime,
+		UserName:   claims.LoginAccount.Username,
+		RealName:   claims.LoginAccount.RealName,
+	}
+	if resp.ExpireTime == 0 && claims.ExpiresAt != nil {
+		resp.ExpireTime = claims.ExpiresAt.Unix()
+	}
+
+	return resp, nil
+}
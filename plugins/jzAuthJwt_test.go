@@ -0,0 +1,133 @@
+package plugins
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	gateway "github.com/punpeo/pun-gateway-lib"
+	"github.com/punpeo/pun-gateway-lib/access/control/controlClient"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func signTestJwt(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims JwtClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if len(kid) > 0 {
+		token.Header["kid"] = kid
+	}
+	s, err := token.SignedString(key)
+	assert.NoError(t, err)
+
+	return s
+}
+
+func testJwtClaims(adminId int64, exp time.Time) JwtClaims {
+	return JwtClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "jzkj",
+			ExpiresAt: jwt.NewNumericDate(exp),
+		},
+		LoginAccount: LoginAccount{AdminId: adminId, ExpireTime: exp.Unix()},
+	}
+}
+
+func TestJwtControl(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	assert.NoError(t, err)
+	pub := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+
+	c := &gateway.GatewayConf{
+		AuthKey: "legacy",
+		Jwt: gateway.JwtConf{
+			Keys: []gateway.JwtKey{
+				{Kid: "2023", Secret: "old"},
+				{Kid: "2024", PublicKey: pub},
+			},
+			Issuer: "jzkj",
+			Leeway: 5 * time.Second,
+		},
+	}
+	v, err := newJwtVerifier(c)
+	assert.NoError(t, err)
+	f := &fakeControl{}
+	jc := &jwtControl{Control: f, verifier: v}
+	exp := time.Now().Add(time.Hour)
+
+	parse := func(token string) (*controlClient.ParseAuthTokenResp, error) {
+		return jc.ParseAuthToken(context.Background(), &controlClient.ParseAuthTokenReq{Token: token})
+	}
+
+	// 轮换期间新旧密钥都可以校验
+	for _, token := range []string{
+		signTestJwt(t, jwt.SigningMethodHS256, []byte("old"), "2023", testJwtClaims(7, exp)),
+		signTestJwt(t, jwt.SigningMethodRS256, rsaKey, "2024", testJwtClaims(7, exp)),
+		signTestJwt(t, jwt.SigningMethodHS256, []byte("legacy"), "", testJwtClaims(7, exp)),
+		"Bearer " + signTestJwt(t, jwt.SigningMethodHS256, []byte("legacy"), "", testJwtClaims(7, exp)),
+	} {
+		resp, err := parse(token)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(7), resp.AdminId)
+		assert.Equal(t, exp.Unix(), resp.ExpireTime)
+	}
+	assert.Equal(t, 0, f.tokenCalls)
+
+	// 过期、没有过期时间、签发者错误、kid 对应的密钥签名错误时在本地拒绝
+	expired := testJwtClaims(7, time.Now().Add(-time.Minute))
+	wrongIssuer := testJwtClaims(7, exp)
+	wrongIssuer.Issuer = "other"
+	notBefore := testJwtClaims(7, exp)
+	notBefore.NotBefore = jwt.NewNumericDate(time.Now().Add(time.Minute))
+	noExpire := testJwtClaims(7, exp)
+	noExpire.ExpiresAt = nil
+	noExpire.LoginAccount.ExpireTime = 0
+	for _, token := range []string{
+		signTestJwt(t, jwt.SigningMethodHS256, []byte("old"), "2023", expired),
+		signTestJwt(t, jwt.SigningMethodHS256, []byte("old"), "2023", wrongIssuer),
+		signTestJwt(t, jwt.SigningMethodHS256, []byte("old"), "2023", notBefore),
+		signTestJwt(t, jwt.SigningMethodHS256, []byte("old"), "2023", noExpire),
+		signTestJwt(t, jwt.SigningMethodHS256, []byte("forged"), "2023", testJwtClaims(7, exp)),
+	} {
+		_, err := parse(token)
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	}
+	assert.Equal(t, 0, f.tokenCalls)
+
+	// 不在时钟偏差内才算过期
+	resp, err := parse(signTestJwt(t, jwt.SigningMethodHS256, []byte("old"), "2023", testJwtClaims(7, time.Now().Add(-time.Second))))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(7), resp.AdminId)
+
+	// 无法在本地校验时调用 accessControl
+	for _, token := range []string{
+		"good",
+		signTestJwt(t, jwt.SigningMethodHS256, []byte("new"), "2025", testJwtClaims(7, exp)),
+		signTestJwt(t, jwt.SigningMethodHS256, []byte("new"), "", testJwtClaims(7, exp)),
+	} {
+		_, _ = parse(token)
+	}
+	assert.Equal(t, 3, f.tokenCalls)
+}
+
+func TestNewJwtVerifier(t *testing.T) {
+	v, err := newJwtVerifier(&gateway.GatewayConf{})
+	assert.NoError(t, err)
+	assert.Nil(t, v)
+
+	_, err = newJwtVerifier(&gateway.GatewayConf{Jwt: gateway.JwtConf{Keys: []gateway.JwtKey{{Kid: "a"}}}})
+	assert.Error(t, err)
+	_, err = newJwtVerifier(&gateway.GatewayConf{Jwt: gateway.JwtConf{Keys: []gateway.JwtKey{{Kid: "a", PublicKey: "x"}}}})
+	assert.Error(t, err)
+	_, err = newJwtVerifier(&gateway.GatewayConf{Jwt: gateway.JwtConf{Keys: []gateway.JwtKey{
+		{Kid: "a", Secret: "x"}, {Kid: "a", Secret: "y"},
+	}}})
+	assert.Error(t, err)
+}
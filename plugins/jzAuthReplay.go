@@ -0,0 +1,144 @@
+package plugins
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	gateway "github.com/punpeo/pun-gateway-lib"
+	"github.com/spf13/cast"
+	"github.com/zeromicro/go-zero/core/collection"
+	"github.com/zeromicro/go-zero/core/logx"
+	"github.com/zeromicro/go-zero/core/stores/redis"
+)
+
+const (
+	signReplayStoreRedis = "redis"
+	// signNoncePrefix redis 中已使用 nonce 的 key 前缀
+	signNoncePrefix = "gateway:sign:nonce:"
+)
+
+var (
+	errSignTimestamp = errors.New("sign缺少timestamp")
+	errSignExpired   = errors.New("sign已过期，请检查timestamp")
+	errSignNonce     = errors.New("sign缺少nonce")
+	errSignReplay    = errors.New("sign请求重复")
+)
+
+// signReplay 校验 sign 请求的 timestamp 和 nonce，拒绝过期和重复的请求
+type signReplay struct {
+	c gateway.SignReplayConf
+	// lock 保证内存中 nonce 的检查和保存是原子的
+	lock  sync.Mutex
+	seen  *collection.Cache
+	store *redis.Redis
+	now   func() time.Time
+}
+
+// newSignReplay 未配置 SignReplay 时返回 nil
+func newSignReplay(c *gateway.GatewayConf) (*signReplay, error) {
+	if c.SignReplay == nil {
+		return nil, nil
+	}
+
+	sr := &signReplay{
+		c:   *c.SignReplay,
+		now: time.Now,
+	}
+	seen, err := collection.NewCache(sr.ttl(), collection.WithName("signNonce"))
+	if err != nil {
+		return nil, err
+	}
+	sr.seen = seen
+
+	if sr.c.Store == signReplayStoreRedis {
+		if len(c.Redis.Host) == 0 {
+			return nil, errors.New("SignReplay.Store 为 redis 时需要配置 Redis")
+		}
+		if sr.store, err = redis.NewRedis(c.Redis); err != nil {
+			return nil, err
+		}
+	}
+
+	return sr, nil
+}
+
+// ttl nonce 的保存时间，timestamp 在 [now-Window, now+Window] 内都有效，保存 2 倍 Window 才能覆盖整个有效期
+func (sr *signReplay) ttl() time.Duration {
+	return 2 * sr.c.Window
+}
+
+// check 从 sign 的参数或 hmac-sha256 签名的请求头获取 timestamp 和 nonce 并校验，sr 为 nil 时不校验
+func (sr *signReplay) check(r *http.Request, data map[string]any) error {
+	if sr == nil {
+		return nil
+	}
+
+	ts := signParam(r, data, "timestamp")
+	if len(ts) == 0 {
+		return errSignTimestamp
+	}
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errSignTimestamp
+	}
+	// 兼容毫秒的 timestamp
+	if sec > 1e12 {
+		sec /= 1000
+	}
+	if math.Abs(float64(sr.now().Unix()-sec)) > sr.c.Window.Seconds() {
+		return errSignExpired
+	}
+
+	nonce := signParam(r, data, "nonce")
+	if len(nonce) == 0 {
+		if sr.c.RequireNonce {
+			return errSignNonce
+		}
+		return nil
+	}
+
+	if !sr.markNonce(r.Context(), nonce) {
+		return errSignReplay
+	}
+
+	return nil
+}
+
+// markNonce 保存 nonce，已使用过时返回 false
+func (sr *signReplay) markNonce(ctx context.Context, nonce string) bool {
+	if sr.store != nil {
+		ok, err := sr.store.SetnxExCtx(ctx, signNoncePrefix+nonce, "1", int(math.Ceil(sr.ttl().Seconds())))
+		if err == nil {
+			return ok
+		}
+		logx.WithContext(ctx).Errorf("sign nonce 保存到 redis 失败，使用本机内存：%v", err)
+	}
+
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+	if _, ok := sr.seen.Get(nonce); ok {
+		return false
+	}
+	sr.seen.Set(nonce, struct{}{})
+	return true
+}
+
+// signParam 先取 sign 参数中的值，没有时取请求头
+// 只有 hmac-sha256 的签名包含请求头的 timestamp 和 nonce，md5 只校验 data，请求头的值可以任意修改，不能使用
+func signParam(r *http.Request, data map[string]any, key string) string {
+	if v, ok := data[key]; ok {
+		if s := cast.ToString(v); len(s) > 0 {
+			return s
+		}
+	}
+	if signVersion(r) != signVersionHmacSha256 {
+		return ""
+	}
+
+	return r.Header.Get(key)
+}
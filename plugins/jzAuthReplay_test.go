@@ -0,0 +1,75 @@
+package plugins
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	gateway "github.com/punpeo/pun-gateway-lib"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSignReplay(t *testing.T, c gateway.SignReplayConf) *signReplay {
+	sr, err := newSignReplay(&gateway.GatewayConf{SignReplay: &c})
+	assert.NoError(t, err)
+	sr.now = func() time.Time {
+		return time.Unix(1700000000, 0)
+	}
+	return sr
+}
+
+func TestSignReplayTimestamp(t *testing.T) {
+	sr := newTestSignReplay(t, gateway.SignReplayConf{Window: time.Minute})
+	r := httptest.NewRequest(http.MethodPost, "/", http.NoBody)
+
+	assert.NoError(t, sr.check(r, map[string]any{"timestamp": float64(1700000030)}))
+	assert.NoError(t, sr.check(r, map[string]any{"timestamp": "1699999940"}))
+	// 毫秒
+	assert.NoError(t, sr.check(r, map[string]any{"timestamp": float64(1700000000123)}))
+	assert.Equal(t, errSignExpired, sr.check(r, map[string]any{"timestamp": "1699999939"}))
+	assert.Equal(t, errSignExpired, sr.check(r, map[string]any{"timestamp": "1700000061"}))
+	assert.Equal(t, errSignTimestamp, sr.check(r, map[string]any{}))
+	assert.Equal(t, errSignTimestamp, sr.check(r, map[string]any{"timestamp": "abc"}))
+
+	// md5 的签名不包含请求头，不使用请求头的 timestamp
+	r.Header.Set("timestamp", "1700000000")
+	assert.Equal(t, errSignTimestamp, sr.check(r, nil))
+	r.Header.Set(signVersionHeader, "md5")
+	assert.Equal(t, errSignTimestamp, sr.check(r, nil))
+	assert.Equal(t, errSignExpired, sr.check(r, map[string]any{"timestamp": "1699999939"}))
+
+	r.Header.Set(signVersionHeader, "HMAC-SHA256")
+	assert.NoError(t, sr.check(r, nil))
+}
+
+func TestSignReplayNonce(t *testing.T) {
+	sr := newTestSignReplay(t, gateway.SignReplayConf{Window: time.Minute})
+	r := httptest.NewRequest(http.MethodPost, "/", http.NoBody)
+	ts := strconv.FormatInt(1700000000, 10)
+
+	assert.NoError(t, sr.check(r, map[string]any{"timestamp": ts, "nonce": "a"}))
+	assert.Equal(t, errSignReplay, sr.check(r, map[string]any{"timestamp": ts, "nonce": "a"}))
+	assert.NoError(t, sr.check(r, map[string]any{"timestamp": ts, "nonce": "b"}))
+	// 未要求 nonce 时可以不带
+	assert.NoError(t, sr.check(r, map[string]any{"timestamp": ts}))
+
+	sr = newTestSignReplay(t, gateway.SignReplayConf{Window: time.Minute, RequireNonce: true})
+	assert.Equal(t, errSignNonce, sr.check(r, map[string]any{"timestamp": ts}))
+	r.Header.Set("nonce", "c")
+	assert.Equal(t, errSignNonce, sr.check(r, map[string]any{"timestamp": ts}))
+	r.Header.Set(signVersionHeader, signVersionHmacSha256)
+	assert.NoError(t, sr.check(r, map[string]any{"timestamp": ts}))
+	assert.Equal(t, errSignReplay, sr.check(r, map[string]any{"timestamp": ts}))
+}
+
+func TestNewSignReplay(t *testing.T) {
+	sr, err := newSignReplay(&gateway.GatewayConf{})
+	assert.NoError(t, err)
+	assert.Nil(t, sr)
+	assert.NoError(t, sr.check(httptest.NewRequest(http.MethodPost, "/", http.NoBody), nil))
+
+	_, err = newSignReplay(&gateway.GatewayConf{SignReplay: &gateway.SignReplayConf{Window: time.Minute, Store: "redis"}})
+	assert.Error(t, err)
+}
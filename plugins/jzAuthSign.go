@@ -0,0 +1,250 @@
+package plugins
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	gateway "github.com/punpeo/pun-gateway-lib"
+	"github.com/zeromicro/go-zero/core/metric"
+)
+
+const (
+	// signVersionHeader 签名版本的请求头，为空时为 md5
+	signVersionHeader = "X-Sign-Version"
+	// signKeyIdHeader 调用方密钥 ID 的请求头
+	signKeyIdHeader = "X-Sign-Key-Id"
+
+	signVersionMd5        = "md5"
+	signVersionHmacSha256 = "hmac-sha256"
+
+	// signCallerUnknown 指标中无法确认的版本和调用方
+	signCallerUnknown = "unknown"
+)
+
+var metricSignTotal = metric.NewCounterVec(&metric.CounterVecOpts{
+	Namespace: "gateway",
+	Subsystem: "sign",
+	Name:      "requests_total",
+	Help:      "gateway internal sign requests by version and caller.",
+	Labels:    []string{"version", "caller", "result"},
+})
+
+var (
+	errSignFailed  = errors.New("sign校验失败")
+	errSignVersion = errors.New("sign版本不支持")
+	errSignMd5     = errors.New("sign不再支持md5，请使用hmac-sha256")
+	errSignKeyId   = errors.New("sign密钥ID未配置")
+	errSignBody    = errors.New("sign请求体已被读取")
+)
+
+// signVersion 请求的签名版本，转为小写，为空时为 md5
+func signVersion(r *http.Request) string {
+	version := strings.ToLower(r.Header.Get(signVersionHeader))
+	if len(version) == 0 {
+		return signVersionMd5
+	}
+
+	return version
+}
+
+// verifyRequestSign 按 X-Sign-Version 校验内部调用的签名，data 为 md5 签名的参数
+func verifyRequestSign(r *http.Request, c *gateway.GatewayConf, data map[string]any) error {
+	version := signVersion(r)
+	// caller 只使用配置了的密钥 ID，请求头的值由调用方任意填写，直接作为标签会使指标无限增长
+	caller := signCallerUnknown
+	var err error
+	switch version {
+	case signVersionMd5:
+		caller = signCaller(r, c.Sign.Keys)
+		if c.Sign.DisableMd5 {
+			err = errSignMd5
+		} else if !VerifySign(data, c.SignKey) {
+			err = errSignFailed
+		}
+	case signVersionHmacSha256:
+		kid := r.Header.Get(signKeyIdHeader)
+		if err = verifyHmacSign(r, c.Sign.Keys, kid, r.Header.Get("sign")); err == nil {
+			caller = kid
+		}
+	default:
+		version, err = signCallerUnknown, errSignVersion
+	}
+
+	result := "ok"
+	if err != nil {
+		result = "fail"
+	}
+	metricSignTotal.Inc(version, caller, result)
+
+	return err
+}
+
+// signCaller md5 签名指标中的调用方，请求头 X-Sign-Key-Id 是 Sign.Keys 中配置的密钥 ID 时使用它，否则为 unknown
+// md5 签名不校验密钥 ID，调用方迁移前带上 X-Sign-Key-Id 即可在指标中区分，标签的取值不超过配置的密钥个数
+func signCaller(r *http.Request, keys []gateway.SignKeyConf) string {
+	kid := r.Header.Get(signKeyIdHeader)
+	if len(kid) == 0 {
+		return signCallerUnknown
+	}
+
+	for _, k := range keys {
+		if k.Kid == kid {
+			return kid
+		}
+	}
+
+	return signCallerUnknown
+}
+
+// verifyHmacSign 校验 hmac-sha256 签名，sign 为请求头中十六进制的签名
+func verifyHmacSign(r *http.Request, keys []gateway.SignKeyConf, kid, sign string) error {
+	if len(kid) == 0 {
+		return errSignKeyId
+	}
+
+	var secret string
+	for _, k := range keys {
+		if k.Kid == kid {
+			secret = k.Secret
+			break
+		}
+	}
+	if len(secret) == 0 {
+		return errSignKeyId
+	}
+
+	expected, err := SignRequest(r, secret)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(sign))) {
+		return errSignFailed
+	}
+
+	return nil
+}
+
+// SignRequest 计算请求的 hmac-sha256 签名，调用方按同样的方式签名，签名放在请求头 sign 中
+func SignRequest(r *http.Request, secret string) (string, error) {
+	canonical, err := canonicalRequest(r)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(canonical))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// canonicalRequest 签名的内容，每行依次为：
+// 版本、大写的方法、路径、按 key 和 value 排序的 query（不含 sign）、请求头 timestamp、请求头 nonce、请求体的 sha256
+// x-www-form-urlencoded 表单按 url.Values.Encode 编码后计算 sha256，multipart 按原始请求体计算，文件也参与签名
+func canonicalRequest(r *http.Request) (string, error) {
+	body, err := signBody(r)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(body)
+
+	return strings.Join([]string{
+		signVersionHmacSha256,
+		strings.ToUpper(r.Method),
+		r.URL.EscapedPath(),
+		canonicalQuery(r.URL.Query()),
+		r.Header.Get("timestamp"),
+		r.Header.Get("nonce"),
+		hex.EncodeToString(sum[:]),
+	}, "\n"), nil
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		if k != "sign" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var params []string
+	for _, k := range keys {
+		vals := append([]string(nil), query[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			params = append(params, url.QueryEscape(k)+"="+url.QueryEscape(v))
+		}
+	}
+
+	return strings.Join(params, "&")
+}
+
+// multipartBody 签名时读取的 multipart 请求体，解析表单时从它读取，解析后仍可以取到原始请求体
+type multipartBody struct {
+	*bytes.Reader
+	raw []byte
+}
+
+func (b *multipartBody) Close() error {
+	return nil
+}
+
+// prepareSignBody hmac-sha256 签名的 multipart 请求在解析表单之前读取原始请求体
+func prepareSignBody(r *http.Request) error {
+	if signVersion(r) != signVersionHmacSha256 || !isMultipartRequest(r) {
+		return nil
+	}
+
+	_, err := signBody(r)
+	return err
+}
+
+// signBody 读取请求体并放回
+// x-www-form-urlencoded 表单为按 key 排序编码的表单，与是否已被解析无关；multipart 为原始请求体，需要在解析表单之前读取
+func signBody(r *http.Request) ([]byte, error) {
+	if isMultipartRequest(r) {
+		if b, ok := r.Body.(*multipartBody); ok {
+			return b.raw, nil
+		}
+		if r.MultipartForm != nil {
+			return nil, errSignBody
+		}
+	} else if isFormRequest(r) {
+		if r.PostForm == nil {
+			if err := r.ParseForm(); err != nil {
+				return nil, err
+			}
+		}
+		return []byte(r.PostForm.Encode()), nil
+	}
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if isMultipartRequest(r) {
+		r.Body = &multipartBody{Reader: bytes.NewReader(body), raw: body}
+	} else {
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	return body, nil
+}
+
+func isMultipartRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data")
+}
+
+func isFormRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded")
+}
@@ -0,0 +1,169 @@
+package plugins
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	gateway "github.com/punpeo/pun-gateway-lib"
+	"github.com/stretchr/testify/assert"
+)
+
+var testSignConf = &gateway.GatewayConf{
+	SignKey: "md5key",
+	Sign: gateway.SignConf{
+		Keys: []gateway.SignKeyConf{
+			{Kid: "order", Secret: "order-secret"},
+			{Kid: "user", Secret: "user-secret"},
+		},
+	},
+}
+
+func newHmacRequest(t *testing.T, kid, secret, body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/api/order?b=2&a=1&a=0", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set(signVersionHeader, "HMAC-SHA256")
+	r.Header.Set(signKeyIdHeader, kid)
+	r.Header.Set("timestamp", "1700000000")
+	sign, err := SignRequest(r, secret)
+	assert.NoError(t, err)
+	r.Header.Set("sign", sign)
+	return r
+}
+
+func TestVerifyRequestSignHmac(t *testing.T) {
+	body := `{"items":[{"id":1}],"paid":true}`
+	r := newHmacRequest(t, "order", "order-secret", body)
+	assert.NoError(t, verifyRequestSign(r, testSignConf, nil))
+	// 请求体放回以便转发
+	bs, _ := io.ReadAll(r.Body)
+	assert.Equal(t, body, string(bs))
+
+	// 嵌套的字段、bool 也参与签名
+	r = newHmacRequest(t, "order", "order-secret", body)
+	r.Body = io.NopCloser(strings.NewReader(`{"items":[{"id":2}],"paid":true}`))
+	assert.Equal(t, errSignFailed, verifyRequestSign(r, testSignConf, nil))
+
+	r = newHmacRequest(t, "order", "order-secret", body)
+	r.Header.Set("timestamp", "1700000001")
+	assert.Equal(t, errSignFailed, verifyRequestSign(r, testSignConf, nil))
+
+	r = newHmacRequest(t, "order", "order-secret", body)
+	r.URL.Path = "/api/refund"
+	assert.Equal(t, errSignFailed, verifyRequestSign(r, testSignConf, nil))
+
+	// 用其他调用方的密钥签名
+	r = newHmacRequest(t, "order", "user-secret", body)
+	assert.Equal(t, errSignFailed, verifyRequestSign(r, testSignConf, nil))
+
+	r = newHmacRequest(t, "unknown", "order-secret", body)
+	assert.Equal(t, errSignKeyId, verifyRequestSign(r, testSignConf, nil))
+}
+
+func TestVerifyRequestSignHmacForm(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/api/order", strings.NewReader("b=2&a=1"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set(signVersionHeader, signVersionHmacSha256)
+	r.Header.Set(signKeyIdHeader, "user")
+	sign, err := SignRequest(r, "user-secret")
+	assert.NoError(t, err)
+	r.Header.Set("sign", sign)
+
+	// jzAuth 获取 security_key 时已解析表单
+	assert.Empty(t, r.FormValue("security_key"))
+	assert.NoError(t, verifyRequestSign(r, testSignConf, nil))
+}
+
+func TestVerifyRequestSignHmacMultipart(t *testing.T) {
+	multipartBody := func(file string) (string, string) {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		assert.NoError(t, mw.SetBoundary("sign-test"))
+		assert.NoError(t, mw.WriteField("order_id", "1"))
+		fw, err := mw.CreateFormFile("invoice", "invoice.pdf")
+		assert.NoError(t, err)
+		_, err = fw.Write([]byte(file))
+		assert.NoError(t, err)
+		assert.NoError(t, mw.Close())
+		return buf.String(), mw.FormDataContentType()
+	}
+	newRequest := func(body, ct string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/api/order", strings.NewReader(body))
+		r.Header.Set("Content-Type", ct)
+		r.Header.Set(signVersionHeader, signVersionHmacSha256)
+		r.Header.Set(signKeyIdHeader, "user")
+		return r
+	}
+
+	body, ct := multipartBody("v1")
+	sign, err := SignRequest(newRequest(body, ct), "user-secret")
+	assert.NoError(t, err)
+
+	// 按原始请求体签名，jzAuth 获取 security_key 时解析表单之后仍可以校验，文件也可以读取
+	r := newRequest(body, ct)
+	r.Header.Set("sign", sign)
+	assert.NoError(t, prepareSignBody(r))
+	assert.Empty(t, r.FormValue("security_key"))
+	assert.NoError(t, verifyRequestSign(r, testSignConf, nil))
+	assert.Equal(t, "1", r.FormValue("order_id"))
+	assert.Len(t, r.MultipartForm.File["invoice"], 1)
+
+	// 替换文件后签名不一致
+	tampered, _ := multipartBody("v2")
+	r = newRequest(tampered, ct)
+	r.Header.Set("sign", sign)
+	assert.NoError(t, prepareSignBody(r))
+	assert.Equal(t, errSignFailed, verifyRequestSign(r, testSignConf, nil))
+
+	// 没有在解析表单之前读取请求体
+	r = newRequest(body, ct)
+	r.Header.Set("sign", sign)
+	assert.Empty(t, r.FormValue("security_key"))
+	assert.Equal(t, errSignBody, verifyRequestSign(r, testSignConf, nil))
+}
+
+func TestVerifyRequestSignMd5(t *testing.T) {
+	md5Sign := func(params string) string {
+		h := md5.Sum([]byte(params + "&key=md5key"))
+		return hex.EncodeToString(h[:])
+	}
+	r := httptest.NewRequest(http.MethodPost, "/api/order", http.NoBody)
+
+	sign := md5Sign("a=1&b=2")
+	assert.NoError(t, verifyRequestSign(r, testSignConf, map[string]any{"a": "1", "b": float64(2), "sign": sign}))
+	assert.Equal(t, errSignFailed, verifyRequestSign(r, testSignConf, map[string]any{"a": "2", "b": "2", "sign": sign}))
+
+	r.Header.Set(signVersionHeader, "md5")
+	assert.NoError(t, verifyRequestSign(r, testSignConf, map[string]any{"a": "1", "b": "2", "sign": sign}))
+
+	c := *testSignConf
+	c.Sign.DisableMd5 = true
+	assert.Equal(t, errSignMd5, verifyRequestSign(r, &c, map[string]any{"a": "1", "b": "2", "sign": sign}))
+
+	r.Header.Set(signVersionHeader, "sha1")
+	assert.Equal(t, errSignVersion, verifyRequestSign(r, testSignConf, nil))
+}
+
+func TestSignCaller(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/api/order", http.NoBody)
+	assert.Equal(t, signCallerUnknown, signCaller(r, testSignConf.Sign.Keys))
+
+	// md5 调用方带上配置了的密钥 ID 时按它统计，任意填写的值不会成为新的标签
+	r.Header.Set(signKeyIdHeader, "order")
+	assert.Equal(t, "order", signCaller(r, testSignConf.Sign.Keys))
+	r.Header.Set(signKeyIdHeader, "random-1")
+	assert.Equal(t, signCallerUnknown, signCaller(r, testSignConf.Sign.Keys))
+	r.Header.Set(signKeyIdHeader, "order")
+	assert.Equal(t, signCallerUnknown, signCaller(r, nil))
+}
+
+func TestCanonicalQuery(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/?b=2&a=1&a=0&sign=x&c=a%20b", http.NoBody)
+	assert.Equal(t, "a=0&a=1&b=2&c=a+b", canonicalQuery(r.URL.Query()))
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"sort"
 	"strings"
 	"sync"
@@ -16,10 +17,13 @@ import (
 
 	jsoniter "github.com/json-iterator/go"
 	gateway "github.com/punpeo/pun-gateway-lib"
+	"github.com/punpeo/punpeo-lib/rest/xerr"
 	"github.com/spf13/cast"
+	"github.com/stretchr/testify/assert"
 	"github.com/zeromicro/go-zero/core/discov"
 	"github.com/zeromicro/go-zero/rest"
 	"github.com/zeromicro/go-zero/zrpc"
+	"google.golang.org/grpc/codes"
 )
 
 const (
@@ -251,3 +255,64 @@ func toUrlParams(data map[string]interface{}, keys ...[]string) string {
 	}
 	return strings.Join(params, "&")
 }
+
+func TestJzAuthMiddlewareAbort(t *testing.T) {
+	f := &fakeControl{}
+	p := &PluginJzAuth{
+		config: &gateway.GatewayConf{AuthCheckMapping: map[string]map[string]bool{
+			"get": {"/users": true},
+		}},
+		accessControlRpc: f,
+	}
+	serve := func(method, auth string) (*gateway.PluginContext, bool) {
+		r := httptest.NewRequest(method, "/users", http.NoBody)
+		if len(auth) > 0 {
+			r.Header.Set("Authorization", auth)
+		}
+		pc := gateway.NewPluginContext()
+		r = r.WithContext(gateway.ContextWithPluginContext(r.Context(), pc))
+		called := false
+		p.Middleware()(func(http.ResponseWriter, *http.Request) {
+			called = true
+		})(httptest.NewRecorder(), r)
+
+		return pc, called
+	}
+
+	// 鉴权失败时中止请求，交给网关按 Errors 和 Formatter 输出，业务码不变
+	tests := []struct {
+		name    string
+		method  string
+		auth    string
+		code    codes.Code
+		bizCode uint32
+	}{
+		{name: "no credential", method: http.MethodGet, code: codes.Unauthenticated, bizCode: xerr.LOGIN_EXPIRE_ERROR},
+		{name: "bad token", method: http.MethodGet, auth: "bad", code: codes.Unauthenticated, bizCode: xerr.LOGIN_EXPIRE_ERROR},
+		{name: "no route config", method: http.MethodPost, code: codes.Internal},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pc, called := serve(test.method, test.auth)
+			assert.True(t, called)
+			var e *gateway.Error
+			if assert.ErrorAs(t, pc.Err(), &e) {
+				assert.Equal(t, test.code, e.Code)
+				assert.Equal(t, test.bizCode, e.BizCode)
+			}
+			assert.Empty(t, pc.MetadataValue("uid"))
+		})
+	}
+
+	pc, called := serve(http.MethodGet, "good")
+	assert.True(t, called)
+	assert.NoError(t, pc.Err())
+	assert.Equal(t, "1", pc.MetadataValue("uid"))
+}
+
+func TestAuthErrorCode(t *testing.T) {
+	assert.Equal(t, codes.PermissionDenied, authErrorCode(xerr.MISSED_FUNC_PERMISSIONS_ERROR))
+	assert.Equal(t, codes.Unauthenticated, authErrorCode(xerr.LOGIN_EXPIRE_ERROR))
+	assert.Equal(t, codes.Unauthenticated, authErrorCode(xerr.SERVER_COMMON_ERROR))
+	assert.Equal(t, codes.Internal, authErrorCode(0))
+}
@@ -0,0 +1,221 @@
+package plugins
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	gateway "github.com/punpeo/pun-gateway-lib"
+	"github.com/punpeo/pun-gateway-lib/internal"
+	"github.com/zeromicro/go-zero/core/collection"
+	"github.com/zeromicro/go-zero/core/stores/redis"
+	"github.com/zeromicro/go-zero/rest"
+	"golang.org/x/time/rate"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+const (
+	rateLimitKeyRoute     = "route"
+	rateLimitKeyUid       = "uid"
+	rateLimitKeyIp        = "ip"
+	rateLimitKeyChannelId = "channel_id"
+
+	rateLimitStoreMemory = "memory"
+	rateLimitStoreRedis  = "redis"
+
+	// rateLimitExpire 限流器最后一次使用后在内存中至少保留的时间，rateLimitLimit 最多保留的限流器个数
+	rateLimitExpire = time.Minute
+	rateLimitLimit  = 100000
+	// rateLimitPrefix redis 中限流的 key 前缀
+	rateLimitPrefix = "gateway:rateLimit:"
+)
+
+// PluginRateLimit 按路由的令牌桶限流插件，未配置参数时每条路由每秒 100 个请求
+type PluginRateLimit struct {
+	gateway.BasicRpcHandler
+
+	// limiters 所有路由共用的本机限流器，key 为路由、参数和限流 key，redis 不可用时也使用它
+	limiters *collection.Cache
+	// store、redis Init 中按 GatewayConf.Redis 创建，未配置时为 nil
+	store *redis.Redis
+	redis *redisLimiter
+
+	args  RateLimitArgs
+	route string
+	// expire 限流器最后一次使用后保留的时间，不小于令牌桶从空到满的时间，重新创建的令牌桶是满的
+	expire time.Duration
+}
+
+// RateLimitArgs rateLimit 的路由参数
+type RateLimitArgs struct {
+	// Rate 每秒的令牌数
+	Rate int `json:",default=100"`
+	// Burst 令牌桶的容量，为 0 时等于 Rate
+	Burst int `json:",optional"`
+	// Key 按什么限流：route 整条路由、uid 用户（需要 jzAuth，未登录时按 ip）、ip 客户端 IP、channel_id 渠道（需要 jzAuth），
+	// 客户端 IP 按 GatewayConf.TrustedProxies 确定
+	// channel_id 由客户端传入，换一个值就是新的令牌桶，只能用于分配渠道的配额，不能防刷，防刷需要按 ip 或 uid 限流
+	Key string `json:",default=route,options=route|uid|ip|channel_id"`
+	// Store 令牌桶保存在 memory 本机内存或 redis 集群共享，redis 不可用时退化为本机限流
+	Store string `json:",default=memory,options=memory|redis"`
+	// Msg 限流时的错误信息
+	Msg string `json:",default=请求过于频繁，请稍后再试"`
+	// Code 限流时的业务码，为 0 时按 Errors 配置
+	Code uint32 `json:",optional"`
+	// HttpStatus 限流时的 HTTP 状态码
+	HttpStatus int `json:",default=429"`
+}
+
+func init() {
+	Register("rateLimit", func(*gateway.GatewayConf) (gateway.Plugin, error) {
+		return NewPluginRateLimit(), nil
+	})
+}
+
+func NewPluginRateLimit() *PluginRateLimit {
+	return &PluginRateLimit{}
+}
+
+func (p *PluginRateLimit) Name() string {
+	return "rateLimit"
+}
+
+// Phase 在鉴权阶段的最后执行，按 uid 限流时 jzAuth 已写入 uid，分流之前拒绝请求
+func (p *PluginRateLimit) Phase() gateway.PluginPhase {
+	return gateway.PhaseAuth
+}
+
+func (p *PluginRateLimit) Priority() int {
+	return -100
+}
+
+// Requires 按 uid 或 channel_id 限流时依赖 jzAuth，未通过鉴权的请求不会用任意的 channel_id 创建令牌桶
+func (p *PluginRateLimit) Requires(_ *gateway.RouteMapping) []string {
+	if p.args.Key == rateLimitKeyUid || p.args.Key == rateLimitKeyChannelId {
+		return []string{"jzAuth"}
+	}
+
+	return nil
+}
+
+// Init 创建限流器的缓存，配置了 Redis 时连接 redis
+func (p *PluginRateLimit) Init(c *gateway.GatewayConf) error {
+	limiters, err := collection.NewCache(rateLimitExpire, collection.WithLimit(rateLimitLimit),
+		collection.WithName("rateLimit"))
+	if err != nil {
+		return err
+	}
+	p.limiters = limiters
+
+	if len(c.Redis.Host) > 0 {
+		if p.store, err = redis.NewRedis(c.Redis); err != nil {
+			return err
+		}
+		p.redis = newRedisLimiter(p.store)
+	}
+
+	return nil
+}
+
+// Stop 停止检查 redis 恢复的协程
+func (p *PluginRateLimit) Stop() {
+	if p.redis != nil {
+		p.redis.stop()
+	}
+}
+
+// HealthCheck 配置了 Redis 时检查 redis 是否可用
+func (p *PluginRateLimit) HealthCheck(ctx context.Context) error {
+	if p.store == nil || p.store.PingCtx(ctx) {
+		return nil
+	}
+
+	return errors.New("redis 不可用")
+}
+
+// ForRoute 按路由参数创建插件，如 - name: rateLimit, args: {rate: 10, key: uid, store: redis}
+func (p *PluginRateLimit) ForRoute(method, path string, args gateway.PluginArgs) (gateway.Plugin, error) {
+	var a RateLimitArgs
+	if err := args.Unmarshal(&a); err != nil {
+		return nil, err
+	}
+	if a.Rate <= 0 {
+		return nil, fmt.Errorf("rate 必须大于 0：%d", a.Rate)
+	}
+	if a.Burst <= 0 {
+		a.Burst = a.Rate
+	}
+	if a.Store == rateLimitStoreRedis && p.redis == nil {
+		return nil, errors.New("store 为 redis 时需要配置 Redis")
+	}
+
+	cp := *p
+	cp.args = a
+	cp.route = strings.ToUpper(method) + " " + path
+	cp.expire = rateLimitExpire
+	if refill := time.Duration(a.Burst) * time.Second / time.Duration(a.Rate); refill > cp.expire {
+		cp.expire = refill
+	}
+	return &cp, nil
+}
+
+func (p *PluginRateLimit) Middleware() rest.Middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			// 未经 ForRoute 创建的插件不限流
+			if p.limiters != nil && len(p.route) > 0 && !p.allow(r) {
+				e := gateway.NewError(codes.ResourceExhausted, p.args.Msg)
+				e.BizCode = p.args.Code
+				e.HttpStatus = p.args.HttpStatus
+				e.Details = append(e.Details, &errdetails.RetryInfo{RetryDelay: durationpb.New(time.Second)})
+				gateway.PluginContextFromRequest(r).Abort(e)
+			}
+
+			next(w, r)
+		}
+	}
+}
+
+// allow 取一个令牌，限流器出错时放行
+// redis 令牌桶所有 key 共用一个限流器，redis 不可用时按本机限流
+// 本机限流器每次使用都刷新过期时间，持续请求的 key 不会因为过期被重新创建为满的令牌桶
+func (p *PluginRateLimit) allow(r *http.Request) bool {
+	key := fmt.Sprintf("%s|%d|%d|%s|%s", p.route, p.args.Rate, p.args.Burst, p.args.Store, p.limitKey(r))
+	if p.args.Store == rateLimitStoreRedis {
+		if allowed, ok := p.redis.allow(r.Context(), rateLimitPrefix+key, p.args.Rate, p.args.Burst); ok {
+			return allowed
+		}
+	}
+
+	v, err := p.limiters.Take(key, func() (any, error) {
+		return rate.NewLimiter(rate.Limit(p.args.Rate), p.args.Burst), nil
+	})
+	if err != nil {
+		return true
+	}
+	p.limiters.SetWithExpire(key, v, p.expire)
+
+	return v.(*rate.Limiter).Allow()
+}
+
+// limitKey 请求的限流 key
+func (p *PluginRateLimit) limitKey(r *http.Request) string {
+	switch p.args.Key {
+	case rateLimitKeyUid:
+		if uid := gateway.PluginContextFromRequest(r).MetadataValue("uid"); len(uid) > 0 && uid != "0" {
+			return "uid:" + uid
+		}
+		return "ip:" + gateway.ClientIP(r)
+	case rateLimitKeyIp:
+		return "ip:" + gateway.ClientIP(r)
+	case rateLimitKeyChannelId:
+		return "channel:" + internal.CommonParam(r, "channel_id")
+	default:
+		return ""
+	}
+}
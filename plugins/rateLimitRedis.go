@@ -0,0 +1,146 @@
+package plugins
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zeromicro/go-zero/core/logx"
+	"github.com/zeromicro/go-zero/core/stores/redis"
+	"github.com/zeromicro/go-zero/core/threading"
+)
+
+// rateLimitPingInterval redis 不可用时检查恢复的间隔
+const rateLimitPingInterval = 100 * time.Millisecond
+
+// rateLimitScript 与 go-zero limit.TokenLimiter 相同的令牌桶，key 由调用方传入，过期时间至少 1 秒
+// KEYS[1] 为令牌数，KEYS[2] 为上次刷新的时间
+var rateLimitScript = redis.NewScript(`local rate = tonumber(ARGV[1])
+local capacity = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local requested = tonumber(ARGV[4])
+local fill_time = capacity/rate
+local ttl = math.max(1, math.floor(fill_time*2))
+local last_tokens = tonumber(redis.call("get", KEYS[1]))
+if last_tokens == nil then
+    last_tokens = capacity
+end
+
+local last_refreshed = tonumber(redis.call("get", KEYS[2]))
+if last_refreshed == nil then
+    last_refreshed = 0
+end
+
+local delta = math.max(0, now-last_refreshed)
+local filled_tokens = math.min(capacity, last_tokens+(delta*rate))
+local allowed = filled_tokens >= requested
+local new_tokens = filled_tokens
+if allowed then
+    new_tokens = filled_tokens - requested
+end
+
+redis.call("setex", KEYS[1], ttl, new_tokens)
+redis.call("setex", KEYS[2], ttl, now)
+
+return allowed`)
+
+// redisLimiter 所有路由和限流 key 共用的 redis 令牌桶
+// redis 出错时标记为不可用，由一个协程检查恢复，不可用期间调用方退化为本机限流
+type redisLimiter struct {
+	store *redis.Redis
+	// down redis 不可用，monitoring 正在检查恢复
+	down       atomic.Bool
+	lock       sync.Mutex
+	monitoring bool
+	done       chan struct{}
+	stopOnce   sync.Once
+}
+
+func newRedisLimiter(store *redis.Redis) *redisLimiter {
+	return &redisLimiter{
+		store: store,
+		done:  make(chan struct{}),
+	}
+}
+
+// allow 从 key 对应的令牌桶取一个令牌，ok 为 false 表示 redis 不可用，需要调用方按本机限流
+func (l *redisLimiter) allow(ctx context.Context, key string, rate, burst int) (allowed, ok bool) {
+	if l.down.Load() {
+		return false, false
+	}
+
+	resp, err := l.store.ScriptRunCtx(ctx, rateLimitScript,
+		[]string{fmt.Sprintf("{%s}.tokens", key), fmt.Sprintf("{%s}.ts", key)},
+		[]string{
+			strconv.Itoa(rate),
+			strconv.Itoa(burst),
+			strconv.FormatInt(time.Now().Unix(), 10),
+			"1",
+		})
+	// 脚本返回 false 时为 nil
+	if err == redis.Nil {
+		return false, true
+	}
+	// 请求已取消或超时，不需要放行
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return false, true
+	}
+	if err != nil {
+		logx.Errorf("redis 限流失败，退化为本机限流：%v", err)
+		l.startMonitor()
+		return false, false
+	}
+
+	code, ok := resp.(int64)
+	if !ok {
+		logx.Errorf("redis 限流返回 %v，退化为本机限流", resp)
+		l.startMonitor()
+		return false, false
+	}
+
+	return code == 1, true
+}
+
+// startMonitor 标记 redis 不可用，同一时间只有一个协程检查恢复
+func (l *redisLimiter) startMonitor() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.monitoring {
+		return
+	}
+	l.monitoring = true
+	l.down.Store(true)
+
+	threading.GoSafe(func() {
+		ticker := time.NewTicker(rateLimitPingInterval)
+		defer func() {
+			ticker.Stop()
+			l.lock.Lock()
+			l.monitoring = false
+			l.lock.Unlock()
+		}()
+
+		for {
+			select {
+			case <-ticker.C:
+				if l.store.Ping() {
+					l.down.Store(false)
+					return
+				}
+			case <-l.done:
+				return
+			}
+		}
+	})
+}
+
+func (l *redisLimiter) stop() {
+	l.stopOnce.Do(func() {
+		close(l.done)
+	})
+}
@@ -0,0 +1,210 @@
+package plugins
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gateway "github.com/punpeo/pun-gateway-lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/zeromicro/go-zero/core/stores/redis"
+)
+
+// fakeRedis 只实现 PING 和 EVALSHA 的 redis
+// 每个 key 只放行 allow 个请求，down 时所有命令返回错误，记录 EVALSHA 的 key
+type fakeRedis struct {
+	addr  string
+	allow int
+
+	lock  sync.Mutex
+	down  bool
+	pings int
+	keys  map[string]int
+}
+
+func newFakeRedis(t *testing.T, allow int) *fakeRedis {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		_ = lis.Close()
+	})
+
+	f := &fakeRedis{addr: lis.Addr().String(), allow: allow, keys: make(map[string]int)}
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+
+	return f
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+
+	rd := bufio.NewReader(conn)
+	for {
+		args, err := readRedisCommand(rd)
+		if err != nil {
+			return
+		}
+
+		f.lock.Lock()
+		var reply string
+		switch cmd := strings.ToUpper(args[0]); {
+		case f.down:
+			reply = "-ERR down\r\n"
+		case cmd == "PING":
+			f.pings++
+			reply = "+PONG\r\n"
+		case cmd == "EVALSHA" && len(args) > 3:
+			f.keys[args[3]]++
+			if f.keys[args[3]] > f.allow {
+				reply = "$-1\r\n"
+			} else {
+				reply = ":1\r\n"
+			}
+		default:
+			reply = "-ERR unknown command\r\n"
+		}
+		f.lock.Unlock()
+
+		if _, err = io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakeRedis) setDown(down bool) {
+	f.lock.Lock()
+	f.down = down
+	f.lock.Unlock()
+}
+
+func (f *fakeRedis) keyCount() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.keys)
+}
+
+// readRedisCommand 读取一条 RESP 数组形式的命令
+func readRedisCommand(rd *bufio.Reader) ([]string, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("unexpected %q", line)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		if line, err = rd.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err = io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+
+	return args, nil
+}
+
+func newTestRedisRateLimit(t *testing.T, f *fakeRedis, args gateway.PluginArgs) *PluginRateLimit {
+	p := NewPluginRateLimit()
+	assert.NoError(t, p.Init(&gateway.GatewayConf{
+		Redis: redis.RedisConf{Host: f.addr, Type: redis.NodeType, NonBlock: true},
+	}))
+	t.Cleanup(p.Stop)
+
+	args["store"] = rateLimitStoreRedis
+	pl, err := p.ForRoute(http.MethodGet, "/users/:id", args)
+	assert.NoError(t, err)
+
+	return pl.(*PluginRateLimit)
+}
+
+// hasLocalLimiter 是否为 limitKey 创建了本机限流器
+func hasLocalLimiter(p *PluginRateLimit, limitKey string) bool {
+	_, ok := p.limiters.Get(fmt.Sprintf("%s|%d|%d|%s|%s", p.route, p.args.Rate, p.args.Burst, p.args.Store, limitKey))
+	return ok
+}
+
+func TestPluginRateLimitRedis(t *testing.T) {
+	f := newFakeRedis(t, 1)
+	p := newTestRedisRateLimit(t, f, gateway.PluginArgs{"rate": 100, "key": "ip"})
+	ip := func(addr string) func(r *http.Request) {
+		return func(r *http.Request) { r.RemoteAddr = addr }
+	}
+
+	// 按 redis 的结果限流，key 随请求传入脚本，不创建本机限流器
+	assert.NoError(t, doRateLimit(p, ip("10.0.0.1:1")))
+	assert.Error(t, doRateLimit(p, ip("10.0.0.1:2")))
+	assert.NoError(t, doRateLimit(p, ip("10.0.0.2:1")))
+	assert.Equal(t, 2, f.keyCount())
+	assert.False(t, hasLocalLimiter(p, "ip:10.0.0.1"))
+}
+
+func TestPluginRateLimitRedisDown(t *testing.T) {
+	f := newFakeRedis(t, 100)
+	p := newTestRedisRateLimit(t, f, gateway.PluginArgs{"rate": 1, "key": "ip"})
+	f.setDown(true)
+
+	// redis 不可用时退化为本机限流，所有 key 共用一个检查恢复的协程
+	for i := 0; i < 10; i++ {
+		addr := fmt.Sprintf("10.0.0.%d:1", i)
+		assert.NoError(t, doRateLimit(p, func(r *http.Request) { r.RemoteAddr = addr }))
+		assert.Error(t, doRateLimit(p, func(r *http.Request) { r.RemoteAddr = addr }))
+	}
+	assert.True(t, p.redis.down.Load())
+	assert.True(t, hasLocalLimiter(p, "ip:10.0.0.9"))
+	assert.Equal(t, 0, f.keyCount())
+
+	// 恢复后重新使用 redis
+	f.setDown(false)
+	assert.Eventually(t, func() bool {
+		return !p.redis.down.Load()
+	}, time.Second, 10*time.Millisecond)
+	assert.NoError(t, doRateLimit(p, func(r *http.Request) { r.RemoteAddr = "10.0.0.1:1" }))
+	assert.Equal(t, 1, f.keyCount())
+	f.lock.Lock()
+	assert.Equal(t, 1, f.pings)
+	f.lock.Unlock()
+}
+
+func TestRedisLimiterStop(t *testing.T) {
+	f := newFakeRedis(t, 100)
+	f.setDown(true)
+	l := newRedisLimiter(redis.MustNewRedis(redis.RedisConf{Host: f.addr, Type: redis.NodeType, NonBlock: true}))
+
+	_, ok := l.allow(context.Background(), "k", 1, 1)
+	assert.False(t, ok)
+	l.stop()
+	assert.Eventually(t, func() bool {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		return !l.monitoring
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,111 @@
+package plugins
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	gateway "github.com/punpeo/pun-gateway-lib"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+)
+
+func newTestRateLimit(t *testing.T, args gateway.PluginArgs) *PluginRateLimit {
+	p := NewPluginRateLimit()
+	assert.NoError(t, p.Init(&gateway.GatewayConf{}))
+
+	pl, err := p.ForRoute(http.MethodGet, "/users/:id", args)
+	assert.NoError(t, err)
+
+	return pl.(*PluginRateLimit)
+}
+
+// doRateLimit 发送一个请求，返回限流的错误
+func doRateLimit(p *PluginRateLimit, setup func(r *http.Request)) error {
+	r := httptest.NewRequest(http.MethodGet, "/users/1", http.NoBody)
+	pc := gateway.NewPluginContext()
+	r = r.WithContext(gateway.ContextWithPluginContext(r.Context(), pc))
+	if setup != nil {
+		setup(r)
+	}
+	p.Middleware()(func(http.ResponseWriter, *http.Request) {})(httptest.NewRecorder(), r)
+
+	return pc.Err()
+}
+
+func TestPluginRateLimitRoute(t *testing.T) {
+	p := newTestRateLimit(t, gateway.PluginArgs{"rate": 1, "burst": 2})
+
+	assert.NoError(t, doRateLimit(p, nil))
+	assert.NoError(t, doRateLimit(p, nil))
+	err := doRateLimit(p, nil)
+	var e *gateway.Error
+	assert.ErrorAs(t, err, &e)
+	assert.Equal(t, codes.ResourceExhausted, e.Code)
+	assert.Equal(t, http.StatusTooManyRequests, e.HttpStatus)
+	assert.Equal(t, "请求过于频繁，请稍后再试", e.Msg)
+	assert.Len(t, e.Details, 1)
+}
+
+func TestPluginRateLimitKey(t *testing.T) {
+	p := newTestRateLimit(t, gateway.PluginArgs{"rate": 1, "key": "ip"})
+	ip := func(addr string) func(r *http.Request) {
+		return func(r *http.Request) { r.RemoteAddr = addr }
+	}
+
+	assert.NoError(t, doRateLimit(p, ip("10.0.0.1:1")))
+	assert.Error(t, doRateLimit(p, ip("10.0.0.1:2")))
+	assert.NoError(t, doRateLimit(p, ip("10.0.0.2:1")))
+
+	// 不受信任的 X-Forwarded-For 不能绕过限流
+	spoof := func(xff string) func(r *http.Request) {
+		return func(r *http.Request) {
+			r.RemoteAddr = "10.0.0.3:1"
+			r.Header.Set("X-Forwarded-For", xff)
+		}
+	}
+	assert.NoError(t, doRateLimit(p, spoof("1.1.1.1")))
+	assert.Error(t, doRateLimit(p, spoof("2.2.2.2")))
+
+	p = newTestRateLimit(t, gateway.PluginArgs{"rate": 1, "key": "uid"})
+	uid := func(id string) func(r *http.Request) {
+		return func(r *http.Request) { gateway.PluginContextFromRequest(r).SetMetadata("uid", id) }
+	}
+	assert.NoError(t, doRateLimit(p, uid("1")))
+	assert.Error(t, doRateLimit(p, uid("1")))
+	assert.NoError(t, doRateLimit(p, uid("2")))
+	assert.Equal(t, []string{"jzAuth"}, p.Requires(nil))
+
+	// channel_id 由客户端传入，同样依赖 jzAuth
+	p = newTestRateLimit(t, gateway.PluginArgs{"rate": 1, "key": "channel_id"})
+	channel := func(id string) func(r *http.Request) {
+		return func(r *http.Request) { r.Header.Set("channel_id", id) }
+	}
+	assert.NoError(t, doRateLimit(p, channel("1")))
+	assert.Error(t, doRateLimit(p, channel("1")))
+	assert.NoError(t, doRateLimit(p, channel("2")))
+	assert.Equal(t, []string{"jzAuth"}, p.Requires(nil))
+}
+
+func TestPluginRateLimitArgs(t *testing.T) {
+	p := NewPluginRateLimit()
+	assert.NoError(t, p.Init(&gateway.GatewayConf{}))
+
+	_, err := p.ForRoute(http.MethodGet, "/", gateway.PluginArgs{"store": "redis"})
+	assert.Error(t, err)
+	_, err = p.ForRoute(http.MethodGet, "/", gateway.PluginArgs{"key": "mobile"})
+	assert.Error(t, err)
+	_, err = p.ForRoute(http.MethodGet, "/", gateway.PluginArgs{"rate": 0})
+	assert.Error(t, err)
+
+	pl, err := p.ForRoute(http.MethodGet, "/", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 100, pl.(*PluginRateLimit).args.Burst)
+	assert.Equal(t, rateLimitExpire, pl.(*PluginRateLimit).expire)
+
+	// 令牌桶从空到满需要 200 秒，过期时间不小于它
+	pl, err = p.ForRoute(http.MethodGet, "/", gateway.PluginArgs{"rate": 1, "burst": 200})
+	assert.NoError(t, err)
+	assert.Equal(t, 200*time.Second, pl.(*PluginRateLimit).expire)
+}
@@ -0,0 +1,48 @@
+package plugins
+
+import (
+	"fmt"
+	"sync"
+
+	gateway "github.com/punpeo/pun-gateway-lib"
+)
+
+var (
+	factoryLock sync.RWMutex
+	factories   = make(map[string]gateway.PluginFactory)
+)
+
+// Register 注册插件的构造函数，内置插件在各自的 init 中注册，同名时 panic
+func Register(name string, factory gateway.PluginFactory) {
+	factoryLock.Lock()
+	defer factoryLock.Unlock()
+
+	if len(name) == 0 || factory == nil {
+		panic("插件名称或构造函数为空")
+	}
+	if _, ok := factories[name]; ok {
+		panic(fmt.Sprintf("已存在同名插件：%s", name))
+	}
+
+	factories[name] = factory
+}
+
+// Factories 已注册的插件构造函数
+func Factories() map[string]gateway.PluginFactory {
+	factoryLock.RLock()
+	defer factoryLock.RUnlock()
+
+	ret := make(map[string]gateway.PluginFactory, len(factories))
+	for name, factory := range factories {
+		ret[name] = factory
+	}
+
+	return ret
+}
+
+// WithFactories 网关按配置从已注册的构造函数创建插件，不需要再逐个调用 Register
+//
+//	gw := gateway.MustNewServer(&c, plugins.WithFactories())
+func WithFactories() gateway.Option {
+	return gateway.WithPluginFactories(Factories())
+}
@@ -0,0 +1,23 @@
+package plugins
+
+import (
+	"testing"
+
+	gateway "github.com/punpeo/pun-gateway-lib"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFactories(t *testing.T) {
+	fs := Factories()
+	for _, name := range []string{"jzAuth", "empty", "custom", "hls", "uriDispatch", "script", "rateLimit"} {
+		assert.Contains(t, fs, name)
+	}
+
+	pl, err := fs["empty"](&gateway.GatewayConf{})
+	assert.NoError(t, err)
+	assert.Equal(t, "empty", pl.Name())
+
+	assert.Panics(t, func() {
+		Register("empty", fs["empty"])
+	})
+}
@@ -0,0 +1,150 @@
+package plugins
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	gateway "github.com/punpeo/pun-gateway-lib"
+	"github.com/zeromicro/go-zero/core/logx"
+	"github.com/zeromicro/go-zero/core/stores/redis"
+	"github.com/zeromicro/go-zero/core/threading"
+)
+
+// revocationList 吊销的用户 ID 和 security_key 指纹，定期从文件和 redis set 重新加载
+type revocationList struct {
+	c     gateway.RevocationConf
+	store *redis.Redis
+	// members 当前的成员，类型为 map[string]struct{}
+	members  atomic.Value
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// newRevocationList 未配置 File 和 RedisKey 时返回 nil，创建时加载一次，失败时返回错误
+func newRevocationList(c *gateway.GatewayConf) (*revocationList, error) {
+	rc := c.Revocation
+	if len(rc.File) == 0 && len(rc.RedisKey) == 0 {
+		return nil, nil
+	}
+
+	rl := &revocationList{
+		c:    rc,
+		done: make(chan struct{}),
+	}
+	if len(rc.RedisKey) > 0 {
+		if len(c.Redis.Host) == 0 {
+			return nil, errors.New("Revocation.RedisKey 需要配置 Redis")
+		}
+		store, err := redis.NewRedis(c.Redis)
+		if err != nil {
+			return nil, err
+		}
+		rl.store = store
+	}
+
+	if err := rl.load(); err != nil {
+		return nil, err
+	}
+
+	return rl, nil
+}
+
+// start 定期重新加载，加载失败时保留上次的成员
+func (rl *revocationList) start() {
+	if rl.c.Interval <= 0 {
+		return
+	}
+
+	threading.GoSafe(func() {
+		ticker := time.NewTicker(rl.c.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := rl.load(); err != nil {
+					logx.Errorf("加载吊销列表失败：%v", err)
+				}
+			case <-rl.done:
+				return
+			}
+		}
+	})
+}
+
+func (rl *revocationList) stop() {
+	rl.stopOnce.Do(func() {
+		close(rl.done)
+	})
+}
+
+func (rl *revocationList) load() error {
+	members := make(map[string]struct{})
+	if len(rl.c.File) > 0 {
+		content, err := os.ReadFile(rl.c.File)
+		if err != nil {
+			return err
+		}
+		for _, m := range parseRevocationFile(content) {
+			members[m] = struct{}{}
+		}
+	}
+
+	if rl.store != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		vals, err := rl.store.SmembersCtx(ctx, rl.c.RedisKey)
+		if err != nil {
+			return err
+		}
+		for _, v := range vals {
+			if v = strings.TrimSpace(v); len(v) > 0 {
+				members[v] = struct{}{}
+			}
+		}
+	}
+
+	rl.members.Store(members)
+	return nil
+}
+
+// Revoked uid 或 security_key 的指纹是否已吊销，rl 为 nil 时都未吊销
+func (rl *revocationList) Revoked(keys ...string) bool {
+	if rl == nil {
+		return false
+	}
+
+	members, _ := rl.members.Load().(map[string]struct{})
+	for _, k := range keys {
+		if len(k) == 0 {
+			continue
+		}
+		if _, ok := members[k]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseRevocationFile 每行一个成员，忽略空行和 # 开头的注释
+func parseRevocationFile(content []byte) []string {
+	var members []string
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		members = append(members, line)
+	}
+
+	return members
+}
@@ -0,0 +1,68 @@
+package plugins
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	gateway "github.com/punpeo/pun-gateway-lib"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSecurityKeyData(t *testing.T) {
+	info, err := parseSecurityKeyData("user_id=123&expire_time=1700000000")
+	assert.NoError(t, err)
+	assert.Equal(t, "123", info.UserId)
+	assert.Equal(t, int64(1700000000), info.ExpireTime.Unix())
+	assert.Len(t, info.Fingerprint, 64)
+
+	// 毫秒
+	info, err = parseSecurityKeyData("user_id=123&expire_time=1700000000000")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1700000000), info.ExpireTime.Unix())
+
+	_, err = parseSecurityKeyData("user_id=123")
+	assert.Error(t, err)
+	_, err = parseSecurityKeyData("user_id=123&expire_time=abc")
+	assert.Error(t, err)
+}
+
+func TestSecurityKeyExpired(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	info := &SecurityKey{ExpireTime: now.Add(-30 * time.Second)}
+	assert.True(t, info.Expired(now, 0))
+	assert.False(t, info.Expired(now, time.Minute))
+	assert.False(t, (&SecurityKey{ExpireTime: now.Add(time.Second)}).Expired(now, 0))
+}
+
+func TestRevocationListFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "revoked.txt")
+	assert.NoError(t, os.WriteFile(file, []byte("# 泄露的账号\n123\n\n  abcdef  \n"), 0o644))
+
+	rl, err := newRevocationList(&gateway.GatewayConf{Revocation: gateway.RevocationConf{File: file}})
+	assert.NoError(t, err)
+	assert.True(t, rl.Revoked("123"))
+	assert.True(t, rl.Revoked("456", "abcdef"))
+	assert.False(t, rl.Revoked("456", ""))
+	assert.False(t, rl.Revoked("# 泄露的账号"))
+
+	assert.NoError(t, os.WriteFile(file, []byte("456\n"), 0o644))
+	assert.NoError(t, rl.load())
+	assert.False(t, rl.Revoked("123"))
+	assert.True(t, rl.Revoked("456"))
+
+	assert.NoError(t, os.Remove(file))
+	assert.Error(t, rl.load())
+	assert.True(t, rl.Revoked("456"))
+}
+
+func TestNewRevocationList(t *testing.T) {
+	rl, err := newRevocationList(&gateway.GatewayConf{})
+	assert.NoError(t, err)
+	assert.Nil(t, rl)
+	assert.False(t, rl.Revoked("123"))
+
+	_, err = newRevocationList(&gateway.GatewayConf{Revocation: gateway.RevocationConf{RedisKey: "gateway:revoked"}})
+	assert.Error(t, err)
+}
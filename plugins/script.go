@@ -0,0 +1,464 @@
+package plugins
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+
+	gateway "github.com/punpeo/pun-gateway-lib"
+	"github.com/punpeo/pun-gateway-lib/internal"
+	"github.com/zeromicro/go-zero/core/conf"
+	"github.com/zeromicro/go-zero/core/logx"
+	"github.com/zeromicro/go-zero/rest"
+	"google.golang.org/grpc/metadata"
+)
+
+// ScriptConf 脚本插件的定义，值为 text/template 模板，可以在路由参数中配置，也可以从 File 加载
+type ScriptConf struct {
+	// File 从 yaml 或 json 文件加载定义，配置后忽略其它项
+	File string `json:",optional"`
+	// Priority 在阶段内的优先级，脚本插件属于 PhaseTransform 阶段
+	Priority int `json:",optional"`
+	// Request 在 Middleware 中处理请求
+	Request ScriptRequest `json:",optional"`
+	// Metadata 在 OnSendHeaders 中设置发送给 rpc 的 metadata，模板结果为空时不设置
+	Metadata map[string]string `json:",optional"`
+	// Response 在 OnReceiveResponse 中处理响应
+	Response ScriptResponse `json:",optional"`
+}
+
+// ScriptRequest 请求的处理
+type ScriptRequest struct {
+	// Headers 设置请求头，模板结果为空时删除
+	Headers map[string]string `json:",optional"`
+	// Abort 模板结果不为空时中止请求，结果作为错误信息
+	Abort string `json:",optional"`
+	// AbortCode 中止请求的 gRPC 状态码
+	AbortCode string `json:",default=PermissionDenied"`
+}
+
+// ScriptResponse 响应的处理，按 Rename、Delete、Set、Body 的顺序改写响应体
+type ScriptResponse struct {
+	// Status HTTP 状态码，模板结果为空或不是有效的状态码时不设置
+	Status string `json:",optional"`
+	// Headers 设置响应头，模板结果为空时不设置
+	Headers map[string]string `json:",optional"`
+	// Rename 重命名字段，key 和 value 为点分隔的路径，如 data.user_name: data.name
+	Rename map[string]string `json:",optional"`
+	// Delete 删除字段
+	Delete []string `json:",optional"`
+	// Set 设置字段，模板结果是 JSON 时按 JSON 设置，否则为字符串
+	Set map[string]string `json:",optional"`
+	// Body 输出整个响应体，配置后忽略响应体原有的内容
+	Body string `json:",optional"`
+}
+
+// PluginScript 脚本插件，未配置路由参数时不做任何处理
+type PluginScript struct {
+	gateway.BasicContextRpcHandler
+
+	priority int
+	request  *scriptRequest
+	metadata map[string]*template.Template
+	response *scriptResponse
+}
+
+type scriptRequest struct {
+	headers   map[string]*template.Template
+	abort     *template.Template
+	abortCode string
+}
+
+type scriptResponse struct {
+	status  *template.Template
+	headers map[string]*template.Template
+	rename  map[string]string
+	delete  []string
+	set     map[string]*template.Template
+	body    *template.Template
+}
+
+// scriptData 模板的数据
+type scriptData struct {
+	// Request 请求，只在 Request 和 Metadata 中可用
+	Request *http.Request
+	// Header 请求头
+	Header http.Header
+	// Query query 参数
+	Query url.Values
+	// Metadata Metadata 中为发送给 rpc 的 metadata，Response 中为 rpc 的响应头
+	Metadata metadata.MD
+	// Body 解码后的响应体，只在 Response 中可用
+	Body interface{}
+	// Ctx 本次请求的 PluginContext
+	Ctx *gateway.PluginContext
+}
+
+// Meta 获取 metadata 的第一个值
+func (d *scriptData) Meta(key string) string {
+	if vals := d.Metadata.Get(key); len(vals) > 0 {
+		return vals[0]
+	}
+
+	return ""
+}
+
+// Value 获取 PluginContext 中的字符串值
+func (d *scriptData) Value(key string) string {
+	return d.Ctx.GetString(key)
+}
+
+// Get 按点分隔的路径获取响应体的字段
+func (d *scriptData) Get(path string) interface{} {
+	val, _ := jsonPathGet(d.Body, path)
+	return val
+}
+
+var scriptFuncs = template.FuncMap{
+	"toJson": func(v interface{}) (string, error) {
+		bs, err := json.Marshal(v)
+		return string(bs), err
+	},
+	"default": func(def, v interface{}) interface{} {
+		if v == nil || v == "" {
+			return def
+		}
+		return v
+	},
+	"lower":     strings.ToLower,
+	"upper":     strings.ToUpper,
+	"trim":      strings.TrimSpace,
+	"contains":  strings.Contains,
+	"hasPrefix": strings.HasPrefix,
+	"replace":   strings.ReplaceAll,
+}
+
+func init() {
+	Register("script", func(*gateway.GatewayConf) (gateway.Plugin, error) {
+		return NewPluginScript(), nil
+	})
+}
+
+func NewPluginScript() *PluginScript {
+	return &PluginScript{}
+}
+
+func (p *PluginScript) Name() string {
+	return "script"
+}
+
+func (p *PluginScript) Priority() int {
+	return p.priority
+}
+
+// ForRoute 按路由参数编译脚本，配置热更新时重新读取 File
+func (p *PluginScript) ForRoute(_, _ string, args gateway.PluginArgs) (gateway.Plugin, error) {
+	if len(args) == 0 {
+		return p, nil
+	}
+
+	var c ScriptConf
+	if err := args.Unmarshal(&c); err != nil {
+		return nil, err
+	}
+	if len(c.File) > 0 {
+		file := c.File
+		c = ScriptConf{}
+		if err := conf.Load(file, &c); err != nil {
+			return nil, fmt.Errorf("加载脚本 %s 失败：%w", file, err)
+		}
+	}
+
+	return newPluginScript(c)
+}
+
+func newPluginScript(c ScriptConf) (*PluginScript, error) {
+	p := &PluginScript{priority: c.Priority}
+
+	var err error
+	if !isEmptyScriptRequest(c.Request) {
+		if _, err = internal.ParseCode(c.Request.AbortCode); err != nil {
+			return nil, err
+		}
+		p.request = &scriptRequest{abortCode: c.Request.AbortCode}
+		if p.request.headers, err = parseTemplates("request.headers", c.Request.Headers); err != nil {
+			return nil, err
+		}
+		if p.request.abort, err = parseTemplate("request.abort", c.Request.Abort); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.metadata, err = parseTemplates("metadata", c.Metadata); err != nil {
+		return nil, err
+	}
+
+	resp := c.Response
+	if len(resp.Status) > 0 || len(resp.Headers) > 0 || len(resp.Rename) > 0 ||
+		len(resp.Delete) > 0 || len(resp.Set) > 0 || len(resp.Body) > 0 {
+		p.response = &scriptResponse{rename: resp.Rename, delete: resp.Delete}
+		if p.response.status, err = parseTemplate("response.status", resp.Status); err != nil {
+			return nil, err
+		}
+		if p.response.headers, err = parseTemplates("response.headers", resp.Headers); err != nil {
+			return nil, err
+		}
+		if p.response.set, err = parseTemplates("response.set", resp.Set); err != nil {
+			return nil, err
+		}
+		if p.response.body, err = parseTemplate("response.body", resp.Body); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+func isEmptyScriptRequest(r ScriptRequest) bool {
+	return len(r.Headers) == 0 && len(r.Abort) == 0
+}
+
+// CheckOutput response.status 和 response.headers 只能用于直接写出响应的一元路由
+func (p *PluginScript) CheckOutput(out gateway.RouteOutput) error {
+	if p.response == nil || (p.response.status == nil && len(p.response.headers) == 0) {
+		return nil
+	}
+
+	return checkRawOutput(out, "设置 response.status 和 response.headers")
+}
+
+// checkRawOutput 在 OnReceiveResponse 中设置响应头或状态码的插件不能用于以下路由：
+// 配置了 Formatter 的路由由 Formatter 写入状态码，WebSocket 路由的连接已升级，服务端流路由在插件之前已写出响应头
+func checkRawOutput(out gateway.RouteOutput, what string) error {
+	switch {
+	case out.Formatted:
+		return fmt.Errorf("配置了 formatter 的路由不能%s", what)
+	case out.WebSocket:
+		return fmt.Errorf("websocket 路由不能%s", what)
+	case out.Stream:
+		return fmt.Errorf("服务端流路由不能%s", what)
+	}
+
+	return nil
+}
+
+func (p *PluginScript) Middleware() rest.Middleware {
+	if p.request == nil {
+		return nil
+	}
+
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			pc := gateway.PluginContextFromRequest(r)
+			data := &scriptData{Request: r, Header: r.Header, Query: r.URL.Query(), Ctx: pc}
+			for k, tpl := range p.request.headers {
+				if val := execTemplate(tpl, data); len(val) > 0 {
+					r.Header.Set(k, val)
+				} else {
+					r.Header.Del(k)
+				}
+			}
+
+			if p.request.abort != nil {
+				if msg := execTemplate(p.request.abort, data); len(msg) > 0 {
+					// abortCode 在 ForRoute 中已检查
+					code, _ := internal.ParseCode(p.request.abortCode)
+					pc.Abort(gateway.NewError(code, msg))
+				}
+			}
+
+			next(w, r)
+		}
+	}
+}
+
+func (p *PluginScript) OnSendHeaders(pc *gateway.PluginContext, r *http.Request, md metadata.MD) metadata.MD {
+	if len(p.metadata) == 0 {
+		return md
+	}
+
+	data := &scriptData{Request: r, Header: r.Header, Query: r.URL.Query(), Metadata: md, Ctx: pc}
+	for k, tpl := range p.metadata {
+		if val := execTemplate(tpl, data); len(val) > 0 {
+			md.Set(k, val)
+		}
+	}
+
+	return md
+}
+
+func (p *PluginScript) OnReceiveResponse(pc *gateway.PluginContext, respJson string, md metadata.MD, w http.ResponseWriter) string {
+	resp := p.response
+	if resp == nil {
+		return respJson
+	}
+
+	data := &scriptData{Metadata: md, Ctx: pc}
+	if len(respJson) > 0 {
+		dec := json.NewDecoder(strings.NewReader(respJson))
+		dec.UseNumber()
+		if err := dec.Decode(&data.Body); err != nil {
+			logx.Errorf("脚本插件解析响应失败：%v", err)
+			return respJson
+		}
+	}
+
+	for old, name := range resp.rename {
+		if val, ok := jsonPathGet(data.Body, old); ok {
+			jsonPathDelete(data.Body, old)
+			jsonPathSet(data.Body, name, val)
+		}
+	}
+	for _, path := range resp.delete {
+		jsonPathDelete(data.Body, path)
+	}
+	for path, tpl := range resp.set {
+		jsonPathSet(data.Body, path, scriptValue(execTemplate(tpl, data)))
+	}
+
+	out := respJson
+	if resp.body != nil {
+		out = execTemplate(resp.body, data)
+	} else if len(resp.rename) > 0 || len(resp.delete) > 0 || len(resp.set) > 0 {
+		bs, err := json.Marshal(data.Body)
+		if err != nil {
+			logx.Errorf("脚本插件输出响应失败：%v", err)
+			return respJson
+		}
+		out = string(bs)
+	}
+
+	// 响应头需要在写入状态码之前设置
+	for k, tpl := range resp.headers {
+		if val := execTemplate(tpl, data); len(val) > 0 {
+			w.Header().Set(k, val)
+		}
+	}
+	if resp.status != nil {
+		code, err := strconv.Atoi(execTemplate(resp.status, data))
+		if err == nil && http.StatusText(code) != "" {
+			w.WriteHeader(code)
+		}
+	}
+
+	return out
+}
+
+func parseTemplate(name, text string) (*template.Template, error) {
+	if len(text) == 0 {
+		return nil, nil
+	}
+
+	tpl, err := template.New(name).Funcs(scriptFuncs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("脚本 %s 有误：%w", name, err)
+	}
+
+	return tpl, nil
+}
+
+func parseTemplates(name string, texts map[string]string) (map[string]*template.Template, error) {
+	if len(texts) == 0 {
+		return nil, nil
+	}
+
+	tpls := make(map[string]*template.Template, len(texts))
+	for k, text := range texts {
+		tpl, err := parseTemplate(name+"."+k, text)
+		if err != nil {
+			return nil, err
+		}
+		if tpl != nil {
+			tpls[k] = tpl
+		}
+	}
+
+	return tpls, nil
+}
+
+// execTemplate 执行模板，出错时记录日志并返回空串
+func execTemplate(tpl *template.Template, data *scriptData) string {
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, data); err != nil {
+		logx.Errorf("脚本 %s 执行失败：%v", tpl.Name(), err)
+		return ""
+	}
+
+	return strings.TrimSpace(buf.String())
+}
+
+// scriptValue 模板结果是 JSON 时按 JSON 解析，否则为字符串
+func scriptValue(s string) interface{} {
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil || dec.More() {
+		return s
+	}
+
+	return v
+}
+
+var errJsonPath = errors.New("路径不存在")
+
+// jsonPathParent 找到路径的上一级对象和最后一段 key
+func jsonPathParent(v interface{}, path string, create bool) (map[string]interface{}, string, error) {
+	keys := strings.Split(path, ".")
+	for _, key := range keys[:len(keys)-1] {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			next, ok := node[key]
+			if !ok || next == nil {
+				if !create {
+					return nil, "", errJsonPath
+				}
+				next = map[string]interface{}{}
+				node[key] = next
+			}
+			v = next
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, "", errJsonPath
+			}
+			v = node[i]
+		default:
+			return nil, "", errJsonPath
+		}
+	}
+
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, "", errJsonPath
+	}
+
+	return obj, keys[len(keys)-1], nil
+}
+
+func jsonPathGet(v interface{}, path string) (interface{}, bool) {
+	obj, key, err := jsonPathParent(v, path, false)
+	if err != nil {
+		return nil, false
+	}
+
+	val, ok := obj[key]
+	return val, ok
+}
+
+func jsonPathDelete(v interface{}, path string) {
+	if obj, key, err := jsonPathParent(v, path, false); err == nil {
+		delete(obj, key)
+	}
+}
+
+func jsonPathSet(v interface{}, path string, val interface{}) {
+	if obj, key, err := jsonPathParent(v, path, true); err == nil {
+		obj[key] = val
+	}
+}
@@ -0,0 +1,224 @@
+package plugins
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	gateway "github.com/punpeo/pun-gateway-lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/zeromicro/go-zero/rest"
+	"github.com/zeromicro/go-zero/zrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+)
+
+func newTestScript(t *testing.T, args gateway.PluginArgs) *PluginScript {
+	pl, err := NewPluginScript().ForRoute(http.MethodGet, "/users/:id", args)
+	assert.NoError(t, err)
+
+	return pl.(*PluginScript)
+}
+
+func TestPluginScriptResponse(t *testing.T) {
+	p := newTestScript(t, gateway.PluginArgs{
+		"response": map[string]interface{}{
+			"status":  `{{ .Meta "x-http-status" }}`,
+			"headers": map[string]interface{}{"X-Uid": `{{ .Value "uid" }}`},
+			"rename":  map[string]interface{}{"data.user_name": "data.name"},
+			"delete":  []interface{}{"data.mobile"},
+			"set": map[string]interface{}{
+				"data.level": `{{ .Get "data.score" }}`,
+				"data.tag":   `{{ upper (.Get "data.name") }}`,
+			},
+		},
+	})
+
+	pc := gateway.NewPluginContext()
+	pc.Set("uid", "10")
+	w := httptest.NewRecorder()
+	md := metadata.Pairs("x-http-status", "201")
+	out := p.OnReceiveResponse(pc, `{"code":1000,"data":{"user_name":"tom","mobile":"13800000000","score":12}}`, md, w)
+
+	assert.JSONEq(t, `{"code":1000,"data":{"name":"tom","score":12,"level":12,"tag":"TOM"}}`, out)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "10", w.Header().Get("X-Uid"))
+}
+
+func TestPluginScriptBody(t *testing.T) {
+	p := newTestScript(t, gateway.PluginArgs{
+		"response": map[string]interface{}{
+			"body": `{"items":{{ toJson (.Get "list") }}}`,
+		},
+	})
+
+	out := p.OnReceiveResponse(gateway.NewPluginContext(), `{"list":[1,2]}`, metadata.MD{}, httptest.NewRecorder())
+	assert.JSONEq(t, `{"items":[1,2]}`, out)
+}
+
+func TestPluginScriptRequest(t *testing.T) {
+	p := newTestScript(t, gateway.PluginArgs{
+		"request": map[string]interface{}{
+			"headers": map[string]interface{}{"X-Caller": `{{ .Query.Get "caller" }}`},
+			"abort":   `{{ if not (.Header.Get "X-Token") }}缺少 token{{ end }}`,
+		},
+		"metadata": map[string]interface{}{"caller": `{{ .Header.Get "X-Caller" }}`},
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/users/1?caller=php", http.NoBody)
+	pc := gateway.NewPluginContext()
+	r = r.WithContext(gateway.ContextWithPluginContext(r.Context(), pc))
+	var called bool
+	p.Middleware()(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})(httptest.NewRecorder(), r)
+
+	assert.True(t, called)
+	assert.Equal(t, "php", r.Header.Get("X-Caller"))
+	var e *gateway.Error
+	assert.ErrorAs(t, pc.Err(), &e)
+	assert.Equal(t, codes.PermissionDenied, e.Code)
+	assert.Equal(t, "缺少 token", e.Msg)
+
+	md := p.OnSendHeaders(pc, r, metadata.MD{})
+	assert.Equal(t, []string{"php"}, md.Get("caller"))
+}
+
+func TestPluginScriptFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "script.yaml")
+	assert.NoError(t, os.WriteFile(file, []byte("priority: 5\nresponse:\n  delete: [secret]\n"), 0o644))
+
+	p := newTestScript(t, gateway.PluginArgs{"file": file})
+	assert.Equal(t, 5, p.Priority())
+	out := p.OnReceiveResponse(gateway.NewPluginContext(), `{"secret":"x","id":1}`, metadata.MD{}, httptest.NewRecorder())
+	assert.JSONEq(t, `{"id":1}`, out)
+}
+
+func TestPluginScriptError(t *testing.T) {
+	_, err := NewPluginScript().ForRoute(http.MethodGet, "/", gateway.PluginArgs{
+		"response": map[string]interface{}{"body": "{{ .Get }"},
+	})
+	assert.Error(t, err)
+
+	_, err = NewPluginScript().ForRoute(http.MethodGet, "/", gateway.PluginArgs{
+		"request": map[string]interface{}{"abort": "x", "abortCode": "Nope"},
+	})
+	assert.Error(t, err)
+
+	p, err := NewPluginScript().ForRoute(http.MethodGet, "/", nil)
+	assert.NoError(t, err)
+	assert.Nil(t, p.Middleware())
+}
+
+func TestPluginScriptCheckOutput(t *testing.T) {
+	p := newTestScript(t, gateway.PluginArgs{
+		"response": map[string]interface{}{"delete": []interface{}{"secret"}},
+	})
+	assert.NoError(t, p.CheckOutput(gateway.RouteOutput{Formatted: true}))
+	assert.NoError(t, p.CheckOutput(gateway.RouteOutput{WebSocket: true}))
+
+	p = newTestScript(t, gateway.PluginArgs{
+		"response": map[string]interface{}{"headers": map[string]interface{}{"X-Uid": "1"}},
+	})
+	assert.NoError(t, p.CheckOutput(gateway.RouteOutput{}))
+	assert.Error(t, p.CheckOutput(gateway.RouteOutput{Formatted: true}))
+	assert.Error(t, p.CheckOutput(gateway.RouteOutput{WebSocket: true}))
+	assert.Error(t, p.CheckOutput(gateway.RouteOutput{Stream: true}))
+
+	p = newTestScript(t, gateway.PluginArgs{
+		"response": map[string]interface{}{"status": "201"},
+	})
+	assert.Error(t, p.CheckOutput(gateway.RouteOutput{Formatted: true}))
+}
+
+// newScriptGateway 启动提供 grpc.health.v1.Health 和反射服务的上游，按 mapping 创建使用脚本插件的网关
+func newScriptGateway(t *testing.T, formatter string, mapping gateway.RouteMapping) (*gateway.Server, error) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	svr := grpc.NewServer()
+	hs := health.NewServer()
+	healthpb.RegisterHealthServer(svr, hs)
+	reflection.Register(svr)
+	go func() {
+		_ = svr.Serve(lis)
+	}()
+	t.Cleanup(func() {
+		hs.Shutdown()
+		svr.Stop()
+	})
+
+	c := &gateway.GatewayConf{
+		RestConf:  rest.RestConf{Host: "127.0.0.1", Timeout: 3000},
+		Formatter: formatter,
+		Upstreams: []gateway.Upstream{{
+			Grpc:     zrpc.RpcClientConf{Target: lis.Addr().String()},
+			Mappings: []gateway.RouteMapping{mapping},
+		}},
+	}
+	gw := gateway.MustNewServer(c, WithFactories())
+
+	return gw, gw.Reload(c)
+}
+
+func TestPluginScriptChain(t *testing.T) {
+	script := gateway.PluginConf{
+		Name: "script",
+		Args: gateway.PluginArgs{
+			"request": map[string]interface{}{
+				"abort": `{{ if not (.Header.Get "X-Token") }}缺少 token{{ end }}`,
+			},
+			"response": map[string]interface{}{
+				"status":  "202",
+				"headers": map[string]interface{}{"X-Status": `{{ .Get "status" }}`},
+				"set":     map[string]interface{}{"checked": "true"},
+			},
+		},
+	}
+	gw, err := newScriptGateway(t, "", gateway.RouteMapping{
+		Method:      http.MethodGet,
+		Path:        "/health",
+		RpcPath:     "grpc.health.v1.Health/Check",
+		PluginConfs: []gateway.PluginConf{script},
+	})
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/health", http.NoBody)
+	r.Header.Set("X-Token", "t")
+	gw.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Equal(t, "SERVING", w.Header().Get("X-Status"))
+	assert.JSONEq(t, `{"status":"SERVING","checked":true}`, w.Body.String())
+
+	// 中止后不再调用 rpc
+	w = httptest.NewRecorder()
+	gw.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", http.NoBody))
+	assert.JSONEq(t, `{"code":1001,"msg":"缺少 token","data":null}`, w.Body.String())
+	assert.Empty(t, w.Header().Get("X-Status"))
+
+	// 配置了 Formatter 的路由和服务端流路由不能设置响应状态码和响应头
+	_, err = newScriptGateway(t, gateway.FormatterRaw, gateway.RouteMapping{
+		Method:      http.MethodGet,
+		Path:        "/health",
+		RpcPath:     "grpc.health.v1.Health/Check",
+		PluginConfs: []gateway.PluginConf{script},
+	})
+	assert.ErrorContains(t, err, "formatter")
+
+	_, err = newScriptGateway(t, "", gateway.RouteMapping{
+		Method:      http.MethodGet,
+		Path:        "/health/watch",
+		RpcPath:     "grpc.health.v1.Health/Watch",
+		Stream:      "ndjson",
+		PluginConfs: []gateway.PluginConf{script},
+	})
+	assert.ErrorContains(t, err, "服务端流")
+}
@@ -16,11 +16,22 @@ type PluginUriDispatch struct {
 
 	gw     *gateway.Server
 	config *gateway.GatewayConf
+	// route 由路由参数构造的路由配置，未配置参数时为 nil，从 UpstreamsRouteMap 查找
+	route *gateway.RouteMapping
+	// dispatcher 请求 php 的客户端和灰度用户的缓存，ForRoute 创建的插件共用
+	dispatcher *uridispatch.Dispatcher
+}
+
+func init() {
+	Register("uriDispatch", func(c *gateway.GatewayConf) (gateway.Plugin, error) {
+		return NewPluginUriDispatch(c), nil
+	})
 }
 
 func NewPluginUriDispatch(config *gateway.GatewayConf) *PluginUriDispatch {
 	return &PluginUriDispatch{
-		config: config,
+		config:     config,
+		dispatcher: uridispatch.NewDispatcher(),
 	}
 }
 
@@ -28,12 +39,60 @@ func (p *PluginUriDispatch) Name() string {
 	return "uriDispatch"
 }
 
+func (p *PluginUriDispatch) Phase() gateway.PluginPhase {
+	return gateway.PhaseDispatch
+}
+
+// Requires 灰度调度且按用户灰度时依赖 jzAuth 写入的 uid
+func (p *PluginUriDispatch) Requires(rm *gateway.RouteMapping) []string {
+	route := p.route
+	if route == nil {
+		route = rm
+	}
+
+	dispatch := route.UriDispatch
+	switch dispatch.DispatchRule {
+	case 1, 4, 5:
+		if dispatch.GrayScheme == 1 || dispatch.GrayScheme == 2 {
+			return []string{"jzAuth"}
+		}
+	}
+
+	return nil
+}
+
+// ForRoute 按路由参数创建插件，参数与 RouteMapping.UriDispatch 相同，如 - name: uriDispatch, args: {dispatchRule: 3, directHost: ...}
+func (p *PluginUriDispatch) ForRoute(method, path string, args gateway.PluginArgs) (gateway.Plugin, error) {
+	if len(args) == 0 {
+		return p, nil
+	}
+
+	route := &gateway.RouteMapping{Method: strings.ToLower(method), Path: path}
+	if err := args.Unmarshal(&route.UriDispatch); err != nil {
+		return nil, err
+	}
+
+	cp := *p
+	cp.route = route
+	return &cp, nil
+}
+
+// Stop 网关停止时关闭 php 请求的连接
+func (p *PluginUriDispatch) Stop() {
+	p.dispatcher.Close()
+}
+
 func (p *PluginUriDispatch) Middleware() rest.Middleware {
 	hdl := func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			uri := strings.Split(r.RequestURI, "?")[0]
-			uri = strings.Replace(uri, "//", "/", 1)
-			routeConfigMap, ok := p.config.UpstreamsRouteMap[strings.ToLower(r.Method)]
+			config := gateway.RequestConfig(r, p.config)
+			if p.route != nil {
+				p.dispatcher.NewUriDispatch(*p.route, config.Mode).Handler(w, r, next)
+				return
+			}
+
+			uri := gateway.RoutePath(r)
+			routeConfigMap, ok := config.UpstreamsRouteMap[strings.ToLower(r.Method)]
 			if !ok {
 				err := fmt.Errorf(fmt.Sprintf("route mapping http request method empty：%s | %s", r.RequestURI, r.Method))
 				httpx.WriteJson(w, http.StatusOK, &result.ResponseSuccessBean{Msg: err.Error(), Data: nil})
@@ -45,8 +104,7 @@ func (p *PluginUriDispatch) Middleware() rest.Middleware {
 				httpx.WriteJson(w, http.StatusOK, &result.ResponseSuccessBean{Msg: err.Error(), Data: nil})
 				return
 			}
-			uridispatch.Mode = p.config.Mode
-			uridispatch.NewUriDispatch(routeConfig).Handler(w, r, next)
+			p.dispatcher.NewUriDispatch(routeConfig, config.Mode).Handler(w, r, next)
 		})
 	}
 
@@ -1,13 +1,13 @@
 package uridispatch
 
 import (
-	"context"
 	"errors"
 	"fmt"
 	"github.com/go-resty/resty/v2"
 	"github.com/google/go-cmp/cmp"
 	json "github.com/json-iterator/go"
 	gateway "github.com/punpeo/pun-gateway-lib"
+	"github.com/punpeo/pun-gateway-lib/internal"
 	"github.com/punpeo/punpeo-lib/rest/restyclient"
 	"github.com/punpeo/punpeo-lib/rest/result"
 	"github.com/punpeo/punpeo-lib/rest/xerr"
@@ -17,7 +17,6 @@ import (
 	"github.com/zeromicro/go-zero/core/threading"
 	"github.com/zeromicro/go-zero/rest/httpx"
 	"io/ioutil"
-	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -34,17 +33,69 @@ type IUriProcessor interface {
 type UriDispatch struct {
 	RouteConfig  gateway.RouteMapping
 	UriProcessor IUriProcessor
+
+	d *Dispatcher
+	// mode 本次请求的运行环境，pro 时不发送接口不一致的通知
+	mode string
 }
 
-var Mode string
+// Dispatcher 调度的共享状态，包括请求 php 的客户端和灰度用户的缓存，由插件持有，Close 后不再使用
+type Dispatcher struct {
+	client    *resty.Client
+	grayUsers sync.Map
+}
 
-var grayUserMap sync.Map
+func NewDispatcher() *Dispatcher {
+	return &Dispatcher{
+		client: resty.New().SetTimeout(8 * time.Second),
+	}
+}
 
-func NewUriDispatch(routeConfig gateway.RouteMapping) *UriDispatch {
+// NewUriDispatch 按路由配置创建一次请求的调度，mode 为网关配置的 Mode
+func (d *Dispatcher) NewUriDispatch(routeConfig gateway.RouteMapping, mode string) *UriDispatch {
 	return &UriDispatch{
 		RouteConfig: routeConfig,
+		d:           d,
+		mode:        mode,
 	}
 }
+
+// Mode 运行环境
+// Deprecated: 使用 Dispatcher.NewUriDispatch 的 mode 参数，只对 NewUriDispatch 和未设置 Mode 的 ReserveServer 生效
+var Mode string
+
+// defaultDispatcher NewUriDispatch 使用的调度，与 NewHttpClient 共用请求 php 的客户端
+var defaultDispatcher = &Dispatcher{client: NewHttpClient()}
+
+// NewUriDispatch 按路由配置创建一次请求的调度，使用包级别的 Mode
+// Deprecated: 使用 NewDispatcher 创建调度，再调用 Dispatcher.NewUriDispatch
+func NewUriDispatch(routeConfig gateway.RouteMapping) *UriDispatch {
+	return defaultDispatcher.NewUriDispatch(routeConfig, Mode)
+}
+
+var (
+	client *resty.Client
+	once   sync.Once
+)
+
+// NewHttpClient 包级别共用的请求 php 的客户端
+// Deprecated: 使用 NewDispatcher，每个 Dispatcher 持有自己的客户端
+func NewHttpClient() *resty.Client {
+	once.Do(func() {
+		client = resty.New().SetTimeout(8 * time.Second)
+	})
+
+	return client
+}
+
+// Close 关闭 php 请求的空闲连接，清空灰度用户的缓存
+func (d *Dispatcher) Close() {
+	d.client.GetClient().CloseIdleConnections()
+	d.grayUsers.Range(func(key, _ any) bool {
+		d.grayUsers.Delete(key)
+		return true
+	})
+}
 func (h *UriDispatch) SetDispatchHandler(d IUriProcessor) {
 	h.UriProcessor = d
 }
@@ -59,19 +110,19 @@ func (h *UriDispatch) Handler(w http.ResponseWriter, r *http.Request, next http.
 		if isGray {
 			h.SetDispatchHandler(NewDirectGoServer())
 		} else {
-			h.SetDispatchHandler(NewDirectPhpSource(h.RouteConfig.UriDispatch.DirectHost, h.RouteConfig.UriDispatch.DirectPath))
+			h.SetDispatchHandler(h.newDirectPhpServer())
 		}
 	case 2: // 2-兜底双请求校验
-		h.SetDispatchHandler(NewReserveServer(NewDirectGoServer(), NewDirectPhpSource(h.RouteConfig.UriDispatch.DirectHost, h.RouteConfig.UriDispatch.DirectPath), h.RouteConfig.UriDispatch.Priority))
+		h.SetDispatchHandler(h.newReserveServer())
 	case 3: //3-直连php服务
-		h.SetDispatchHandler(NewDirectPhpSource(h.RouteConfig.UriDispatch.DirectHost, h.RouteConfig.UriDispatch.DirectPath))
+		h.SetDispatchHandler(h.newDirectPhpServer())
 	case 4: //4-内部接口版本灰度方案
 		newServerFn, ok := newServerFuncMap[h.RouteConfig.UriDispatch.DispatchServer]
 		if !ok {
 			logx.Errorf("调度服务不存在")
 			return
 		}
-		server := newServerFn(h.RouteConfig, r)
+		server := newServerFn(h, r)
 		isGray, err := h.isGray(w, r)
 		if err != nil {
 			logx.Errorf("路由调度错误, %+v", errors.Unwrap(err))
@@ -90,10 +141,10 @@ func (h *UriDispatch) Handler(w http.ResponseWriter, r *http.Request, next http.
 		}
 		if isGray {
 			//灰度走兜底
-			h.SetDispatchHandler(NewReserveServer(NewDirectGoServer(), NewDirectPhpSource(h.RouteConfig.UriDispatch.DirectHost, h.RouteConfig.UriDispatch.DirectPath), h.RouteConfig.UriDispatch.Priority))
+			h.SetDispatchHandler(h.newReserveServer())
 		} else {
 			//非灰度 直连php
-			h.SetDispatchHandler(NewDirectPhpSource(h.RouteConfig.UriDispatch.DirectHost, h.RouteConfig.UriDispatch.DirectPath))
+			h.SetDispatchHandler(h.newDirectPhpServer())
 		}
 	case 0: //直连go服务
 		fallthrough
@@ -109,9 +160,10 @@ func (h *UriDispatch) Handler(w http.ResponseWriter, r *http.Request, next http.
 }
 
 func (h *UriDispatch) isGray(_ http.ResponseWriter, r *http.Request) (bool, error) {
-	ids := getValueByCtx(r.Context(), "uid")
+	// uid 由 jzAuth 插件写入 PluginContext，没有 jzAuth 时为空
+	ids := gateway.PluginContextFromRequest(r).MetadataValue("uid")
 	uid, _ := strconv.ParseInt(ids, 10, 64)
-	uri := strings.Replace(r.URL.Path, "//", "/", 1)
+	uri := gateway.RoutePath(r)
 	var userBucket []string
 	grayDivisor := h.RouteConfig.UriDispatch.GrayDivisor
 	if grayDivisor == 0 {
@@ -131,7 +183,7 @@ func (h *UriDispatch) isGray(_ http.ResponseWriter, r *http.Request) (bool, erro
 		if uid > 0 {
 			key := fmt.Sprintf("userId:%s:%s", h.RouteConfig.Method, uri)
 			// 按配置加载用户ID
-			iUserGrayBucket, ok := grayUserMap.Load(key)
+			iUserGrayBucket, ok := h.d.grayUsers.Load(key)
 			if !ok {
 				content, err := readFile(h.RouteConfig.UriDispatch.GrayConfigPath)
 				if err != nil {
@@ -140,7 +192,7 @@ func (h *UriDispatch) isGray(_ http.ResponseWriter, r *http.Request) (bool, erro
 				}
 				userBucket = strings.Split(content, ",")
 				userBucket = lo.Uniq(userBucket)
-				grayUserMap.Store(key, userBucket)
+				h.d.grayUsers.Store(key, userBucket)
 			} else {
 				userBucket = iUserGrayBucket.([]string)
 			}
@@ -154,7 +206,7 @@ func (h *UriDispatch) isGray(_ http.ResponseWriter, r *http.Request) (bool, erro
 		if ip != "" {
 			key := fmt.Sprintf("ip:%s:%s", h.RouteConfig.Method, uri)
 			// 按配置加载用户ID
-			iUserGrayBucket, ok := grayUserMap.Load(key)
+			iUserGrayBucket, ok := h.d.grayUsers.Load(key)
 			if !ok {
 				content, err := readFile(h.RouteConfig.UriDispatch.GrayConfigPath)
 				if err != nil {
@@ -163,7 +215,7 @@ func (h *UriDispatch) isGray(_ http.ResponseWriter, r *http.Request) (bool, erro
 				}
 				userBucket = strings.Split(content, ",")
 				userBucket = lo.Uniq(userBucket)
-				grayUserMap.Store(key, userBucket)
+				h.d.grayUsers.Store(key, userBucket)
 			} else {
 				userBucket = iUserGrayBucket.([]string)
 			}
@@ -177,13 +229,23 @@ func (h *UriDispatch) isGray(_ http.ResponseWriter, r *http.Request) (bool, erro
 	return false, nil
 }
 
-type newServerFunc func(conf gateway.RouteMapping, r *http.Request) IUriProcessor
+func (h *UriDispatch) newDirectPhpServer() *DirectPhpServer {
+	return NewDirectPhpSourceWithClient(h.d.client, h.RouteConfig.UriDispatch.DirectHost, h.RouteConfig.UriDispatch.DirectPath)
+}
+
+func (h *UriDispatch) newReserveServer() *ReserveServer {
+	s := NewReserveServer(NewDirectGoServer(), h.newDirectPhpServer(), h.RouteConfig.UriDispatch.Priority)
+	s.Mode = h.mode
+	return s
+}
+
+type newServerFunc func(h *UriDispatch, r *http.Request) IUriProcessor
 
 var newServerFuncMap = map[int8]newServerFunc{
-	0: func(conf gateway.RouteMapping, r *http.Request) IUriProcessor {
-		return NewDirectPhpSource(conf.UriDispatch.DirectHost, conf.UriDispatch.DirectPath)
+	0: func(h *UriDispatch, r *http.Request) IUriProcessor {
+		return h.newDirectPhpServer()
 	},
-	1: func(conf gateway.RouteMapping, r *http.Request) IUriProcessor {
+	1: func(h *UriDispatch, r *http.Request) IUriProcessor {
 		return NewDirectGoServer()
 	},
 }
@@ -213,32 +275,38 @@ func (s *DirectGoServer) Process(w http.ResponseWriter, r *http.Request, next ht
 */
 type DirectPhpServer struct {
 	*ServerResponseWriter
+	client *resty.Client
 	//directHost  php服务地址
 	DirectHost string
 	//directPath  php服务路径
 	DirectPath string
 }
 
+// NewDirectPhpSource 使用 NewHttpClient 的客户端请求 php
 func NewDirectPhpSource(host, path string) *DirectPhpServer {
+	return NewDirectPhpSourceWithClient(NewHttpClient(), host, path)
+}
+
+// NewDirectPhpSourceWithClient 使用 client 请求 php
+func NewDirectPhpSourceWithClient(client *resty.Client, host, path string) *DirectPhpServer {
 	return &DirectPhpServer{
+		client:     client,
 		DirectHost: host,
 		DirectPath: path,
 	}
 }
 
-func (w *DirectPhpServer) SetWriter(writer *ServerResponseWriter) {
-	w.ServerResponseWriter = writer
-}
-
-var client *resty.Client
-var once sync.Once
+// httpClient 请求 php 的客户端，未设置时使用 NewHttpClient 的客户端
+func (s *DirectPhpServer) httpClient() *resty.Client {
+	if s.client == nil {
+		return NewHttpClient()
+	}
 
-func NewHttpClient() *resty.Client {
-	once.Do(func() {
-		client = resty.New().SetTimeout(8 * time.Second)
-	})
+	return s.client
+}
 
-	return client
+func (w *DirectPhpServer) SetWriter(writer *ServerResponseWriter) {
+	w.ServerResponseWriter = writer
 }
 
 func (s *DirectPhpServer) Process(w http.ResponseWriter, r *http.Request, _ http.Handler) {
@@ -249,7 +317,7 @@ func (s *DirectPhpServer) Process(w http.ResponseWriter, r *http.Request, _ http
 	header["Accept-Encoding"] = []string{"gzip"}
 	//直连不转发
 	header["Direct"] = []string{"1"}
-	resp, err := NewHttpClient().
+	resp, err := s.httpClient().
 		R().
 		SetContext(r.Context()).
 		SetQueryString(r.URL.RawQuery).
@@ -273,6 +341,8 @@ type ReserveServer struct {
 	DirectGoServer  *DirectGoServer
 	DirectPhpServer *DirectPhpServer
 	Priority        int8
+	// Mode 运行环境，pro 时不发送接口不一致的通知
+	Mode string
 }
 
 func NewReserveServer(goServer *DirectGoServer, phpServer *DirectPhpServer, priority int8) *ReserveServer {
@@ -341,7 +411,7 @@ func (s *ReserveServer) Process(w http.ResponseWriter, r *http.Request, next htt
 		isSame, res := CompareoRespnse(&goResponse, &phpResponse)
 		if !isSame {
 			log(r, "error", 500, fmt.Sprintf("新接口与旧接口不一致, %s", res))
-			sendWxReport(fmt.Sprintf("%s/%s", strings.TrimRight(r.Host, "/"), strings.TrimLeft(r.URL.String(), "/")), res)
+			s.sendWxReport(fmt.Sprintf("%s/%s", strings.TrimRight(r.Host, "/"), strings.TrimLeft(r.URL.String(), "/")), res)
 			//对比不一致，返回php服务内容
 			writeOutput(w, s.DirectPhpServer.statusCode, s.DirectPhpServer.ResponseBody)
 
@@ -368,7 +438,7 @@ func (s *ReserveServer) Process(w http.ResponseWriter, r *http.Request, next htt
 		if !isSame {
 			//对比不一致，返回go服务内容
 			log(r, "error", 500, fmt.Sprintf("新接口与旧接口不一致, %s", res))
-			sendWxReport(fmt.Sprintf("%s/%s", strings.TrimRight(r.Host, "/"), strings.TrimLeft(r.URL.String(), "/")), res)
+			s.sendWxReport(fmt.Sprintf("%s/%s", strings.TrimRight(r.Host, "/"), strings.TrimLeft(r.URL.String(), "/")), res)
 			writeOutput(w, s.DirectGoServer.statusCode, s.DirectGoServer.ResponseBody)
 			return
 		}
@@ -470,40 +540,10 @@ func readFile(fileName string) (string, error) {
 	return string(data), nil
 }
 
-func getValueByCtx(ctx context.Context, key string) string {
-	uidData := ctx.Value("moreMd").([]string)
-	for _, v := range uidData {
-		sep := strings.Split(v, ":")
-		if len(sep) != 2 {
-			continue
-		}
-		if sep[0] == key {
-			return sep[1]
-		}
-	}
-	return ""
-}
-
 // ClientIP 尽最大努力实现获取客户端 IP 的算法。
 // 解析 X-Real-IP 和 X-Forwarded-For 以便于反向代理（nginx 或 haproxy）可以正常工作。
 func ClientIP(r *http.Request) string {
-	xForwardedFor := r.Header.Get("X-Forwarded-For")
-	ip := strings.TrimSpace(strings.Split(xForwardedFor, ",")[0])
-	if ip != "" && net.ParseIP(ip) != nil {
-		return ip
-	}
-
-	ip = strings.TrimSpace(r.Header.Get("X-Real-Ip"))
-	if ip != "" && net.ParseIP(ip) != nil {
-		return ip
-	}
-	ip, _, err := net.SplitHostPort(strings.TrimSpace(r.RemoteAddr))
-
-	if err == nil && net.ParseIP(ip) != nil {
-		return ip
-	}
-
-	return ""
+	return internal.ClientIP(r)
 }
 
 var metricServerReqCodeTotal = metric.NewCounterVec(&metric.CounterVecOpts{
@@ -516,7 +556,7 @@ var metricServerReqCodeTotal = metric.NewCounterVec(&metric.CounterVecOpts{
 
 func log(r *http.Request, level string, code int64, msg string) {
 	body, _ := ioutil.ReadAll(r.Body)
-	path := strings.Replace(r.URL.Path, "//", "/", 1)
+	path := gateway.RoutePath(r)
 	l := logx.WithContext(r.Context()).WithFields(logx.LogField{
 		Key:   "method",
 		Value: r.URL.String(),
@@ -548,13 +588,23 @@ type WxMsg struct {
 	} `json:"markdown"`
 }
 
-func sendWxReport(url, str string) {
-	if Mode == "pro" {
+// mode 运行环境，未设置时使用包级别的 Mode
+func (s *ReserveServer) mode() string {
+	if len(s.Mode) == 0 {
+		return Mode
+	}
+
+	return s.Mode
+}
+
+func (s *ReserveServer) sendWxReport(url, str string) {
+	mode := s.mode()
+	if mode == "pro" {
 		return
 	}
 	threading.RunSafe(func() {
 		path := "https://qyapi.weixin.qq.com/cgi-bin/webhook/send?key=124c77e3-6a01-460e-b733-da7ea6ec9b41"
-		content := fmt.Sprintf("\n##### 灰度接口校验不一致\n> [%s](%s)\n>\n> 环境：%s \n>\n> 对比：`%s`\n", url, url, Mode, str)
+		content := fmt.Sprintf("\n##### 灰度接口校验不一致\n> [%s](%s)\n>\n> 环境：%s \n>\n> 对比：`%s`\n", url, url, mode, str)
 		if len(content) > 2048 {
 			rs := []rune(content)
 			content = string(rs[:2048])
@@ -565,7 +615,7 @@ func sendWxReport(url, str string) {
 				Content string `json:"content"`
 			}{Content: content},
 		}
-		resp, err := NewHttpClient().R().SetHeader("Content-Type", "application/json").SetBody(msg).
+		resp, err := s.DirectPhpServer.httpClient().R().SetHeader("Content-Type", "application/json").SetBody(msg).
 			Execute("POST", path)
 		fmt.Println(resp)
 		fmt.Println(err)
@@ -0,0 +1,70 @@
+package uridispatch
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	gateway "github.com/punpeo/pun-gateway-lib"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewUriDispatch(t *testing.T) {
+	old := Mode
+	defer func() {
+		Mode = old
+	}()
+
+	// 旧的 API 使用包级别的 Mode 和共用的客户端
+	Mode = "pro"
+	route := gateway.RouteMapping{Path: "/user/info"}
+	h := NewUriDispatch(route)
+	assert.Equal(t, route, h.RouteConfig)
+	assert.Equal(t, "pro", h.mode)
+	assert.Same(t, NewHttpClient(), h.d.client)
+	assert.Same(t, NewHttpClient(), NewDirectPhpSource("http://php", "user/info").httpClient())
+
+	// Dispatcher 使用传入的 mode 和自己的客户端
+	d := NewDispatcher()
+	defer d.Close()
+	h = d.NewUriDispatch(route, "dev")
+	assert.Equal(t, "dev", h.mode)
+	assert.NotSame(t, NewHttpClient(), h.newDirectPhpServer().httpClient())
+}
+
+func TestReserveServerMode(t *testing.T) {
+	old := Mode
+	defer func() {
+		Mode = old
+	}()
+
+	Mode = "pro"
+	s := NewReserveServer(NewDirectGoServer(), NewDirectPhpSource("http://php", "user/info"), 0)
+	assert.Equal(t, "pro", s.mode())
+	s.Mode = "dev"
+	assert.Equal(t, "dev", s.mode())
+}
+
+func TestDirectPhpServer(t *testing.T) {
+	php := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/user/info", r.URL.Path)
+		assert.Equal(t, "id=1", r.URL.RawQuery)
+		assert.Equal(t, "1", r.Header.Get("Direct"))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"code":1000,"msg":"ok","data":{"id":1}}`)
+	}))
+	defer php.Close()
+
+	// 直接构造、没有设置客户端的 DirectPhpServer 使用共用的客户端
+	for _, s := range []*DirectPhpServer{
+		NewDirectPhpSource(php.URL, "user/info"),
+		{DirectHost: php.URL, DirectPath: "user/info"},
+	} {
+		w := httptest.NewRecorder()
+		s.Process(w, httptest.NewRequest(http.MethodGet, "/user/info?id=1", http.NoBody), nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"code":1000,"msg":"ok","data":{"id":1}}`, strings.TrimSpace(w.Body.String()))
+	}
+}
@@ -0,0 +1,140 @@
+package gateway
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/zeromicro/go-zero/core/conf"
+	"github.com/zeromicro/go-zero/core/discov"
+	"github.com/zeromicro/go-zero/core/logx"
+	"github.com/zeromicro/go-zero/core/threading"
+)
+
+// watchConfig 按 Reload 配置监听配置文件和 etcd
+func (s *Server) watchConfig() error {
+	rc := s.Config.Reload
+	if len(rc.File) > 0 {
+		content, err := os.ReadFile(rc.File)
+		if err != nil {
+			return err
+		}
+
+		threading.GoSafe(func() {
+			s.watchFile(rc.File, rc.Interval, content)
+		})
+	}
+
+	if len(rc.Etcd.Hosts) > 0 {
+		return s.watchEtcd(rc.Etcd)
+	}
+
+	return nil
+}
+
+// watchFile 定期检查配置文件，内容变化后重新加载
+func (s *Server) watchFile(file string, interval time.Duration, content []byte) {
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			cur, err := os.ReadFile(file)
+			if err != nil {
+				logx.Errorf("读取网关配置失败：%s, %v", file, err)
+				continue
+			}
+			if bytes.Equal(cur, content) {
+				continue
+			}
+
+			content = cur
+			var c GatewayConf
+			if err := conf.Load(file, &c); err != nil {
+				logx.Errorf("解析网关配置失败：%s, %v", file, err)
+				continue
+			}
+
+			s.reloadConfig(&c, file)
+		}
+	}
+}
+
+// watchEtcd 监听 etcd 中的配置
+func (s *Server) watchEtcd(c discov.EtcdConf) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	var opts []discov.SubOption
+	if c.HasAccount() {
+		opts = append(opts, discov.WithSubEtcdAccount(c.User, c.Pass))
+	}
+	if c.HasTLS() {
+		opts = append(opts, discov.WithSubEtcdTLS(c.CertFile, c.CertKeyFile, c.CACertFile, c.InsecureSkipVerify))
+	}
+
+	sub, err := discov.NewSubscriber(c.Hosts, c.Key, opts...)
+	if err != nil {
+		return err
+	}
+
+	var (
+		lock    sync.Mutex
+		content string
+	)
+	listener := func() {
+		lock.Lock()
+		defer lock.Unlock()
+
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+
+		vals := sub.Values()
+		if len(vals) == 0 {
+			return
+		}
+		if len(vals) > 1 {
+			logx.Error(errors.New("etcd 网关配置存在多个值：" + c.Key))
+			return
+		}
+		if vals[0] == content {
+			return
+		}
+
+		content = vals[0]
+		var gc GatewayConf
+		if err := conf.LoadFromYamlBytes([]byte(content), &gc); err != nil {
+			logx.Errorf("解析网关配置失败：%s, %v", c.Key, err)
+			return
+		}
+
+		s.reloadConfig(&gc, c.Key)
+	}
+	sub.AddListener(listener)
+	// etcd 中已有的配置优先于启动时的配置
+	listener()
+
+	return nil
+}
+
+func (s *Server) reloadConfig(c *GatewayConf, from string) {
+	if err := s.Reload(c); err != nil {
+		logx.Errorf("网关配置热更新失败，继续使用当前配置：%s, %v", from, err)
+		return
+	}
+
+	logx.Infof("网关配置热更新成功：%s", from)
+}
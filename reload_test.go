@@ -0,0 +1,150 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestServerReloadFailed(t *testing.T) {
+	addr, _ := newTestUpstream(t)
+	svr := newTestServer(t, newTestConf(addr, testMapping(http.MethodGet, "/health", testHealthCheck)))
+	old := svr.current
+
+	tests := []struct {
+		name     string
+		mappings []RouteMapping
+	}{
+		{
+			name: "rpc not found",
+			mappings: []RouteMapping{
+				testMapping(http.MethodGet, "/health", testHealthCheck),
+				testMapping(http.MethodGet, "/missing", "grpc.health.v1.Health/Missing"),
+			},
+		},
+		{
+			name: "plugin not found",
+			mappings: []RouteMapping{
+				testMapping(http.MethodGet, "/health", testHealthCheck),
+				{Method: http.MethodGet, Path: "/added", RpcPath: testHealthCheck, Plugins: []string{"unknown"}},
+			},
+		},
+		{
+			name: "duplicated route",
+			mappings: []RouteMapping{
+				testMapping(http.MethodGet, "/health", testHealthCheck),
+				testMapping(http.MethodGet, "/health", testHealthCheck),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Error(t, svr.Reload(newTestConf(addr, test.mappings...)))
+
+			// 保留原来的快照和路由
+			assert.Same(t, old, svr.current)
+			assert.Equal(t, []string{"GET /health"}, svr.current.routes)
+			assert.Equal(t, `{"status":"SERVING"}`, serveServer(svr, http.MethodGet, "/health", "").Body.String())
+			assert.Equal(t, http.StatusNotFound, serveServer(svr, http.MethodGet, "/added", "").Code)
+		})
+	}
+
+	// 之后的热更新不受影响
+	assert.NoError(t, svr.Reload(newTestConf(addr,
+		testMapping(http.MethodGet, "/health", testHealthCheck),
+		testMapping(http.MethodGet, "/added", testHealthCheck),
+	)))
+	assert.NotSame(t, old, svr.current)
+	assert.Equal(t, []string{"GET /added", "GET /health"}, svr.current.routes)
+	assert.Equal(t, `{"status":"SERVING"}`, serveServer(svr, http.MethodGet, "/added", "").Body.String())
+}
+
+func TestServerReloadRequestConfig(t *testing.T) {
+	addr, _ := newTestUpstream(t)
+	configs := make(chan *GatewayConf, 2)
+	recorder := &configPlugin{plainPlugin: plainPlugin{name: "test"}, configs: configs}
+	c := newTestConf(addr, testMapping(http.MethodGet, "/health", testHealthCheck))
+	svr := newTestServer(t, c, recorder)
+
+	serveServer(svr, http.MethodGet, "/health", "")
+	assert.Same(t, c, <-configs)
+
+	// 新请求读取到新的配置
+	next := newTestConf(addr, testMapping(http.MethodGet, "/health", testHealthCheck))
+	assert.NoError(t, svr.Reload(next))
+	serveServer(svr, http.MethodGet, "/health", "")
+	got := <-configs
+	assert.Same(t, next, got)
+	assert.Contains(t, got.UpstreamsRouteMap["get"], "/health")
+}
+
+func TestWatchFile(t *testing.T) {
+	addr, _ := newTestUpstream(t)
+	file := filepath.Join(t.TempDir(), "gateway.yaml")
+	writeConf := func(paths ...string) []byte {
+		content := fmt.Sprintf(`Name: gateway
+Host: 127.0.0.1
+Port: 8888
+AccessControlRpc: {}
+UpstreamsRouteMap: {}
+Safe:
+  Key: key
+  Iv: iv
+SignKey: key
+Upstreams:
+  - Grpc:
+      Target: %s
+    Mappings:
+`, addr)
+		for _, p := range paths {
+			content += fmt.Sprintf("      - {Method: get, Path: %s, RpcPath: %s, Plugins: [test]}\n", p, testHealthCheck)
+		}
+		assert.NoError(t, os.WriteFile(file, []byte(content), 0o644))
+		return []byte(content)
+	}
+
+	content := writeConf("/health")
+	svr := newTestServer(t, newTestConf(addr, testMapping(http.MethodGet, "/health", testHealthCheck)))
+	go svr.watchFile(file, 10*time.Millisecond, content)
+	defer close(svr.done)
+
+	writeConf("/health", "/added")
+	assert.Eventually(t, func() bool {
+		return serveServer(svr, http.MethodGet, "/added", "").Code == http.StatusOK
+	}, 3*time.Second, 10*time.Millisecond)
+
+	// 配置错误时保留当前路由
+	cur := func() *snapshot {
+		svr.reloadLock.Lock()
+		defer svr.reloadLock.Unlock()
+		return svr.current
+	}
+	old := cur()
+	assert.NoError(t, os.WriteFile(file, []byte("Upstreams: ["), 0o644))
+	time.Sleep(50 * time.Millisecond)
+	assert.Same(t, old, cur())
+
+	writeConf("/added")
+	assert.Eventually(t, func() bool {
+		return serveServer(svr, http.MethodGet, "/health", "").Code == http.StatusNotFound
+	}, 3*time.Second, 10*time.Millisecond)
+	assert.Equal(t, http.StatusOK, serveServer(svr, http.MethodGet, "/added", "").Code)
+}
+
+// configPlugin 在 OnSendHeaders 中记录请求读取到的配置
+type configPlugin struct {
+	plainPlugin
+	configs chan *GatewayConf
+}
+
+func (p *configPlugin) OnSendHeaders(pc *PluginContext, r *http.Request, md metadata.MD) metadata.MD {
+	p.configs <- RequestConfig(r, nil)
+	return md
+}
@@ -0,0 +1,61 @@
+package gateway
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/punpeo/pun-gateway-lib/internal"
+	"github.com/zeromicro/go-zero/rest"
+)
+
+type routePathKey struct{}
+
+// RoutePath 获取请求命中的路由模板，如 /users/:id
+// 路径变量不同的请求会得到同一个值，插件应使用它而不是 RequestURI 查找路由配置
+func RoutePath(r *http.Request) string {
+	if path, ok := r.Context().Value(routePathKey{}).(string); ok {
+		return path
+	}
+
+	return strings.ReplaceAll(r.URL.Path, "//", "/")
+}
+
+// routePathMiddleware 将路由模板写入请求上下文
+func routePathMiddleware(path string) rest.Middleware {
+	path = strings.ReplaceAll(path, "//", "/")
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			next(w, r.WithContext(context.WithValue(r.Context(), routePathKey{}, path)))
+		}
+	}
+}
+
+type routeConfigKey struct{}
+
+// RequestConfig 获取处理请求的网关配置
+// 配置热更新后，进行中的请求仍使用旧配置，插件应通过它读取 UpstreamsRouteMap 等路由配置，
+// 请求不是由网关路由处理时返回 c
+func RequestConfig(r *http.Request, c *GatewayConf) *GatewayConf {
+	if conf, ok := r.Context().Value(routeConfigKey{}).(*GatewayConf); ok {
+		return conf
+	}
+
+	return c
+}
+
+// ClientIP 客户端 IP，只有请求来自 TrustedProxies 时才使用 X-Forwarded-For 和 X-Real-Ip，
+// 请求不是由网关路由处理时为连接的对端地址
+func ClientIP(r *http.Request) string {
+	return internal.RequestClientIP(r)
+}
+
+// routeConfigMiddleware 将路由所属的网关配置和按其 TrustedProxies 确定的客户端 IP 写入请求上下文
+func routeConfigMiddleware(c *GatewayConf, proxies *internal.TrustedProxies) rest.Middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			r = internal.WithClientIP(r, proxies.ClientIP(r))
+			next(w, r.WithContext(context.WithValue(r.Context(), routeConfigKey{}, c)))
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/punpeo/pun-gateway-lib/internal"
+	"github.com/zeromicro/go-zero/core/load"
+	"github.com/zeromicro/go-zero/core/search"
+	"github.com/zeromicro/go-zero/core/stat"
+	"github.com/zeromicro/go-zero/rest"
+	"github.com/zeromicro/go-zero/rest/chain"
+	"github.com/zeromicro/go-zero/rest/handler"
+	"github.com/zeromicro/go-zero/rest/pathvar"
+)
+
+// gatewayRouter 网关路由，同时作为 go-zero 的 httpx.Router
+// 网关路由不注册到 go-zero，而是保存在可整体替换的路由表中，配置热更新时原子切换，
+// 进行中的请求继续使用旧的路由表；通过 go-zero 注册的路由（如 AddRoute 添加的路由）保存在 native 中。
+// 网关路由的原生中间件由 buildChain 按 RestConf 构造，go-zero 注册的路由的原生中间件仍由 go-zero 按路由选项构造
+type gatewayRouter struct {
+	conf    rest.RestConf
+	metrics *stat.Metrics
+	shedder load.Shedder
+	table   atomic.Value
+	// native 通过 go-zero 注册的路由，启动时注册，之后不再修改
+	native     *routeTable
+	notFound   http.Handler
+	notAllowed http.Handler
+	// middlewares 通过 Server.Use 添加的中间件，go-zero 注册的路由由 go-zero 添加
+	middlewares []rest.Middleware
+}
+
+// routeTable 一份完整的网关路由，不可修改
+type routeTable struct {
+	// trees 按 Method 和自定义方法区分的路由树
+	trees map[string]*search.Tree
+	// wildcards 含 ** 通配的路由，路由树不支持通配，按顺序逐一匹配
+	wildcards []wildcardRoute
+}
+
+// wildcardRoute 含 ** 通配的路由
+type wildcardRoute struct {
+	key      string
+	segments []string
+	handler  http.Handler
+}
+
+func newGatewayRouter(conf rest.RestConf) *gatewayRouter {
+	gr := &gatewayRouter{
+		conf:   conf,
+		native: newRouteTable(),
+	}
+
+	if len(conf.Name) > 0 {
+		gr.metrics = stat.NewMetrics(conf.Name)
+	} else {
+		gr.metrics = stat.NewMetrics(fmt.Sprintf("%s:%d", conf.Host, conf.Port))
+	}
+	if conf.CpuThreshold > 0 {
+		gr.shedder = load.NewAdaptiveShedder(load.WithCpuThreshold(conf.CpuThreshold))
+	}
+	gr.table.Store(newRouteTable())
+
+	return gr
+}
+
+func newRouteTable() *routeTable {
+	return &routeTable{trees: make(map[string]*search.Tree)}
+}
+
+// newTable 构造路由表，路由按 go-zero 的默认顺序加上原生中间件
+func (gr *gatewayRouter) newTable(routes []gatewayRoute) (*routeTable, error) {
+	rt := newRouteTable()
+	for _, r := range routes {
+		chn := gr.buildChain(r)
+		for _, m := range gr.middlewares {
+			chn = chn.Append(convertMiddleware(m))
+		}
+		h := chn.ThenFunc(r.Handler)
+		if r.stream {
+			h = gr.streamDeadline(h)
+		}
+		if err := rt.add(r.Method, r.Path, h); err != nil {
+			return nil, err
+		}
+	}
+
+	return rt, nil
+}
+
+// add 添加一条路由
+func (rt *routeTable) add(method, reqPath string, h http.Handler) error {
+	routePath, verb := internal.SplitVerb(path.Clean(reqPath))
+	key := treeKey(method, verb)
+
+	if strings.Contains(routePath, "/*") {
+		wr := wildcardRoute{
+			key:      key,
+			segments: strings.Split(routePath[1:], "/"),
+			handler:  h,
+		}
+		for _, w := range rt.wildcards {
+			if w.key == wr.key && strings.Join(w.segments, "/") == strings.Join(wr.segments, "/") {
+				return fmt.Errorf("%s %s: duplicated route", method, reqPath)
+			}
+		}
+		rt.wildcards = append(rt.wildcards, wr)
+		return nil
+	}
+
+	tree, ok := rt.trees[key]
+	if !ok {
+		tree = search.NewTree()
+		rt.trees[key] = tree
+	}
+	if err := tree.Add(routePath, h); err != nil {
+		return fmt.Errorf("%s %s: %w", method, reqPath, err)
+	}
+
+	return nil
+}
+
+// search 查找路由，先按自定义方法查找，再按完整路径查找，最后匹配通配路由
+func (rt *routeTable) search(method, reqPath string) (http.Handler, map[string]string, bool) {
+	routePath, verb := internal.SplitVerb(reqPath)
+	if len(verb) > 0 {
+		if h, params, ok := rt.searchKey(treeKey(method, verb), routePath); ok {
+			return h, params, true
+		}
+	}
+
+	return rt.searchKey(method, reqPath)
+}
+
+// methods 路径对应路由的所有方法
+func (rt *routeTable) methods(reqPath string) []string {
+	seen := make(map[string]struct{})
+	for key := range rt.trees {
+		seen[strings.SplitN(key, ":", 2)[0]] = struct{}{}
+	}
+	for _, w := range rt.wildcards {
+		seen[strings.SplitN(w.key, ":", 2)[0]] = struct{}{}
+	}
+
+	var methods []string
+	for method := range seen {
+		if _, _, ok := rt.search(method, reqPath); ok {
+			methods = append(methods, method)
+		}
+	}
+
+	return methods
+}
+
+func (rt *routeTable) searchKey(key, reqPath string) (http.Handler, map[string]string, bool) {
+	if tree, ok := rt.trees[key]; ok {
+		if result, ok := tree.Search(reqPath); ok {
+			return result.Item.(http.Handler), result.Params, true
+		}
+	}
+
+	segments := strings.Split(reqPath[1:], "/")
+	for _, w := range rt.wildcards {
+		if w.key != key {
+			continue
+		}
+		if params, ok := matchWildcard(w.segments, segments); ok {
+			return w.handler, params, true
+		}
+	}
+
+	return nil, nil, false
+}
+
+// matchWildcard 逐段匹配路由，:name 匹配一段，*name 匹配剩余的零或多段
+func matchWildcard(route, segments []string) (map[string]string, bool) {
+	params := make(map[string]string)
+	for i, seg := range route {
+		switch {
+		case strings.HasPrefix(seg, "*"):
+			if i < len(segments) {
+				params[seg[1:]] = strings.Join(segments[i:], "/")
+			} else {
+				params[seg[1:]] = ""
+			}
+			return params, true
+		case i >= len(segments):
+			return nil, false
+		case strings.HasPrefix(seg, ":"):
+			params[seg[1:]] = segments[i]
+		case seg != segments[i]:
+			return nil, false
+		}
+	}
+
+	return params, len(route) == len(segments)
+}
+
+func treeKey(method, verb string) string {
+	if len(verb) == 0 {
+		return method
+	}
+
+	return method + ":" + verb
+}
+
+// buildChain 原生中间件，顺序与 go-zero 相同，服务端流式路由不经过超时中间件，因为该中间件会缓存整个响应直到请求处理结束
+func (gr *gatewayRouter) buildChain(r gatewayRoute) chain.Chain {
+	chn := chain.New()
+	mw := gr.conf.Middlewares
+
+	if mw.Trace {
+		chn = chn.Append(handler.TraceHandler(gr.conf.Name, r.Path,
+			handler.WithTraceIgnorePaths(gr.conf.TraceIgnorePaths)))
+	}
+	if mw.Log {
+		if gr.conf.Verbose {
+			chn = chn.Append(handler.DetailedLogHandler)
+		} else {
+			chn = chn.Append(handler.LogHandler)
+		}
+	}
+	if mw.Prometheus {
+		chn = chn.Append(handler.PrometheusHandler(r.Path, r.Method))
+	}
+	if mw.MaxConns {
+		chn = chn.Append(handler.MaxConnsHandler(gr.conf.MaxConns))
+	}
+	if mw.Breaker {
+		chn = chn.Append(handler.BreakerHandler(r.Method, r.Path, gr.metrics))
+	}
+	if mw.Shedding {
+		chn = chn.Append(handler.SheddingHandler(gr.shedder, gr.metrics))
+	}
+	if mw.Timeout && !r.stream {
+		chn = chn.Append(handler.TimeoutHandler(time.Duration(gr.conf.Timeout) * time.Millisecond))
+	}
+	if mw.Recover {
+		chn = chn.Append(handler.RecoverHandler)
+	}
+	if mw.Metrics {
+		chn = chn.Append(handler.MetricHandler(gr.metrics))
+	}
+	if mw.MaxBytes {
+		chn = chn.Append(handler.MaxBytesHandler(gr.conf.MaxBytes))
+	}
+	if mw.Gunzip {
+		chn = chn.Append(handler.GunzipHandler)
+	}
+
+	return chn
+}
+
+// streamDeadline 服务端流式路由在原生中间件之前取得 http.Server 传入的 ResponseWriter，
+// 按 RestConf.Timeout 延长每次写入的写超时，避免流被 http.Server 的 WriteTimeout 截断
+func (gr *gatewayRouter) streamDeadline(next http.Handler) http.Handler {
+	timeout := time.Duration(gr.conf.Timeout) * time.Millisecond
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, internal.WithStreamDeadline(w, r, timeout))
+	})
+}
+
+// swap 原子替换路由表
+func (gr *gatewayRouter) swap(rt *routeTable) {
+	gr.table.Store(rt)
+}
+
+// Handle 注册 go-zero 的路由，h 已经加上了原生中间件、鉴权和 Use 添加的中间件
+func (gr *gatewayRouter) Handle(method, reqPath string, h http.Handler) error {
+	return gr.native.add(method, reqPath, h)
+}
+
+// SetNotFoundHandler 设置未找到路由时的处理
+func (gr *gatewayRouter) SetNotFoundHandler(h http.Handler) {
+	gr.notFound = h
+}
+
+// SetNotAllowedHandler 设置路由存在但方法不匹配时的处理
+func (gr *gatewayRouter) SetNotAllowedHandler(h http.Handler) {
+	gr.notAllowed = h
+}
+
+func (gr *gatewayRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reqPath := path.Clean(r.URL.Path)
+	rt := gr.table.Load().(*routeTable)
+	for _, table := range []*routeTable{rt, gr.native} {
+		if h, params, ok := table.search(r.Method, reqPath); ok {
+			if len(params) > 0 {
+				r = pathvar.WithVars(r, params)
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	// 网关路由和 go-zero 的路由中路径存在但方法不匹配时返回 405
+	allows := append(rt.methods(reqPath), gr.native.methods(reqPath)...)
+	if len(allows) == 0 {
+		if gr.notFound != nil {
+			gr.notFound.ServeHTTP(w, r)
+		} else {
+			http.NotFound(w, r)
+		}
+		return
+	}
+
+	if gr.notAllowed != nil {
+		gr.notAllowed.ServeHTTP(w, r)
+		return
+	}
+	sort.Strings(allows)
+	w.Header().Set("Allow", strings.Join(dedupStrings(allows), ", "))
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
+
+func dedupStrings(vals []string) []string {
+	var ret []string
+	for i, v := range vals {
+		if i == 0 || v != vals[i-1] {
+			ret = append(ret, v)
+		}
+	}
+
+	return ret
+}
+
+func convertMiddleware(m rest.Middleware) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return m(next.ServeHTTP)
+	}
+}
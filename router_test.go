@@ -0,0 +1,204 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zeromicro/go-zero/rest"
+	"github.com/zeromicro/go-zero/rest/pathvar"
+)
+
+// echoRoute 输出路由名称和路径变量的网关路由
+func echoRoute(method, path, name string) gatewayRoute {
+	return gatewayRoute{Route: rest.Route{
+		Method: method,
+		Path:   path,
+		Handler: func(w http.ResponseWriter, r *http.Request) {
+			vars := pathvar.Vars(r)
+			keys := make([]string, 0, len(vars))
+			for k := range vars {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+
+			_, _ = fmt.Fprint(w, name)
+			for _, k := range keys {
+				_, _ = fmt.Fprintf(w, " %s=%s", k, vars[k])
+			}
+		},
+	}}
+}
+
+func newTestRouter(t *testing.T, routes ...gatewayRoute) *gatewayRouter {
+	gr := newGatewayRouter(rest.RestConf{})
+	rt, err := gr.newTable(routes)
+	assert.NoError(t, err)
+	gr.swap(rt)
+
+	return gr
+}
+
+func serveTest(gr http.Handler, method, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	gr.ServeHTTP(w, httptest.NewRequest(method, path, http.NoBody))
+	return w
+}
+
+func TestGatewayRouterMatch(t *testing.T) {
+	gr := newTestRouter(t,
+		echoRoute(http.MethodGet, "/users/:id", "user"),
+		echoRoute(http.MethodPost, "/users/:id", "update"),
+		echoRoute(http.MethodGet, "/users/:id/books", "books"),
+		echoRoute(http.MethodPost, "/v1/books/:id:cancel", "cancel"),
+		echoRoute(http.MethodPost, "/v1/books/:id", "book"),
+		echoRoute(http.MethodGet, "/files/*path", "file"),
+		echoRoute(http.MethodGet, "/v1/shelves/:shelf/*rest", "shelf"),
+	)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		expect string
+	}{
+		{name: "var", method: http.MethodGet, path: "/users/7", expect: "user id=7"},
+		{name: "method", method: http.MethodPost, path: "/users/7", expect: "update id=7"},
+		{name: "nested", method: http.MethodGet, path: "/users/7/books", expect: "books id=7"},
+		{name: "clean", method: http.MethodGet, path: "/users//7/./books", expect: "books id=7"},
+		{name: "verb", method: http.MethodPost, path: "/v1/books/3:cancel", expect: "cancel id=3"},
+		{name: "no verb", method: http.MethodPost, path: "/v1/books/3", expect: "book id=3"},
+		{name: "wildcard", method: http.MethodGet, path: "/files/a/b/c.txt", expect: "file path=a/b/c.txt"},
+		{name: "wildcard one", method: http.MethodGet, path: "/files/a", expect: "file path=a"},
+		{name: "wildcard after var", method: http.MethodGet, path: "/v1/shelves/1/books/2", expect: "shelf rest=books/2 shelf=1"},
+		{name: "wildcard empty", method: http.MethodGet, path: "/v1/shelves/1", expect: "shelf rest= shelf=1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := serveTest(gr, test.method, test.path)
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, test.expect, w.Body.String())
+		})
+	}
+}
+
+func TestGatewayRouterDuplicated(t *testing.T) {
+	gr := newGatewayRouter(rest.RestConf{})
+	_, err := gr.newTable([]gatewayRoute{
+		echoRoute(http.MethodGet, "/users/:id", "a"),
+		echoRoute(http.MethodGet, "/users/:id", "b"),
+	})
+	assert.Error(t, err)
+
+	_, err = gr.newTable([]gatewayRoute{
+		echoRoute(http.MethodGet, "/files/*path", "a"),
+		echoRoute(http.MethodGet, "/files/*name", "b"),
+	})
+	assert.NoError(t, err)
+	_, err = gr.newTable([]gatewayRoute{
+		echoRoute(http.MethodGet, "/files/*path", "a"),
+		echoRoute(http.MethodGet, "/files/*path", "b"),
+	})
+	assert.Error(t, err)
+}
+
+func TestGatewayRouterNotAllowed(t *testing.T) {
+	gr := newTestRouter(t,
+		echoRoute(http.MethodGet, "/users/:id", "user"),
+		echoRoute(http.MethodPost, "/users/:id", "update"),
+		echoRoute(http.MethodGet, "/files/*path", "file"),
+	)
+	assert.NoError(t, gr.Handle(http.MethodGet, "/ping", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, "pong")
+	})))
+	assert.NoError(t, gr.Handle(http.MethodPut, "/users/:id", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, "native")
+	})))
+
+	// go-zero 注册的路由在网关路由之后查找
+	w := serveTest(gr, http.MethodGet, "/ping")
+	assert.Equal(t, "pong", w.Body.String())
+	w = serveTest(gr, http.MethodPut, "/users/7")
+	assert.Equal(t, "native", w.Body.String())
+
+	// 方法不匹配时 Allow 包括网关路由和 go-zero 的路由
+	w = serveTest(gr, http.MethodDelete, "/users/7")
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.Equal(t, "GET, POST, PUT", w.Header().Get("Allow"))
+	w = serveTest(gr, http.MethodPost, "/files/a/b")
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.Equal(t, "GET", w.Header().Get("Allow"))
+	w = serveTest(gr, http.MethodPost, "/ping")
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.Equal(t, "GET", w.Header().Get("Allow"))
+
+	w = serveTest(gr, http.MethodGet, "/books/1")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// go-zero 设置的处理
+	gr.SetNotFoundHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	gr.SetNotAllowedHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusConflict)
+	}))
+	assert.Equal(t, http.StatusTeapot, serveTest(gr, http.MethodGet, "/books/1").Code)
+	assert.Equal(t, http.StatusConflict, serveTest(gr, http.MethodDelete, "/users/7").Code)
+}
+
+func TestGatewayRouterSwap(t *testing.T) {
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	old := gatewayRoute{Route: rest.Route{
+		Method: http.MethodGet,
+		Path:   "/slow",
+		Handler: func(w http.ResponseWriter, r *http.Request) {
+			close(entered)
+			<-release
+			_, _ = fmt.Fprint(w, "old")
+		},
+	}}
+	gr := newTestRouter(t, old)
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- serveTest(gr, http.MethodGet, "/slow")
+	}()
+	<-entered
+
+	rt, err := gr.newTable([]gatewayRoute{
+		echoRoute(http.MethodGet, "/slow", "new"),
+		echoRoute(http.MethodGet, "/added", "added"),
+	})
+	assert.NoError(t, err)
+	gr.swap(rt)
+
+	// 新请求使用新的路由表，进行中的请求在旧的路由表上完成
+	assert.Equal(t, "new", serveTest(gr, http.MethodGet, "/slow").Body.String())
+	assert.Equal(t, "added", serveTest(gr, http.MethodGet, "/added").Body.String())
+	close(release)
+	w := <-done
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "old", w.Body.String())
+}
+
+func TestGatewayRouterMiddlewares(t *testing.T) {
+	gr := newGatewayRouter(rest.RestConf{})
+	gr.middlewares = append(gr.middlewares, func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Use", "1")
+			next(w, r)
+		}
+	})
+	rt, err := gr.newTable([]gatewayRoute{echoRoute(http.MethodGet, "/users/:id", "user")})
+	assert.NoError(t, err)
+	gr.swap(rt)
+
+	w := serveTest(gr, http.MethodGet, "/users/1")
+	assert.Equal(t, "1", w.Header().Get("X-Use"))
+	assert.Equal(t, "user id=1", w.Body.String())
+}
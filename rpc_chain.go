@@ -1,83 +1,241 @@
 package gateway
 
 import (
+	"encoding/json"
 	"io"
 	"net/http"
 
 	"github.com/golang/protobuf/jsonpb"
 	"github.com/golang/protobuf/proto"
 	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/punpeo/pun-gateway-lib/internal"
 	"github.com/zeromicro/go-zero/core/logx"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
 // GrpcChainHandler 实现 gRPC 的 handler interface
 type GrpcChainHandler struct {
-	writer    http.ResponseWriter
-	request   *http.Request
+	writer  http.ResponseWriter
+	request *http.Request
+	// pc 本次请求的 PluginContext
+	pc        *PluginContext
 	marshaler jsonpb.Marshaler
-	chains    []RpcHandler
+	chains    []ContextRpcHandler
 	Status    *status.Status
 
-	respHeader metadata.MD
+	respHeader  metadata.MD
+	respTrailer metadata.MD
+	// streamMode 服务端流式方法的输出方式
+	streamMode string
+	// stream 服务端流式方法或 WebSocket 路由的输出，普通请求为 nil
+	stream streamWriter
+	// responseBody 只输出响应消息中的这个字段
+	responseBody string
+	method       *desc.MethodDescriptor
+	// formatter 非流式方法的响应格式，不为 nil 时插件处理后的响应留给 formatter 输出
+	formatter ResponseFormatter
+	message   proto.Message
+	data      string
+	// body 未配置 formatter 时插件处理后的响应，OnReceiveTrailers 之后没有中止才由 writeBody 输出
+	body string
 }
 
 // OnResolveMethod is called with a descriptor of the method that is being invoked.
 func (h *GrpcChainHandler) OnResolveMethod(desc *desc.MethodDescriptor) {
+	h.method = desc
+	h.pc.setMethod(desc)
+	if h.stream == nil && desc != nil && desc.IsServerStreaming() {
+		h.stream = newStreamWriter(h.writer, internal.StreamDeadlineFromRequest(h.request), h.streamMode)
+	}
+
 	for _, chn := range h.chains {
-		if nil == chn {
+		if nil == chn || h.aborted() {
 			continue
 		}
-		chn.OnResolveMethod(desc)
+		chn.OnResolveMethod(h.pc, desc)
 	}
 }
 
 // OnSendHeaders is called with the request metadata that is being sent.
+// 插件通过 PluginContext 设置的 metadata 先合并到请求中
 func (h *GrpcChainHandler) OnSendHeaders(md metadata.MD) {
+	for k, vals := range h.pc.Metadata() {
+		md.Set(k, vals...)
+	}
+
 	for _, chn := range h.chains {
-		if nil == chn {
+		if nil == chn || h.aborted() {
 			continue
 		}
-		md = chn.OnSendHeaders(h.request, md)
+		md = chn.OnSendHeaders(h.pc, h.request, md)
 	}
 }
 
 // OnReceiveHeaders is called when response headers have been received.
 func (h *GrpcChainHandler) OnReceiveHeaders(md metadata.MD) {
 	for _, chn := range h.chains {
-		if nil == chn {
+		if nil == chn || h.aborted() {
 			continue
 		}
-		md = chn.OnReceiveHeaders(md)
+		md = chn.OnReceiveHeaders(h.pc, md)
 	}
 	h.respHeader = md
 }
 
 // OnReceiveResponse is called for each response message received.
 func (h *GrpcChainHandler) OnReceiveResponse(message proto.Message) {
+	message = h.handleMessage(message)
+	if h.aborted() {
+		return
+	}
+
 	resp, err := h.marshaler.MarshalToString(message)
 	if err != nil {
 		logx.Error(err)
 	}
+	if len(h.responseBody) > 0 {
+		resp = h.pickResponseBody(resp)
+	}
 
 	for _, chn := range h.chains {
-		if nil == chn {
+		if nil == chn || h.aborted() {
 			continue
 		}
-		resp = chn.OnReceiveResponse(resp, h.respHeader, h.writer)
+		resp = chn.OnReceiveResponse(h.pc, resp, h.respHeader, h.writer)
+	}
+	if h.aborted() {
+		// 插件中止了请求，响应交给错误输出
+		return
 	}
 
-	_, _ = io.WriteString(h.writer, resp)
+	if h.stream != nil {
+		if err := h.stream.WriteMessage(resp); err != nil {
+			logx.Error(err)
+		}
+		return
+	}
+
+	if h.formatter != nil {
+		// 插件处理后的响应交给 formatter 输出
+		h.message, h.data = message, resp
+		return
+	}
+
+	h.body = resp
 }
 
 // OnReceiveTrailers is called when response trailers and final RPC status have been received.
 func (h *GrpcChainHandler) OnReceiveTrailers(status *status.Status, md metadata.MD) {
 	h.Status = status
 	for _, chn := range h.chains {
-		if nil == chn {
+		if nil == chn || h.aborted() {
 			continue
 		}
-		md = chn.OnReceiveTrailers(status, md)
+		md = chn.OnReceiveTrailers(h.pc, status, md)
 	}
+	h.respTrailer = md
+}
+
+// writeBody 输出未配置 formatter 时的响应，插件在 OnReceiveTrailers 中中止请求时不输出
+func (h *GrpcChainHandler) writeBody() {
+	if h.aborted() || len(h.body) == 0 {
+		return
+	}
+
+	_, _ = io.WriteString(h.writer, h.body)
+}
+
+// response rpc 结束后交给 ResponseFormatter 的响应
+func (h *GrpcChainHandler) response(r *http.Request) *Response {
+	resp := &Response{
+		Request: r,
+		Header:  h.respHeader,
+		Trailer: h.respTrailer,
+		Status:  h.Status,
+	}
+	if h.Status.Code() == codes.OK {
+		resp.Message = h.message
+		resp.Data = json.RawMessage(h.data)
+	}
+
+	return resp
+}
+
+// handleMessage 依次调用实现了 MessageHandler 的插件
+func (h *GrpcChainHandler) handleMessage(message proto.Message) proto.Message {
+	var handlers []MessageHandler
+	for _, chn := range h.chains {
+		if mh, ok := chn.(MessageHandler); ok {
+			handlers = append(handlers, mh)
+		}
+	}
+	if len(handlers) == 0 {
+		return message
+	}
+
+	msg, err := dynamic.AsDynamicMessage(message)
+	if err != nil {
+		logx.Error(err)
+		return message
+	}
+	for _, mh := range handlers {
+		if h.aborted() {
+			break
+		}
+		if next := mh.OnReceiveMessage(h.pc, h.request, h.method, msg); next != nil {
+			msg = next
+		}
+	}
+
+	return msg
+}
+
+// aborted 插件是否中止了请求
+func (h *GrpcChainHandler) aborted() bool {
+	return h.pc.Err() != nil
+}
+
+// finishStream 服务端流式方法结束时输出最终状态，非流式方法返回 false
+func (h *GrpcChainHandler) finishStream(st *status.Status) bool {
+	if h.stream == nil {
+		return false
+	}
+
+	if err := h.stream.WriteStatus(st); err != nil {
+		logx.Error(err)
+	}
+	return true
+}
+
+// pickResponseBody 从响应 JSON 中取出 response_body 指定的字段
+func (h *GrpcChainHandler) pickResponseBody(resp string) string {
+	if h.method == nil {
+		return resp
+	}
+
+	field := h.method.GetOutputType().FindFieldByName(h.responseBody)
+	if field == nil {
+		logx.Errorf("response_body 字段不存在：%s", h.responseBody)
+		return resp
+	}
+
+	key := field.GetJSONName()
+	if h.marshaler.OrigName {
+		key = field.GetName()
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(resp), &fields); err != nil {
+		logx.Error(err)
+		return resp
+	}
+
+	if val, ok := fields[key]; ok {
+		return string(val)
+	}
+
+	return "null"
 }
@@ -0,0 +1,347 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/stretchr/testify/assert"
+	"github.com/zeromicro/go-zero/rest"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// wrapPlugin 在 OnReceiveResponse 中把响应包装为 {"wrapped":...}
+type wrapPlugin struct {
+	plainPlugin
+	formatted chan bool
+}
+
+func (p *wrapPlugin) OnReceiveResponse(pc *PluginContext, resp string, _ metadata.MD, _ http.ResponseWriter) string {
+	p.formatted <- pc.Formatted()
+	return `{"wrapped":` + resp + `}`
+}
+
+func TestFormatterAfterPlugins(t *testing.T) {
+	addr, _ := newTestUpstream(t)
+	mapping := func(path, formatter string) RouteMapping {
+		m := testMapping(http.MethodGet, path, testHealthCheck)
+		m.Formatter = formatter
+		return m
+	}
+	pl := &wrapPlugin{plainPlugin: plainPlugin{name: "test"}, formatted: make(chan bool, 1)}
+	svr := newTestServer(t, newTestConf(addr,
+		mapping("/legacy", ""),
+		mapping("/raw", FormatterRaw),
+		mapping("/jz", FormatterJzEnvelope),
+	), pl)
+
+	tests := []struct {
+		path      string
+		formatted bool
+		expect    string
+	}{
+		{path: "/legacy", expect: `{"wrapped":{"status":"SERVING"}}`},
+		{path: "/raw", formatted: true, expect: `{"wrapped":{"status":"SERVING"}}`},
+		{path: "/jz", formatted: true, expect: `"data":{"wrapped":{"status":"SERVING"}}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			// 配置了 Formatter 的路由同样经过插件的 OnReceiveResponse，由 Formatter 输出插件处理后的响应
+			w := serveServer(svr, http.MethodGet, test.path, "")
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Contains(t, w.Body.String(), test.expect)
+			assert.Equal(t, test.formatted, <-pl.formatted)
+		})
+	}
+}
+
+// abortPlugin 在 at 指定的方法中中止请求，at 为 stream 时在第二条响应消息中止
+type abortPlugin struct {
+	plainPlugin
+	at    string
+	calls *callRecorder
+	// onMessage 收到第一条响应消息时调用
+	onMessage func()
+}
+
+func newAbortError() *Error {
+	e := NewError(codes.PermissionDenied, "denied")
+	e.BizCode = 4003
+	e.HttpStatus = http.StatusForbidden
+	return e
+}
+
+func (p *abortPlugin) Middleware() rest.Middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			p.calls.add(p.name + ".Middleware")
+			if p.at == "Middleware" {
+				PluginContextFromRequest(r).Abort(newAbortError())
+			}
+			next(w, r)
+		}
+	}
+}
+
+func (p *abortPlugin) OnResolveMethod(pc *PluginContext, _ *desc.MethodDescriptor) {
+	p.calls.add(p.name + ".OnResolveMethod")
+}
+
+func (p *abortPlugin) OnSendHeaders(pc *PluginContext, _ *http.Request, md metadata.MD) metadata.MD {
+	p.calls.add(p.name + ".OnSendHeaders")
+	if p.at == "OnSendHeaders" {
+		pc.Abort(newAbortError())
+	}
+	return md
+}
+
+func (p *abortPlugin) OnReceiveResponse(pc *PluginContext, resp string, _ metadata.MD, _ http.ResponseWriter) string {
+	n := p.calls.add(p.name + ".OnReceiveResponse")
+	switch {
+	case p.at == "OnReceiveResponse", p.at == "stream" && n > 1:
+		pc.Abort(newAbortError())
+	case p.onMessage != nil:
+		p.onMessage()
+	}
+	return resp
+}
+
+func (p *abortPlugin) OnReceiveTrailers(pc *PluginContext, _ *status.Status, md metadata.MD) metadata.MD {
+	p.calls.add(p.name + ".OnReceiveTrailers")
+	if p.at == "OnReceiveTrailers" {
+		pc.Abort(newAbortError())
+	}
+	return md
+}
+
+// callRecorder 记录插件方法的调用
+type callRecorder struct {
+	lock  sync.Mutex
+	calls []string
+}
+
+// add 记录一次调用，返回该方法的调用次数
+func (c *callRecorder) add(call string) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.calls = append(c.calls, call)
+	n := 0
+	for _, v := range c.calls {
+		if v == call {
+			n++
+		}
+	}
+	return n
+}
+
+func (c *callRecorder) list() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return append([]string(nil), c.calls...)
+}
+
+func newAbortServer(t *testing.T, at string, mappings ...RouteMapping) (*Server, *callRecorder) {
+	addr, _ := newTestUpstream(t)
+	calls := new(callRecorder)
+	svr := newTestServer(t, newTestConf(addr, mappings...),
+		&abortPlugin{plainPlugin: plainPlugin{name: "abort"}, at: at, calls: calls},
+		&abortPlugin{plainPlugin: plainPlugin{name: "after"}, calls: calls},
+	)
+
+	return svr, calls
+}
+
+func TestPluginAbort(t *testing.T) {
+	tests := []struct {
+		at     string
+		expect []string
+	}{
+		{
+			at:     "Middleware",
+			expect: []string{"abort.Middleware"},
+		},
+		{
+			at: "OnSendHeaders",
+			expect: []string{"abort.Middleware", "after.Middleware", "abort.OnResolveMethod", "after.OnResolveMethod",
+				"abort.OnSendHeaders"},
+		},
+		{
+			at: "OnReceiveResponse",
+			expect: []string{"abort.Middleware", "after.Middleware", "abort.OnResolveMethod", "after.OnResolveMethod",
+				"abort.OnSendHeaders", "after.OnSendHeaders", "abort.OnReceiveResponse"},
+		},
+		{
+			at: "OnReceiveTrailers",
+			expect: []string{"abort.Middleware", "after.Middleware", "abort.OnResolveMethod", "after.OnResolveMethod",
+				"abort.OnSendHeaders", "after.OnSendHeaders", "abort.OnReceiveResponse", "after.OnReceiveResponse",
+				"abort.OnReceiveTrailers"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.at, func(t *testing.T) {
+			svr, calls := newAbortServer(t, test.at, RouteMapping{
+				Method:  http.MethodGet,
+				Path:    "/health",
+				RpcPath: testHealthCheck,
+				Plugins: []string{"abort", "after"},
+			})
+
+			// 之后的插件方法不再调用，已收到的响应不再输出，错误按 Errors 和 Formatter 输出
+			w := serveServer(svr, http.MethodGet, "/health", "")
+			assert.Equal(t, http.StatusForbidden, w.Code)
+			assert.JSONEq(t, `{"code":4003,"msg":"denied","data":null}`, w.Body.String())
+			assert.Equal(t, test.expect, calls.list())
+		})
+	}
+}
+
+func TestPluginAbortStream(t *testing.T) {
+	addr, hs := newTestUpstream(t)
+	calls := new(callRecorder)
+	abort := &abortPlugin{plainPlugin: plainPlugin{name: "abort"}, at: "stream", calls: calls}
+	abort.onMessage = func() {
+		// 第一条消息输出后上游再推送一条消息
+		go hs.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	}
+	svr := newTestServer(t, newTestConf(addr, RouteMapping{
+		Method:  http.MethodGet,
+		Path:    "/watch",
+		RpcPath: testHealthWatch,
+		Plugins: []string{"abort"},
+		Stream:  StreamNDJSON,
+	}), abort)
+
+	// 流式响应已经开始输出，中止的错误作为最后一条返回，rpc 调用被取消
+	w := serveServer(svr, http.MethodGet, "/watch", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	assert.Equal(t, []string{`{"status":"SERVING"}`, `{"status":{"code":7,"msg":"denied"}}`}, lines)
+}
+
+// messagePlugin 在 OnReceiveMessage 中调用 fn 的插件
+type messagePlugin struct {
+	plainPlugin
+	fn func(pc *PluginContext, msg *dynamic.Message) *dynamic.Message
+}
+
+func (p *messagePlugin) OnReceiveMessage(pc *PluginContext, _ *http.Request, _ *desc.MethodDescriptor, msg *dynamic.Message) *dynamic.Message {
+	return p.fn(pc, msg)
+}
+
+func newMessageChain(plugins ...ContextRpcHandler) *GrpcChainHandler {
+	return &GrpcChainHandler{
+		request: httptest.NewRequest(http.MethodGet, "/health", http.NoBody),
+		pc:      NewPluginContext(),
+		chains:  plugins,
+	}
+}
+
+func TestHandleMessage(t *testing.T) {
+	var order []string
+	setStatus := func(name string, st healthpb.HealthCheckResponse_ServingStatus) *messagePlugin {
+		return &messagePlugin{plainPlugin: plainPlugin{name: name}, fn: func(_ *PluginContext, msg *dynamic.Message) *dynamic.Message {
+			order = append(order, name+":"+healthpb.HealthCheckResponse_ServingStatus_name[msg.GetFieldByName("status").(int32)])
+			msg.SetFieldByName("status", int32(st))
+			return msg
+		}}
+	}
+	keep := &messagePlugin{plainPlugin: plainPlugin{name: "keep"}, fn: func(*PluginContext, *dynamic.Message) *dynamic.Message {
+		order = append(order, "keep")
+		return nil
+	}}
+
+	// 按顺序调用，后面的插件收到前面修改后的消息，返回 nil 时不替换
+	h := newMessageChain(setStatus("a", healthpb.HealthCheckResponse_NOT_SERVING), &plainPlugin{name: "plain"}, keep,
+		setStatus("b", healthpb.HealthCheckResponse_SERVICE_UNKNOWN))
+	out := h.handleMessage(&healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING})
+	assert.Equal(t, []string{"a:SERVING", "keep", "b:NOT_SERVING"}, order)
+	msg, ok := out.(*dynamic.Message)
+	assert.True(t, ok)
+	assert.Equal(t, int32(healthpb.HealthCheckResponse_SERVICE_UNKNOWN), msg.GetFieldByName("status"))
+
+	// 没有 MessageHandler 时原样返回
+	in := &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING}
+	assert.Same(t, proto.Message(in), newMessageChain(&plainPlugin{name: "plain"}).handleMessage(in))
+}
+
+func TestHandleMessageReplace(t *testing.T) {
+	// 返回按其它描述构造的消息，之后的插件收到替换后的消息
+	replace := &messagePlugin{plainPlugin: plainPlugin{name: "replace"}, fn: func(_ *PluginContext, msg *dynamic.Message) *dynamic.Message {
+		md, err := desc.LoadMessageDescriptorForMessage(&healthpb.HealthCheckRequest{})
+		assert.NoError(t, err)
+		next := dynamic.NewMessage(md)
+		next.SetFieldByName("service", "replaced")
+		return next
+	}}
+	var got string
+	read := &messagePlugin{plainPlugin: plainPlugin{name: "read"}, fn: func(_ *PluginContext, msg *dynamic.Message) *dynamic.Message {
+		got = msg.GetFieldByName("service").(string)
+		return nil
+	}}
+
+	out := newMessageChain(replace, read).handleMessage(&healthpb.HealthCheckResponse{})
+	assert.Equal(t, "replaced", got)
+	assert.Equal(t, "grpc.health.v1.HealthCheckRequest", out.(*dynamic.Message).GetMessageDescriptor().GetFullyQualifiedName())
+}
+
+func TestHandleMessageAbort(t *testing.T) {
+	abort := &messagePlugin{plainPlugin: plainPlugin{name: "abort"}, fn: func(pc *PluginContext, msg *dynamic.Message) *dynamic.Message {
+		pc.Abort(newAbortError())
+		return nil
+	}}
+	called := false
+	after := &messagePlugin{plainPlugin: plainPlugin{name: "after"}, fn: func(*PluginContext, *dynamic.Message) *dynamic.Message {
+		called = true
+		return nil
+	}}
+
+	// 中止后之后的插件不再调用，响应不再输出
+	h := newMessageChain(abort, after)
+	h.OnReceiveResponse(&healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING})
+	assert.False(t, called)
+	assert.Error(t, h.pc.Err())
+	assert.Empty(t, h.body)
+}
+
+func TestMessageHandlerRoute(t *testing.T) {
+	addr, _ := newTestUpstream(t)
+	pl := &messagePlugin{plainPlugin: plainPlugin{name: "test"}, fn: func(_ *PluginContext, msg *dynamic.Message) *dynamic.Message {
+		msg.SetFieldByName("status", int32(healthpb.HealthCheckResponse_NOT_SERVING))
+		return msg
+	}}
+	svr := newTestServer(t, newTestConf(addr, testMapping(http.MethodGet, "/health", testHealthCheck)), pl)
+
+	// 修改后的消息只序列化一次，再经过插件的 OnReceiveResponse 输出
+	w := serveServer(svr, http.MethodGet, "/health", "")
+	assert.Equal(t, `{"status":"NOT_SERVING"}`, w.Body.String())
+}
+
+func TestMessageHandlerWhen(t *testing.T) {
+	addr, _ := newTestUpstream(t)
+	pl := &messagePlugin{plainPlugin: plainPlugin{name: "test"}, fn: func(_ *PluginContext, msg *dynamic.Message) *dynamic.Message {
+		msg.SetFieldByName("status", int32(healthpb.HealthCheckResponse_NOT_SERVING))
+		return msg
+	}}
+	svr := newTestServer(t, newTestConf(addr, RouteMapping{
+		Method:      http.MethodGet,
+		Path:        "/health",
+		RpcPath:     testHealthCheck,
+		PluginConfs: []PluginConf{{Name: "test", When: &PluginWhen{Query: map[string]string{"mask": "1"}}}},
+	}), pl)
+
+	// 条件不满足时跳过插件的 OnReceiveMessage
+	assert.Equal(t, `{"status":"SERVING"}`, serveServer(svr, http.MethodGet, "/health", "").Body.String())
+	assert.Equal(t, `{"status":"NOT_SERVING"}`, serveServer(svr, http.MethodGet, "/health?mask=1", "").Body.String())
+}
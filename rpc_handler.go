@@ -4,11 +4,13 @@ import (
 	"net/http"
 
 	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
 // RpcHandler Rpc处理
+// 需要读写请求级别的状态或中止请求时实现 ContextRpcHandler，插件实现两者之一即可
 type RpcHandler interface {
 	OnReceiveResponse(string, metadata.MD, http.ResponseWriter) string
 	OnReceiveTrailers(*status.Status, metadata.MD) metadata.MD
@@ -17,7 +19,27 @@ type RpcHandler interface {
 	OnReceiveHeaders(metadata.MD) metadata.MD
 }
 
-var _ RpcHandler = new(BasicRpcHandler)
+// ContextRpcHandler 带 PluginContext 的 Rpc处理，第一个参数为本次请求的 PluginContext
+// 插件同时实现 RpcHandler 时只调用 ContextRpcHandler
+type ContextRpcHandler interface {
+	OnReceiveResponse(*PluginContext, string, metadata.MD, http.ResponseWriter) string
+	OnReceiveTrailers(*PluginContext, *status.Status, metadata.MD) metadata.MD
+	OnResolveMethod(*PluginContext, *desc.MethodDescriptor)
+	OnSendHeaders(*PluginContext, *http.Request, metadata.MD) metadata.MD
+	OnReceiveHeaders(*PluginContext, metadata.MD) metadata.MD
+}
+
+// MessageHandler 可选接口，插件实现后在响应消息序列化为 JSON 之前调用
+// 可以直接读写 msg 的字段，如脱敏、计算字段；返回要输出的消息，通常就是 msg，返回 nil 时不替换，
+// 也可以返回按其它描述构造的消息以改名或增加字段。多个插件按顺序调用，响应消息只序列化一次
+type MessageHandler interface {
+	OnReceiveMessage(pc *PluginContext, r *http.Request, method *desc.MethodDescriptor, msg *dynamic.Message) *dynamic.Message
+}
+
+var (
+	_ RpcHandler        = new(BasicRpcHandler)
+	_ ContextRpcHandler = new(BasicContextRpcHandler)
+)
 
 // BasicRpcHandler RPC Handler 的基本实现
 type BasicRpcHandler struct {
@@ -41,3 +63,80 @@ func (h *BasicRpcHandler) OnSendHeaders(_ *http.Request, md metadata.MD) metadat
 func (h *BasicRpcHandler) OnReceiveHeaders(md metadata.MD) metadata.MD {
 	return md
 }
+
+// BasicContextRpcHandler ContextRpcHandler 的基本实现
+type BasicContextRpcHandler struct {
+}
+
+func (h *BasicContextRpcHandler) OnReceiveResponse(_ *PluginContext, respJson string, _ metadata.MD, _ http.ResponseWriter) string {
+	return respJson
+}
+
+func (h *BasicContextRpcHandler) OnReceiveTrailers(_ *PluginContext, _ *status.Status, md metadata.MD) metadata.MD {
+	return md
+}
+
+func (h *BasicContextRpcHandler) OnResolveMethod(_ *PluginContext, _ *desc.MethodDescriptor) {
+}
+
+func (h *BasicContextRpcHandler) OnSendHeaders(_ *PluginContext, _ *http.Request, md metadata.MD) metadata.MD {
+	return md
+}
+
+func (h *BasicContextRpcHandler) OnReceiveHeaders(_ *PluginContext, md metadata.MD) metadata.MD {
+	return md
+}
+
+// rpcPlugin 只实现了 RpcHandler 的插件，调用时忽略 PluginContext
+type rpcPlugin struct {
+	Plugin
+	handler RpcHandler
+}
+
+// rpcMessagePlugin 实现了 MessageHandler 的 rpcPlugin
+type rpcMessagePlugin struct {
+	*rpcPlugin
+}
+
+// contextPlugin 返回实现了 ContextRpcHandler 的插件，只实现了 RpcHandler 的插件包装后返回，都没有实现时返回 false
+func contextPlugin(pl Plugin) (Plugin, bool) {
+	if _, ok := pl.(ContextRpcHandler); ok {
+		return pl, true
+	}
+
+	h, ok := pl.(RpcHandler)
+	if !ok {
+		return nil, false
+	}
+
+	rp := &rpcPlugin{Plugin: pl, handler: h}
+	if _, ok := pl.(MessageHandler); ok {
+		return rpcMessagePlugin{rp}, true
+	}
+
+	return rp, true
+}
+
+func (p *rpcPlugin) OnReceiveResponse(_ *PluginContext, respJson string, md metadata.MD, w http.ResponseWriter) string {
+	return p.handler.OnReceiveResponse(respJson, md, w)
+}
+
+func (p *rpcPlugin) OnReceiveTrailers(_ *PluginContext, stat *status.Status, md metadata.MD) metadata.MD {
+	return p.handler.OnReceiveTrailers(stat, md)
+}
+
+func (p *rpcPlugin) OnResolveMethod(_ *PluginContext, method *desc.MethodDescriptor) {
+	p.handler.OnResolveMethod(method)
+}
+
+func (p *rpcPlugin) OnSendHeaders(_ *PluginContext, r *http.Request, md metadata.MD) metadata.MD {
+	return p.handler.OnSendHeaders(r, md)
+}
+
+func (p *rpcPlugin) OnReceiveHeaders(_ *PluginContext, md metadata.MD) metadata.MD {
+	return p.handler.OnReceiveHeaders(md)
+}
+
+func (p rpcMessagePlugin) OnReceiveMessage(pc *PluginContext, r *http.Request, method *desc.MethodDescriptor, msg *dynamic.Message) *dynamic.Message {
+	return p.Plugin.(MessageHandler).OnReceiveMessage(pc, r, method, msg)
+}
@@ -0,0 +1,90 @@
+package gateway
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/stretchr/testify/assert"
+	"github.com/zeromicro/go-zero/rest"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+)
+
+// legacyPlugin 只实现了 RpcHandler 的插件
+type legacyPlugin struct {
+	BasicRpcHandler
+	name string
+}
+
+func (p *legacyPlugin) Name() string { return p.name }
+
+func (p *legacyPlugin) Middleware() rest.Middleware { return nil }
+
+func (p *legacyPlugin) OnReceiveResponse(respJson string, _ metadata.MD, _ http.ResponseWriter) string {
+	return `{"legacy":` + respJson + `}`
+}
+
+// legacyMessagePlugin 只实现了 RpcHandler 和 MessageHandler 的插件
+type legacyMessagePlugin struct {
+	legacyPlugin
+}
+
+func (p *legacyMessagePlugin) OnReceiveMessage(_ *PluginContext, _ *http.Request, _ *desc.MethodDescriptor, msg *dynamic.Message) *dynamic.Message {
+	msg.SetFieldByName("status", int32(healthpb.HealthCheckResponse_NOT_SERVING))
+	return msg
+}
+
+// barePlugin 没有实现 RpcHandler 和 ContextRpcHandler 的插件
+type barePlugin struct {
+	name string
+}
+
+func (p *barePlugin) Name() string { return p.name }
+
+func (p *barePlugin) Middleware() rest.Middleware { return nil }
+
+func TestLegacyRpcHandler(t *testing.T) {
+	addr, _ := newTestUpstream(t)
+	c := newTestConf(addr, testMapping(http.MethodGet, "/health", testHealthCheck))
+
+	svr := newTestServer(t, c, &legacyPlugin{name: "test"})
+	assert.Equal(t, `{"legacy":{"status":"SERVING"}}`, serveServer(svr, http.MethodGet, "/health", "").Body.String())
+
+	// 只实现了 RpcHandler 的插件仍然可以实现 MessageHandler
+	svr = newTestServer(t, c, &legacyMessagePlugin{legacyPlugin{name: "test"}})
+	assert.Equal(t, `{"legacy":{"status":"NOT_SERVING"}}`, serveServer(svr, http.MethodGet, "/health", "").Body.String())
+}
+
+func TestContextPlugin(t *testing.T) {
+	pl, ok := contextPlugin(plain("test"))
+	assert.True(t, ok)
+	assert.Equal(t, plain("test"), pl)
+
+	pl, ok = contextPlugin(&legacyPlugin{name: "test"})
+	assert.True(t, ok)
+	assert.IsType(t, &rpcPlugin{}, pl)
+	assert.Implements(t, (*ContextRpcHandler)(nil), pl)
+	pl, ok = contextPlugin(&legacyMessagePlugin{legacyPlugin{name: "test"}})
+	assert.True(t, ok)
+	assert.Implements(t, (*MessageHandler)(nil), pl)
+
+	_, ok = contextPlugin(&barePlugin{name: "test"})
+	assert.False(t, ok)
+}
+
+func TestPluginWithoutRpcHandler(t *testing.T) {
+	addr, _ := newTestUpstream(t)
+	c := newTestConf(addr, testMapping(http.MethodGet, "/health", testHealthCheck))
+	svr := MustNewServer(c, WithPluginFactories(map[string]PluginFactory{
+		"test": func(*GatewayConf) (Plugin, error) {
+			return &barePlugin{name: "test"}, nil
+		},
+	}))
+
+	err := svr.Reload(c)
+	assert.ErrorContains(t, err, "未实现 RpcHandler 或 ContextRpcHandler")
+	_, ok := svr.plugin.plugins["test"]
+	assert.False(t, ok)
+}
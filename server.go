@@ -2,47 +2,143 @@ package gateway
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/punpeo/pun-gateway-lib/internal"
 	"github.com/punpeo/punpeo-lib/rest/result"
 	"github.com/punpeo/punpeo-lib/rest/xerr"
 	"net/http"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/fullstorydev/grpcurl"
 	"github.com/golang/protobuf/jsonpb"
 	"github.com/jhump/protoreflect/grpcreflect"
 	"github.com/zeromicro/go-zero/core/logx"
 	"github.com/zeromicro/go-zero/core/mr"
+	"github.com/zeromicro/go-zero/core/threading"
 	"github.com/zeromicro/go-zero/rest"
 	"github.com/zeromicro/go-zero/rest/httpx"
+	"github.com/zeromicro/go-zero/rest/pathvar"
 	"github.com/zeromicro/go-zero/zrpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type (
 	// Server is a gateway server.
 	Server struct {
 		*rest.Server
-		upstreams []Upstream
 		//jz-gateway 添加 http.Request 拦截的异常捕获
 		processHeader func(http.Header, *http.Request) []string
 		dialer        func(conf zrpc.RpcClientConf) zrpc.Client
-		Config        *GatewayConf
-		plugin        *PluginManager
+		// Config 启动时的配置，热更新后的配置通过 RequestConfig 获取
+		Config *GatewayConf
+		plugin *PluginManager
+		// formatters 响应格式的名称和对应的 ResponseFormatter
+		formatters map[string]ResponseFormatter
+		// factories 插件的构造函数，配置中用到但未注册的插件由它创建
+		factories map[string]PluginFactory
+		// router 网关路由，热更新时整体替换
+		router *gatewayRouter
+
+		// reloadLock 保证同一时间只有一次热更新
+		reloadLock sync.Mutex
+		// current 当前生效的路由快照
+		current *snapshot
+		// conns 上游连接，配置不变的上游在热更新时复用
+		conns    map[string]zrpc.Client
+		connLock sync.Mutex
+		// refresh 调用返回 Unimplemented 时通知刷新反射描述
+		refresh chan struct{}
+		// done 停止配置监听
+		done     chan struct{}
+		stopOnce sync.Once
+	}
+
+	// gatewayRoute 网关路由，stream 表示服务端流式路由
+	gatewayRoute struct {
+		rest.Route
+		stream bool
+	}
+
+	// snapshot 一份配置对应的路由、插件和上游连接，构造后不再修改
+	snapshot struct {
+		conf   *GatewayConf
+		plugin *PluginManager
+		table  *routeTable
+		routes []string
+		// upstreams 上游名称到上游状态
+		upstreams map[string]*upstreamState
+	}
+
+	// upstreamState 构造快照时上游的连接和描述
+	upstreamState struct {
+		// key 上游连接的 key
+		key string
+		cli zrpc.Client
+		// reflection 是否通过反射获取描述
+		reflection bool
+		// reflectClient 反射描述使用的客户端，快照被替换后 Reset，关闭反射的 stream
+		reflectClient *grpcreflect.Client
+		// cached 反射失败，使用了描述缓存
+		cached bool
+		// digest 反射描述的摘要
+		digest string
+		// methods 上游的 rpc 方法
+		methods []string
+	}
+
+	// rpcTarget 路由调用的 rpc 方法及其选项
+	rpcTarget struct {
+		source   grpcurl.DescriptorSource
+		resolver jsonpb.AnyResolver
+		cli      zrpc.Client
+		rpcPath  string
+		origName bool
+		tpl      *internal.PathTemplate
+		// stream 服务端流式方法的输出方式
+		stream string
+		// body、responseBody 对应 google.api.HttpRule 的 body 和 response_body
+		body         string
+		responseBody string
+		// annotated 路由来自 google.api.http 注解，body 为空时请求体不映射字段；配置文件中的路由请求体合并到请求消息中
+		annotated bool
+		// errors gRPC 错误的输出方式
+		errors *errorWriter
+		// formatter 响应格式，nil 时使用插件输出
+		formatter ResponseFormatter
 	}
 
 	// Option defines the method to customize Server.
 	Option func(svr *Server)
 )
 
+// upstreamCloseDelay 上游被移除后，等待进行中的请求结束再关闭连接
+const upstreamCloseDelay = time.Minute
+
 // MustNewServer creates a new gateway server.
 func MustNewServer(c *GatewayConf, opts ...Option) *Server {
 	svr := &Server{
-		upstreams: c.Upstreams,
-		Server:    rest.MustNewServer(c.RestConf),
-		Config:    c,
-		plugin:    NewPluginManager(),
+		Config:     c,
+		plugin:     NewPluginManager(),
+		formatters: defaultFormatters(),
+		router:     newGatewayRouter(c.RestConf),
+		conns:      make(map[string]zrpc.Client),
+		refresh:    make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	// 通过 AddRoute 添加的路由由 go-zero 构造原生中间件，rest.WithTimeout、rest.WithMaxBytes 等路由选项照常生效
+	svr.Server = rest.MustNewServer(c.RestConf, rest.WithRouter(svr.router))
+	if len(c.ReadyPath) > 0 {
+		svr.Server.AddRoute(rest.Route{
+			Method:  http.MethodGet,
+			Path:    c.ReadyPath,
+			Handler: svr.readyHandler,
+		})
 	}
 	for _, opt := range opts {
 		opt(svr)
@@ -51,77 +147,246 @@ func MustNewServer(c *GatewayConf, opts ...Option) *Server {
 	return svr
 }
 
-// Register 注册插件
+// Register 注册插件，需要在 Start 之前调用
 func (s *Server) Register(p Plugin) {
 	s.plugin.Register(p)
 }
 
+// GetPlugin 获取已注册或由构造函数创建的插件，如调用 jzAuth 的 InvalidateToken
+func (s *Server) GetPlugin(name string) (Plugin, bool) {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+
+	pl, ok := s.plugin.plugins[name]
+	return pl, ok
+}
+
+// RegisterFormatter 注册响应格式，可以覆盖内置的格式，需要在 Start 之前调用
+func (s *Server) RegisterFormatter(name string, f ResponseFormatter) {
+	if len(name) == 0 || f == nil {
+		logx.Must(errors.New("响应格式的名称或对象为空"))
+	}
+
+	s.formatters[name] = f
+}
+
+// formatter 按名称获取响应格式，名称为空时返回 nil
+func (s *Server) formatter(name string) (ResponseFormatter, error) {
+	if len(name) == 0 {
+		return nil, nil
+	}
+
+	f, ok := s.formatters[name]
+	if !ok {
+		return nil, fmt.Errorf("找不到响应格式：%s", name)
+	}
+
+	return f, nil
+}
+
+// Use 添加中间件，对网关路由和通过 AddRoute 添加的路由都生效，需要在 Start 之前调用
+func (s *Server) Use(middleware rest.Middleware) {
+	s.router.middlewares = append(s.router.middlewares, middleware)
+	s.Server.Use(middleware)
+}
+
 // Start starts the gateway server.
 func (s *Server) Start() {
-	LoadRouteMap(s.Config)
-	logx.Must(s.build())
+	logx.Must(s.Reload(s.Config))
+	// 启动时插件未就绪则启动失败
+	logx.Must(s.checkHealth())
+	logx.Must(s.watchConfig())
+	threading.GoSafe(func() {
+		s.watchDescriptors(s.Config.DescriptorRefresh)
+	})
 	s.Server.Start()
 }
 
 // Stop stops the gateway server.
+// 停止接收请求后按注册的逆序停止插件
 func (s *Server) Stop() {
-	s.Server.Stop()
+	s.stopOnce.Do(func() {
+		close(s.done)
+		s.Server.Stop()
+		s.stopPlugins()
+	})
+}
+
+// Reload 按新的配置重建网关路由和插件并原子替换，进行中的请求继续使用旧的路由
+// 构造失败时保留当前路由并返回错误，RestConf 的修改需要重启才能生效
+func (s *Server) Reload(c *GatewayConf) error {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+
+	return s.reload(c)
 }
 
-func (s *Server) build() error {
-	if err := s.ensureUpstreamNames(); err != nil {
+func (s *Server) reload(c *GatewayConf) error {
+	created, err := s.loadPlugins(c)
+	if err != nil {
 		return err
 	}
+	// 插件在构造路由之前启动，ForRoute 可以使用 Init 中建立的连接
+	if err := s.startPlugins(c); err != nil {
+		s.removePlugins(created)
+		return err
+	}
+
+	LoadRouteMap(c)
+	snap, err := s.build(c)
+	if err != nil {
+		s.releaseConns(snap, s.current)
+		s.removePlugins(created)
+		return err
+	}
+
+	s.router.swap(snap.table)
+	old := s.current
+	s.current = snap
+	if old != nil {
+		logRouteChanges(old.routes, snap.routes)
+		s.releaseConns(old, snap)
+	}
+
+	return nil
+}
 
-	return mr.MapReduceVoid(func(source chan<- Upstream) {
-		for _, up := range s.upstreams {
+// build 构造一份路由快照，出错时返回的快照只记录了已建立的上游连接
+func (s *Server) build(c *GatewayConf) (*snapshot, error) {
+	snap := &snapshot{
+		conf:      c,
+		plugin:    s.plugin.fork(),
+		upstreams: make(map[string]*upstreamState),
+	}
+
+	if err := ensureUpstreamNames(c.Upstreams); err != nil {
+		return snap, err
+	}
+
+	gwErrors, err := newErrorWriter(c.Errors, nil)
+	if err != nil {
+		return snap, err
+	}
+	gwFormatter, err := s.formatter(c.Formatter)
+	if err != nil {
+		return snap, err
+	}
+	proxies, err := internal.NewTrustedProxies(c.TrustedProxies)
+	if err != nil {
+		return snap, err
+	}
+
+	var (
+		lock   sync.Mutex
+		routes []gatewayRoute
+	)
+	err = mr.MapReduceVoid(func(source chan<- Upstream) {
+		for _, up := range c.Upstreams {
 			source <- up
 		}
-	}, func(up Upstream, writer mr.Writer[rest.Route], cancel func(error)) {
-		var cli zrpc.Client
-		if s.dialer != nil {
-			cli = s.dialer(up.Grpc)
-		} else {
-			cli = zrpc.MustNewClient(up.Grpc)
+	}, func(up Upstream, writer mr.Writer[gatewayRoute], cancel func(error)) {
+		key, cli, err := s.upstreamConn(up, c.DescriptorCache)
+		if err != nil {
+			cancel(fmt.Errorf("%s: %w", up.Name, err))
+			return
+		}
+
+		state := &upstreamState{
+			key:        key,
+			cli:        cli,
+			reflection: len(up.ProtoSets) == 0 && len(up.ProtoFiles) == 0,
 		}
+		lock.Lock()
+		snap.upstreams[up.Name] = state
+		lock.Unlock()
 
-		source, err := s.createDescriptorSource(cli, up)
+		source, reflectClient, err := s.createDescriptorSource(cli, up)
+		state.reflectClient = reflectClient
 		if err != nil {
 			cancel(fmt.Errorf("%s: %w", up.Name, err))
 			return
 		}
 
 		methods, err := internal.GetMethods(source)
+		if err != nil && state.reflection && hasDescriptorCache(c.DescriptorCache, up.Name) {
+			// 反射不可用时使用上次成功获取的描述，后台继续重试反射
+			logx.Errorf("%s: 获取反射描述失败，使用描述缓存，%v", up.Name, err)
+			state.cached = true
+			source, err = grpcurl.DescriptorSourceFromProtoSets(descriptorCacheFile(c.DescriptorCache, up.Name))
+			if err == nil {
+				methods, err = internal.GetMethods(source)
+			}
+		}
 		if err != nil {
 			cancel(fmt.Errorf("%s: %w", up.Name, err))
 			return
 		}
 
+		for _, m := range methods {
+			state.methods = append(state.methods, m.RpcPath)
+		}
+		if state.reflection && !state.cached {
+			// 摘要只用于判断描述是否变化，失败时下次刷新会重建路由
+			if state.digest, err = internal.DescriptorDigest(source); err != nil {
+				logx.Errorf("%s: %v", up.Name, err)
+			}
+			if err := saveDescriptorCache(c.DescriptorCache, up.Name, source); err != nil {
+				logx.Errorf("%s: 保存描述缓存失败，%v", up.Name, err)
+			}
+		}
+
 		resolver := grpcurl.AnyResolverFromDescriptorSource(source)
+		pm := snap.plugin
 		for _, m := range methods {
 			if len(m.HttpMethod) > 0 && len(m.HttpPath) > 0 {
+				tpl, err := internal.ParsePathTemplate(m.HttpTemplate)
+				if err != nil {
+					cancel(fmt.Errorf("%s: %w", up.Name, err))
+					return
+				}
+
 				route := rest.Route{
-					Method:  m.HttpMethod,
-					Path:    m.HttpPath,
-					Handler: s.buildHandler(source, resolver, cli, m.RpcPath, false),
+					Method: m.HttpMethod,
+					Path:   m.HttpPath,
+					Handler: s.buildHandler(pm, rpcTarget{
+						source:       source,
+						resolver:     resolver,
+						cli:          cli,
+						rpcPath:      m.RpcPath,
+						tpl:          tpl,
+						body:         m.Body,
+						responseBody: m.ResponseBody,
+						annotated:    true,
+						errors:       gwErrors,
+						formatter:    gwFormatter,
+					}),
 				}
 
 				// 设置中间件
-				route = s.plugin.WrapMiddleware(&route)
-				writer.Write(route)
+				lock.Lock()
+				route = pm.WrapMiddleware(&route)
+				lock.Unlock()
+				writer.Write(gatewayRoute{Route: route, stream: m.ServerStreaming})
 			}
 		}
 
-		methodSet := make(map[string]struct{})
+		methodSet := make(map[string]internal.Method)
 		for _, m := range methods {
-			methodSet[m.RpcPath] = struct{}{}
+			methodSet[m.RpcPath] = m
 		}
 
 		for _, m := range up.Mappings {
-			// 加载路由对应插件
-			s.plugin.LoadRouteMapping(&up, &m)
+			// 加载路由对应插件，pluginRoutes 在各上游间共用
+			lock.Lock()
+			err := pm.LoadRouteMapping(&up, &m)
+			lock.Unlock()
+			if err != nil {
+				cancel(fmt.Errorf("%s: %w", up.Name, err))
+				return
+			}
 
-			if _, ok := methodSet[m.RpcPath]; !ok {
+			method, ok := methodSet[m.RpcPath]
+			if !ok {
 				cancel(fmt.Errorf("%s: rpc method %s not found", up.Name, m.RpcPath))
 				return
 			}
@@ -132,27 +397,236 @@ func (s *Server) build() error {
 				origName = *m.OrigName
 			}
 
+			tpl, err := internal.ParsePathTemplate(m.Path)
+			if err != nil {
+				cancel(fmt.Errorf("%s: %w", up.Name, err))
+				return
+			}
+
+			errs, err := newErrorWriter(c.Errors, m.Errors)
+			if err != nil {
+				cancel(fmt.Errorf("%s: %w", up.Name, err))
+				return
+			}
+			formatter := gwFormatter
+			if len(m.Formatter) > 0 {
+				if formatter, err = s.formatter(m.Formatter); err != nil {
+					cancel(fmt.Errorf("%s: %w", up.Name, err))
+					return
+				}
+			}
+
+			target := rpcTarget{
+				source:    source,
+				resolver:  resolver,
+				cli:       cli,
+				rpcPath:   m.RpcPath,
+				origName:  origName,
+				tpl:       tpl,
+				stream:    m.Stream,
+				errors:    errs,
+				formatter: formatter,
+			}
 			route := rest.Route{
 				Method:  strings.ToUpper(m.Method),
-				Path:    m.Path,
-				Handler: s.buildHandler(source, resolver, cli, m.RpcPath, origName),
+				Path:    tpl.RoutePath,
+				Handler: s.buildHandler(pm, target),
+			}
+
+			if m.WebSocket {
+				if route.Method != http.MethodGet || !method.ClientStreaming {
+					cancel(fmt.Errorf("%s: websocket route %s must be get and map to a client or bidi streaming method", up.Name, m.Path))
+					return
+				}
+				route.Handler = s.buildWebSocketHandler(pm, target)
 			}
 
 			// 设置中间件
-			route = s.plugin.WrapMiddleware(&route)
-			writer.Write(route)
+			lock.Lock()
+			err = pm.CheckRouteOutput(route.Method, route.Path, RouteOutput{
+				Formatted: formatter != nil,
+				WebSocket: m.WebSocket,
+				Stream:    method.ServerStreaming && !m.WebSocket,
+			})
+			if err == nil {
+				route = pm.WrapMiddleware(&route)
+			}
+			lock.Unlock()
+			if err != nil {
+				cancel(fmt.Errorf("%s: %w", up.Name, err))
+				return
+			}
+			writer.Write(gatewayRoute{Route: route, stream: method.ServerStreaming && !m.WebSocket})
 		}
-	}, func(pipe <-chan rest.Route, cancel func(error)) {
+	}, func(pipe <-chan gatewayRoute, cancel func(error)) {
 		for route := range pipe {
-			s.Server.AddRoute(route)
+			// 插件读取的配置与路由属于同一份快照
+			route.Handler = routeConfigMiddleware(c, proxies)(route.Handler)
+			routes = append(routes, route)
 		}
 	})
+	if err != nil {
+		return snap, err
+	}
+
+	snap.table, err = s.router.newTable(routes)
+	if err != nil {
+		return snap, err
+	}
+
+	for _, route := range routes {
+		snap.routes = append(snap.routes, route.Method+" "+route.Path)
+	}
+	sort.Strings(snap.routes)
+
+	return snap, nil
+}
+
+// upstreamConn 获取上游连接，Grpc 和 ProtoSets 配置都相同的上游复用同一个连接
+// 在锁外建立连接，各上游并行连接；相同配置的上游同时连接时保留先完成的，关闭另一个
+func (s *Server) upstreamConn(up Upstream, cacheDir string) (string, zrpc.Client, error) {
+	bs, _ := json.Marshal([]interface{}{up.Grpc, up.ProtoSets})
+	key := string(bs)
+
+	s.connLock.Lock()
+	cli, ok := s.conns[key]
+	s.connLock.Unlock()
+	if ok {
+		return key, cli, nil
+	}
+
+	cli, err := s.dial(up, cacheDir)
+	if err != nil {
+		return "", nil, err
+	}
+
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+
+	if exist, ok := s.conns[key]; ok {
+		if err := cli.Conn().Close(); err != nil {
+			logx.Error(err)
+		}
+		return key, exist, nil
+	}
+	s.conns[key] = cli
+
+	return key, cli, nil
+}
+
+// dial 建立上游连接，连接失败但有描述缓存时，以非阻塞方式建立连接，上游恢复后自动重连
+func (s *Server) dial(up Upstream, cacheDir string) (zrpc.Client, error) {
+	if s.dialer != nil {
+		return s.dialer(up.Grpc), nil
+	}
+
+	cli, err := zrpc.NewClient(up.Grpc)
+	if err == nil {
+		return cli, nil
+	}
+	if len(up.ProtoSets) > 0 || len(up.ProtoFiles) > 0 || !hasDescriptorCache(cacheDir, up.Name) {
+		return nil, err
+	}
+
+	logx.Errorf("%s: 连接上游失败，使用描述缓存，%v", up.Name, err)
+	conf := up.Grpc
+	conf.NonBlock = true
+	return zrpc.NewClient(conf)
 }
 
-func (s *Server) buildHandler(source grpcurl.DescriptorSource, resolver jsonpb.AnyResolver,
-	cli zrpc.Client, rpcPath string, origName bool) func(http.ResponseWriter, *http.Request) {
+// releaseConns 关闭 from 用到而 keep 没用到的上游连接，并关闭 from 的反射客户端
+func (s *Server) releaseConns(from, keep *snapshot) {
+	if from == nil {
+		return
+	}
+
+	for _, st := range from.upstreams {
+		if client := st.reflectClient; client != nil {
+			// 进行中的请求仍可能通过旧快照查找描述，与连接一样延迟关闭
+			time.AfterFunc(upstreamCloseDelay, client.Reset)
+		}
+	}
+
+	keepKeys := make(map[string]struct{})
+	if keep != nil {
+		for _, st := range keep.upstreams {
+			keepKeys[st.key] = struct{}{}
+		}
+	}
+
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+
+	for _, st := range from.upstreams {
+		key := st.key
+		if _, ok := keepKeys[key]; ok {
+			continue
+		}
+
+		cli, ok := s.conns[key]
+		if !ok {
+			continue
+		}
+
+		delete(s.conns, key)
+		time.AfterFunc(upstreamCloseDelay, func() {
+			if err := cli.Conn().Close(); err != nil {
+				logx.Error(err)
+			}
+		})
+	}
+}
+
+// logRouteChanges 记录热更新前后路由的变化
+func logRouteChanges(old, cur []string) {
+	added, removed := diffStrings(old, cur)
+	for _, r := range added {
+		logx.Infof("网关路由新增：%s", r)
+	}
+	for _, r := range removed {
+		logx.Infof("网关路由移除：%s", r)
+	}
+
+	logx.Infof("网关配置已更新，共 %d 条路由", len(cur))
+}
+
+// diffStrings 返回 cur 中新增的和 old 中被移除的元素
+func diffStrings(old, cur []string) (added, removed []string) {
+	oldSet := make(map[string]struct{}, len(old))
+	for _, v := range old {
+		oldSet[v] = struct{}{}
+	}
+	curSet := make(map[string]struct{}, len(cur))
+	for _, v := range cur {
+		curSet[v] = struct{}{}
+		if _, ok := oldSet[v]; !ok {
+			added = append(added, v)
+		}
+	}
+	for _, v := range old {
+		if _, ok := curSet[v]; !ok {
+			removed = append(removed, v)
+		}
+	}
+
+	return
+}
+
+func (s *Server) buildHandler(pm *PluginManager, t rpcTarget) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		parser, err := internal.NewRequestParser(r, resolver)
+		if t.tpl != nil {
+			// 还原 {name=shelves/*} 这类变量
+			r = pathvar.WithVars(r, t.tpl.Vars(pathvar.Vars(r)))
+		}
+
+		// 插件在中间件中中止请求时不再解析请求
+		if abort := PluginContextFromRequest(r).Err(); abort != nil {
+			logx.WithContext(r.Context()).Infof("插件中止请求,%v", abort)
+			t.format(w, &Response{Request: r, Status: status.Convert(abort), err: abort})
+			return
+		}
+
+		parser, err := internal.NewRequestParserWithBody(r, t.resolver, t.body, t.annotated)
 		if err != nil {
 			//jz-gateway 调整返回值
 			httpx.WriteJson(w, http.StatusOK, &result.ResponseSuccessBean{Code: xerr.SERVER_COMMON_ERROR, Msg: err.Error(), Data: "请求参数解析错误"})
@@ -162,17 +636,43 @@ func (s *Server) buildHandler(source grpcurl.DescriptorSource, resolver jsonpb.A
 
 		// 设置RPC事件处理器
 		// handler := internal.NewEventHandler(w, resolver)
-		handler := s.plugin.GetRpcHandler(w, r, resolver, origName) //采用插件处理返回格式
-
-		if err := grpcurl.InvokeRPC(r.Context(), source, cli.Conn(), rpcPath, s.prepareMetadata(r.Header, r),
-			handler, parser.Next); err != nil {
+		handler := pm.GetRpcHandler(w, r, t.resolver, t.origName, t.stream) //采用插件处理返回格式
+		handler.responseBody = t.responseBody
+		handler.formatter = t.formatter
+		handler.pc.setFormatted(t.formatter != nil)
+
+		// 插件中止请求时取消 rpc 调用
+		ctx, cancel := handler.pc.withCancel(r.Context())
+		defer cancel()
+
+		err = grpcurl.InvokeRPC(ctx, t.source, t.cli.Conn(), t.rpcPath, s.prepareMetadata(r.Header, r),
+			handler, parser.Next)
+		if abort := handler.pc.Err(); abort != nil {
+			logx.WithContext(r.Context()).Infof("插件中止请求,%v", abort)
+			err = abort
+		} else if err != nil {
 			//jz-gateway 调整返回值
 			logx.Errorf("rpc调用失败,%+v", err.Error())
-			httpx.WriteJson(w, http.StatusOK, &result.ResponseSuccessBean{Code: xerr.SERVER_COMMON_ERROR, Msg: err.Error()})
+		}
+		if err != nil {
+			// 流式响应已经开始输出，错误作为最后一个事件返回
+			if handler.finishStream(status.Convert(err)) {
+				return
+			}
+
+			t.format(w, &Response{Request: r, Header: handler.respHeader, Status: status.Convert(err), err: err})
 			return
 		}
 
 		st := handler.Status
+		if st.Code() == codes.Unimplemented {
+			// 上游可能已经更新，重新获取反射描述
+			s.requestRefresh()
+		}
+		if handler.finishStream(st) {
+			return
+		}
+
 		if st.Code() != codes.OK {
 			//jz-gateway 调整返回值
 			// if handler.XStatusCode != 0 { //自定义code
@@ -184,37 +684,35 @@ func (s *Server) buildHandler(source grpcurl.DescriptorSource, resolver jsonpb.A
 			// 	return
 			// }
 			logx.Errorf("rpc响应失败,%+v", st.Err())
-			httpx.WriteJson(w, http.StatusOK, &result.ResponseSuccessBean{Code: xerr.SERVER_COMMON_ERROR, Msg: st.Message()})
-			return
 		}
+		handler.writeBody()
+		t.format(w, handler.response(r))
 	}
 }
 
-func (s *Server) createDescriptorSource(cli zrpc.Client, up Upstream) (grpcurl.DescriptorSource, error) {
-	var source grpcurl.DescriptorSource
-	var err error
-
+// createDescriptorSource 通过反射获取描述时同时返回反射客户端，由调用方在不再使用时 Reset
+func (s *Server) createDescriptorSource(cli zrpc.Client, up Upstream) (grpcurl.DescriptorSource, *grpcreflect.Client, error) {
 	if len(up.ProtoSets) > 0 {
-		source, err = grpcurl.DescriptorSourceFromProtoSets(up.ProtoSets...)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		client := grpcreflect.NewClientAuto(context.Background(), cli.Conn())
-		source = grpcurl.DescriptorSourceFromServer(context.Background(), client)
+		source, err := grpcurl.DescriptorSourceFromProtoSets(up.ProtoSets...)
+		return source, nil, err
+	}
+	if len(up.ProtoFiles) > 0 {
+		source, err := internal.DescriptorSourceFromProtoFiles(up.ImportPaths, up.ProtoFiles...)
+		return source, nil, err
 	}
 
-	return source, nil
+	client := grpcreflect.NewClientAuto(context.Background(), cli.Conn())
+	return grpcurl.DescriptorSourceFromServer(context.Background(), client), client, nil
 }
 
-func (s *Server) ensureUpstreamNames() error {
-	for i := 0; i < len(s.upstreams); i++ {
-		target, err := s.upstreams[i].Grpc.BuildTarget()
+func ensureUpstreamNames(upstreams []Upstream) error {
+	for i := 0; i < len(upstreams); i++ {
+		target, err := upstreams[i].Grpc.BuildTarget()
 		if err != nil {
 			return err
 		}
 
-		s.upstreams[i].Name = target
+		upstreams[i].Name = target
 	}
 
 	return nil
@@ -237,6 +735,13 @@ func WithHeaderProcessor(processHeader func(http.Header, *http.Request) []string
 	}
 }
 
+// WithPluginFactories 设置插件的构造函数，启动和配置热更新时只创建配置中用到且未通过 Register 注册的插件
+func WithPluginFactories(factories map[string]PluginFactory) Option {
+	return func(s *Server) {
+		s.factories = factories
+	}
+}
+
 // withDialer sets a dialer to create a gRPC client.
 func withDialer(dialer func(conf zrpc.RpcClientConf) zrpc.Client) func(*Server) {
 	return func(s *Server) {
@@ -245,24 +750,29 @@ func withDialer(dialer func(conf zrpc.RpcClientConf) zrpc.Client) func(*Server)
 }
 
 // LoadRouteMap 加载配置转map
+// 路径统一按路由模板记录，如 /users/{id} 记为 /users/:id，与 RoutePath 的返回值一致
 func LoadRouteMap(c *GatewayConf) {
 	AuthCheckMapping := make(map[string]map[string]bool)
 	VerifyFuncControlMapping := make(map[string]map[string]bool)
 	UpstreamsRouteMap := make(map[string]map[string]RouteMapping)
 	for _, upstream := range c.Upstreams {
 		for _, mapping := range upstream.Mappings {
+			path := mapping.Path
+			if tpl, err := internal.ParsePathTemplate(mapping.Path); err == nil {
+				path = tpl.RoutePath
+			}
 			if _, ok := AuthCheckMapping[strings.ToLower(mapping.Method)]; !ok {
-				AuthCheckMapping[strings.ToLower(mapping.Method)] = map[string]bool{strings.ToLower(mapping.Path): mapping.AuthCheck}
+				AuthCheckMapping[strings.ToLower(mapping.Method)] = map[string]bool{strings.ToLower(path): mapping.AuthCheck}
 			}
-			AuthCheckMapping[strings.ToLower(mapping.Method)][strings.ToLower(mapping.Path)] = mapping.AuthCheck
+			AuthCheckMapping[strings.ToLower(mapping.Method)][strings.ToLower(path)] = mapping.AuthCheck
 			if _, ok := VerifyFuncControlMapping[strings.ToLower(mapping.Method)]; !ok {
-				VerifyFuncControlMapping[strings.ToLower(mapping.Method)] = map[string]bool{strings.ToLower(mapping.Path): mapping.AuthCheck}
+				VerifyFuncControlMapping[strings.ToLower(mapping.Method)] = map[string]bool{strings.ToLower(path): mapping.AuthCheck}
 			}
-			VerifyFuncControlMapping[strings.ToLower(mapping.Method)][strings.ToLower(mapping.Path)] = mapping.VerifyFuncControl
+			VerifyFuncControlMapping[strings.ToLower(mapping.Method)][strings.ToLower(path)] = mapping.VerifyFuncControl
 			if _, ok := UpstreamsRouteMap[strings.ToLower(mapping.Method)]; !ok {
 				UpstreamsRouteMap[strings.ToLower(mapping.Method)] = make(map[string]RouteMapping)
 			}
-			UpstreamsRouteMap[strings.ToLower(mapping.Method)][strings.ToLower(mapping.Path)] = mapping
+			UpstreamsRouteMap[strings.ToLower(mapping.Method)][strings.ToLower(path)] = mapping
 
 		}
 	}
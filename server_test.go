@@ -0,0 +1,143 @@
+package gateway
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zeromicro/go-zero/rest"
+	"github.com/zeromicro/go-zero/zrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+)
+
+const (
+	testHealthCheck = "grpc.health.v1.Health/Check"
+	testHealthWatch = "grpc.health.v1.Health/Watch"
+)
+
+// newTestUpstream 启动提供 grpc.health.v1.Health 和反射服务的上游，返回地址
+func newTestUpstream(t *testing.T) (string, *health.Server) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	svr := grpc.NewServer()
+	hs := health.NewServer()
+	healthpb.RegisterHealthServer(svr, hs)
+	reflection.Register(svr)
+	go func() {
+		_ = svr.Serve(lis)
+	}()
+	t.Cleanup(func() {
+		hs.Shutdown()
+		svr.Stop()
+	})
+
+	return lis.Addr().String(), hs
+}
+
+// testMapping 使用 test 插件的路由
+func testMapping(method, path, rpcPath string) RouteMapping {
+	return RouteMapping{
+		Method:  method,
+		Path:    path,
+		RpcPath: rpcPath,
+		Plugins: []string{"test"},
+	}
+}
+
+func newTestConf(addr string, mappings ...RouteMapping) *GatewayConf {
+	return &GatewayConf{
+		RestConf: rest.RestConf{Host: "127.0.0.1", Timeout: 3000},
+		Upstreams: []Upstream{{
+			Grpc:     zrpc.RpcClientConf{Target: addr},
+			Mappings: mappings,
+		}},
+	}
+}
+
+// newTestServer 创建网关并加载配置，没有注册 test 插件时注册一个不做处理的 test 插件
+func newTestServer(t *testing.T, c *GatewayConf, plugins ...Plugin) *Server {
+	svr := MustNewServer(c)
+	for _, pl := range plugins {
+		svr.Register(pl)
+	}
+	if _, ok := svr.plugin.plugins["test"]; !ok {
+		svr.Register(plain("test"))
+	}
+	assert.NoError(t, svr.Reload(c))
+	t.Cleanup(func() {
+		svr.releaseConns(svr.current, nil)
+	})
+
+	return svr
+}
+
+func serveServer(svr *Server, method, target, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if len(body) > 0 {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	svr.ServeHTTP(w, r)
+
+	return w
+}
+
+func TestServerRoute(t *testing.T) {
+	addr, hs := newTestUpstream(t)
+	hs.SetServingStatus("order", healthpb.HealthCheckResponse_NOT_SERVING)
+	svr := newTestServer(t, newTestConf(addr,
+		testMapping(http.MethodGet, "/health", testHealthCheck),
+		testMapping(http.MethodGet, "/health/:service", testHealthCheck),
+	))
+
+	w := serveServer(svr, http.MethodGet, "/health", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `{"status":"SERVING"}`, w.Body.String())
+
+	// 路径变量和 query 参数映射到请求消息
+	w = serveServer(svr, http.MethodGet, "/health/order", "")
+	assert.Equal(t, `{"status":"NOT_SERVING"}`, w.Body.String())
+	w = serveServer(svr, http.MethodGet, "/health?service=order", "")
+	assert.Equal(t, `{"status":"NOT_SERVING"}`, w.Body.String())
+
+	// rpc 返回错误时输出 {code,msg,data}
+	w = serveServer(svr, http.MethodGet, "/health/unknown", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"msg":"unknown service"`)
+
+	w = serveServer(svr, http.MethodPost, "/health", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.Equal(t, http.MethodGet, w.Header().Get("Allow"))
+}
+
+func TestServerAddRouteOptions(t *testing.T) {
+	addr, _ := newTestUpstream(t)
+	c := newTestConf(addr, testMapping(http.MethodPost, "/health", testHealthCheck))
+	c.MaxBytes = 1 << 20
+	c.Middlewares.MaxBytes = true
+	svr := MustNewServer(c)
+	svr.Register(plain("test"))
+	svr.AddRoute(rest.Route{
+		Method: http.MethodPost,
+		Path:   "/upload",
+		Handler: func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		},
+	}, rest.WithMaxBytes(4))
+	assert.NoError(t, svr.Reload(c))
+	defer svr.releaseConns(svr.current, nil)
+
+	// AddRoute 的路由选项由 go-zero 处理，不影响网关路由
+	assert.Equal(t, http.StatusRequestEntityTooLarge, serveServer(svr, http.MethodPost, "/upload", "0123456789").Code)
+	assert.Equal(t, http.StatusNoContent, serveServer(svr, http.MethodPost, "/upload", "0123").Code)
+	w := serveServer(svr, http.MethodPost, "/health", `{"service":""}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `{"status":"SERVING"}`, w.Body.String())
+}
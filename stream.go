@@ -0,0 +1,158 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/punpeo/pun-gateway-lib/internal"
+	"github.com/zeromicro/go-zero/rest/httpx"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// StreamSSE 服务端流式方法以 text/event-stream 输出，每条消息一个事件
+	StreamSSE = "sse"
+	// StreamNDJSON 服务端流式方法以 application/x-ndjson 输出，每条消息一行
+	StreamNDJSON = "ndjson"
+
+	sseContentType    = "text/event-stream"
+	ndjsonContentType = "application/x-ndjson"
+)
+
+// streamStatus 流结束时输出的最终状态
+type streamStatus struct {
+	Code uint32 `json:"code"`
+	Msg  string `json:"msg"`
+}
+
+// streamWriter 服务端流式响应的输出，每条消息写入后立即 flush
+type streamWriter interface {
+	// WriteMessage 写入一条响应消息
+	WriteMessage(msg string) error
+	// WriteStatus 写入 gRPC 的最终状态，作为流的最后一个事件
+	WriteStatus(st *status.Status) error
+}
+
+// streamMode 确定服务端流式方法的输出方式，路由配置优先，其次按 Accept 头选择，默认 SSE
+func streamMode(r *http.Request, mode string) string {
+	switch strings.ToLower(mode) {
+	case StreamSSE:
+		return StreamSSE
+	case StreamNDJSON:
+		return StreamNDJSON
+	}
+
+	accept := r.Header.Get("Accept")
+	if strings.Contains(accept, ndjsonContentType) {
+		return StreamNDJSON
+	}
+
+	return StreamSSE
+}
+
+// newStreamWriter d 为路由的写超时，可以为 nil
+func newStreamWriter(w http.ResponseWriter, d *internal.StreamDeadline, mode string) streamWriter {
+	if mode == StreamNDJSON {
+		return &ndjsonWriter{w: w, d: d}
+	}
+
+	return &sseWriter{w: w, d: d}
+}
+
+// sseWriter 以 Server-Sent Events 输出
+type sseWriter struct {
+	w       http.ResponseWriter
+	d       *internal.StreamDeadline
+	started bool
+	id      int
+}
+
+func (s *sseWriter) WriteMessage(msg string) error {
+	s.id++
+	return s.writeEvent("message", msg)
+}
+
+func (s *sseWriter) WriteStatus(st *status.Status) error {
+	bs, err := json.Marshal(streamStatus{Code: uint32(st.Code()), Msg: st.Message()})
+	if err != nil {
+		return err
+	}
+
+	return s.writeEvent("status", string(bs))
+}
+
+func (s *sseWriter) writeEvent(event, data string) error {
+	if !s.started {
+		s.started = true
+		writeStreamHeader(s.w, sseContentType)
+	}
+
+	var sb strings.Builder
+	if event == "message" {
+		sb.WriteString(fmt.Sprintf("id: %d\n", s.id))
+	}
+	sb.WriteString("event: " + event + "\n")
+	for _, line := range strings.Split(data, "\n") {
+		sb.WriteString("data: " + strings.TrimSuffix(line, "\r") + "\n")
+	}
+	sb.WriteString("\n")
+
+	return writeAndFlush(s.w, s.d, sb.String())
+}
+
+// ndjsonWriter 以换行分隔的 JSON 输出
+type ndjsonWriter struct {
+	w       http.ResponseWriter
+	d       *internal.StreamDeadline
+	started bool
+}
+
+func (n *ndjsonWriter) WriteMessage(msg string) error {
+	// 一条消息必须占据单独一行
+	msg = strings.ReplaceAll(msg, "\r", "")
+	return n.writeLine(strings.ReplaceAll(msg, "\n", ""))
+}
+
+func (n *ndjsonWriter) WriteStatus(st *status.Status) error {
+	bs, err := json.Marshal(map[string]streamStatus{
+		"status": {Code: uint32(st.Code()), Msg: st.Message()},
+	})
+	if err != nil {
+		return err
+	}
+
+	return n.writeLine(string(bs))
+}
+
+func (n *ndjsonWriter) writeLine(line string) error {
+	if !n.started {
+		n.started = true
+		writeStreamHeader(n.w, ndjsonContentType)
+	}
+
+	return writeAndFlush(n.w, n.d, line+"\n")
+}
+
+func writeStreamHeader(w http.ResponseWriter, contentType string) {
+	w.Header().Set(httpx.ContentType, contentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+}
+
+func writeAndFlush(w http.ResponseWriter, d *internal.StreamDeadline, s string) error {
+	return d.Write(func() error {
+		if _, err := io.WriteString(w, s); err != nil {
+			return err
+		}
+
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+
+		return nil
+	})
+}
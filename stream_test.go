@@ -0,0 +1,81 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestStreamMode(t *testing.T) {
+	tests := []struct {
+		name   string
+		mode   string
+		accept string
+		expect string
+	}{
+		{name: "default", expect: StreamSSE},
+		{name: "route sse", mode: "SSE", accept: ndjsonContentType, expect: StreamSSE},
+		{name: "route ndjson", mode: "ndjson", expect: StreamNDJSON},
+		{name: "accept ndjson", accept: "application/x-ndjson, */*", expect: StreamNDJSON},
+		{name: "accept sse", accept: sseContentType, expect: StreamSSE},
+		{name: "unknown", mode: "xml", expect: StreamSSE},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
+			if len(test.accept) > 0 {
+				r.Header.Set("Accept", test.accept)
+			}
+			assert.Equal(t, test.expect, streamMode(r, test.mode))
+		})
+	}
+}
+
+func TestSseWriter(t *testing.T) {
+	w := httptest.NewRecorder()
+	sw := newStreamWriter(w, nil, StreamSSE)
+
+	assert.NoError(t, sw.WriteMessage(`{"id":1}`))
+	// 多行的消息每行一个 data
+	assert.NoError(t, sw.WriteMessage("{\r\n\"id\":2}"))
+	assert.NoError(t, sw.WriteStatus(status.New(codes.NotFound, "not found")))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, w.Flushed)
+	assert.Equal(t, sseContentType, w.Header().Get("Content-Type"))
+	assert.Equal(t, "no-cache", w.Header().Get("Cache-Control"))
+	assert.Equal(t, "no", w.Header().Get("X-Accel-Buffering"))
+	assert.Equal(t, "id: 1\nevent: message\ndata: {\"id\":1}\n\n"+
+		"id: 2\nevent: message\ndata: {\ndata: \"id\":2}\n\n"+
+		"event: status\ndata: {\"code\":5,\"msg\":\"not found\"}\n\n", w.Body.String())
+}
+
+func TestNdjsonWriter(t *testing.T) {
+	w := httptest.NewRecorder()
+	sw := newStreamWriter(w, nil, StreamNDJSON)
+
+	assert.NoError(t, sw.WriteMessage(`{"id":1}`))
+	// 一条消息必须占据单独一行
+	assert.NoError(t, sw.WriteMessage("{\r\n\"id\":2}"))
+	assert.NoError(t, sw.WriteStatus(status.New(codes.OK, "")))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, ndjsonContentType, w.Header().Get("Content-Type"))
+	assert.Equal(t, "{\"id\":1}\n{\"id\":2}\n{\"status\":{\"code\":0,\"msg\":\"\"}}\n", w.Body.String())
+}
+
+func TestStreamWriterStatusOnly(t *testing.T) {
+	// rpc 没有返回消息时，最终状态也会带上流式响应头
+	w := httptest.NewRecorder()
+	sw := newStreamWriter(w, nil, StreamSSE)
+	assert.NoError(t, sw.WriteStatus(status.New(codes.Unavailable, "down")))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, sseContentType, w.Header().Get("Content-Type"))
+	assert.Equal(t, "event: status\ndata: {\"code\":14,\"msg\":\"down\"}\n\n", w.Body.String())
+}
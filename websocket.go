@@ -0,0 +1,113 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/fullstorydev/grpcurl"
+	"github.com/punpeo/pun-gateway-lib/internal"
+	"github.com/zeromicro/go-zero/core/logx"
+	"github.com/zeromicro/go-zero/rest/pathvar"
+	"golang.org/x/net/websocket"
+	"google.golang.org/grpc/status"
+)
+
+// wsWriter 以 WebSocket 帧输出响应，每条消息一帧
+type wsWriter struct {
+	conn *websocket.Conn
+}
+
+func (ws *wsWriter) WriteMessage(msg string) error {
+	return websocket.Message.Send(ws.conn, msg)
+}
+
+func (ws *wsWriter) WriteStatus(st *status.Status) error {
+	bs, err := json.Marshal(map[string]streamStatus{
+		"status": {Code: uint32(st.Code()), Msg: st.Message()},
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := websocket.Message.Send(ws.conn, string(bs)); err != nil {
+		return err
+	}
+
+	return ws.conn.Close()
+}
+
+// checkOrigin 没有 Origin 头的请求（如 php 等服务端调用方）直接允许，有 Origin 时按 WebSocketOrigins 检查
+func (s *Server) checkOrigin(config *websocket.Config, r *http.Request) error {
+	origin, err := websocket.Origin(config, r)
+	if err != nil {
+		return err
+	}
+	if origin == nil {
+		return nil
+	}
+
+	if !internal.OriginAllowed(origin, RequestConfig(r, s.Config).WebSocketOrigins) {
+		return fmt.Errorf("websocket origin 不允许：%s", origin)
+	}
+	config.Origin = origin
+
+	return nil
+}
+
+// buildWebSocketHandler 将路由升级为 WebSocket，桥接客户端流式和双向流式方法
+// 每个入站帧解析为一条请求消息，空帧表示请求发送完毕，每条响应消息作为一帧返回，
+// 最后一帧为 gRPC 的最终状态
+func (s *Server) buildWebSocketHandler(pm *PluginManager, t rpcTarget) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if t.tpl != nil {
+			r = pathvar.WithVars(r, t.tpl.Vars(pathvar.Vars(r)))
+		}
+
+		// 插件在 http 中间件中中止请求时不升级连接，直接输出错误
+		if abort := PluginContextFromRequest(r).Err(); abort != nil {
+			logx.WithContext(r.Context()).Infof("插件中止请求,%v", abort)
+			t.format(w, &Response{Request: r, Status: status.Convert(abort), err: abort})
+			return
+		}
+
+		websocket.Server{Handshake: s.checkOrigin, Handler: func(conn *websocket.Conn) {
+			// 连接劫持后仍保留 http.Server 设置的读写超时，长连接需要清除
+			if err := conn.SetDeadline(time.Time{}); err != nil {
+				logx.Error(err)
+			}
+
+			handler := pm.GetRpcHandler(w, r, t.resolver, t.origName, "")
+			handler.stream = &wsWriter{conn: conn}
+
+			parser, err := internal.NewFrameRequestParser(r, t.resolver, func() (string, error) {
+				var frame string
+				err := websocket.Message.Receive(conn, &frame)
+				return frame, err
+			})
+			if err != nil {
+				handler.finishStream(status.Convert(err))
+				return
+			}
+
+			ctx, cancel := handler.pc.withCancel(r.Context())
+			defer cancel()
+
+			err = grpcurl.InvokeRPC(ctx, t.source, t.cli.Conn(), t.rpcPath, s.prepareMetadata(r.Header, r),
+				handler, parser.Next)
+			if abort := handler.pc.Err(); abort != nil {
+				// 插件中止了请求
+				handler.finishStream(status.Convert(abort))
+				return
+			}
+			if err != nil {
+				logx.Errorf("rpc调用失败,%+v", err.Error())
+				handler.finishStream(status.Convert(err))
+				return
+			}
+
+			handler.finishStream(handler.Status)
+		}}.ServeHTTP(w, r)
+	}
+}